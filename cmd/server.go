@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/lattots/salpa/internal/config"
 	"github.com/lattots/salpa/internal/handler"
@@ -42,7 +45,15 @@ func main() {
 
 	log.Println("Created token manager")
 
-	h, err := handler.CreateHandlerFromConf(conf, tokenManager)
+	if interval := conf.Service.KeyRotationInterval; interval > 0 {
+		go tokenManager.RunKeyRotation(context.Background(), interval)
+		log.Printf("Signing key is rotated every %s\n", interval)
+	}
+
+	// Signing key can also be rotated on demand by sending SIGHUP to the server
+	go rotateKeyOnSignal(tokenManager)
+
+	h, err := handler.CreateHandlerFromConf(conf, tokenManager, tokenStore)
 	if err != nil {
 		log.Fatalln("error creating http handler:", err)
 	}
@@ -60,3 +71,13 @@ func main() {
 		log.Fatalln("unexpected error: ", err)
 	}
 }
+
+func rotateKeyOnSignal(tokenManager *token.Manager) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := tokenManager.RotateSigningKey(); err != nil {
+			log.Printf("failed to rotate signing key: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/google/uuid"
+)
+
+// Store is the part of the token store the account manager uses.
+type Store interface {
+	store.UserStore
+	store.LocalUserStore
+	store.WebAuthnStore
+	store.OneTimeTokenStore
+}
+
+// Manager maps provider logins to Salpa users, so one person has one user ID whichever provider they log in with.
+type Manager struct {
+	store Store
+	// Link the first login of a provider identity to the user with the same verified email
+	linkByEmail bool
+	// Called before a new user is created, nil allows every sign-up
+	signUp SignUpFunc
+}
+
+// SignUpFunc decides whether a provider login may create a new user. An error stops the login.
+type SignUpFunc func(ctx context.Context, email string, emailVerified bool) error
+
+const (
+	purposeLink = "link_identity"
+	linkTTL     = 10 * time.Minute
+)
+
+var (
+	ErrIdentityInUse     = errors.New("this login is already linked to another user")
+	ErrInvalidLink       = errors.New("link request is invalid or has expired")
+	ErrIdentityNotFound  = errors.New("no such login linked to the user")
+	ErrLastLoginMethod   = errors.New("can't remove the only way to log in")
+	ErrUnknownProviderID = errors.New("provider returned no user ID")
+)
+
+func NewManagerFromConf(conf config.SystemConfiguration, s Store) *Manager {
+	return NewManager(s, !conf.Accounts.DisableEmailLinking)
+}
+
+func NewManager(s Store, linkByEmail bool) *Manager {
+	return &Manager{store: s, linkByEmail: linkByEmail}
+}
+
+// SetSignUpCheck sets the function that decides whether a provider login may create a new user.
+func (m *Manager) SetSignUpCheck(signUp SignUpFunc) {
+	m.signUp = signUp
+}
+
+// ResolveIdentity returns the Salpa user of a provider login. The first login of an identity is linked to
+// the user with the same verified email, or creates a new user if there is none.
+func (m *Manager) ResolveIdentity(ctx context.Context, provider string, providerUser models.User) (models.Account, error) {
+	if providerUser.GetID() == "" {
+		return models.Account{}, ErrUnknownProviderID
+	}
+
+	identity, err := m.store.GetIdentity(ctx, provider, providerUser.GetID())
+	if err == nil {
+		return m.store.GetUser(ctx, identity.UserID)
+	}
+	if !errors.Is(err, store.ErrIdentityNotFound) {
+		return models.Account{}, err
+	}
+
+	email, verified := util.ProviderEmail(providerUser)
+	identity = models.Identity{
+		Provider:  provider,
+		Subject:   providerUser.GetID(),
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+
+	// An unverified email could belong to anyone, so it never links to an existing user
+	if verified && m.linkByEmail {
+		user, err := m.store.GetUserByVerifiedEmail(ctx, email)
+		if err == nil {
+			identity.UserID = user.ID
+			err = m.store.AddIdentity(ctx, identity)
+			if errors.Is(err, store.ErrIdentityExists) {
+				return m.retryResolve(ctx, identity)
+			}
+			if err != nil {
+				return models.Account{}, err
+			}
+			return m.addName(ctx, user, providerUser)
+		}
+		if !errors.Is(err, store.ErrUserNotFound) {
+			return models.Account{}, err
+		}
+	}
+
+	if m.signUp != nil {
+		if err = m.signUp(ctx, email, verified); err != nil {
+			return models.Account{}, err
+		}
+	}
+
+	user := models.Account{
+		ID:            uuid.NewString(),
+		Email:         email,
+		EmailVerified: verified,
+		Name:          providerName(providerUser),
+		CreatedAt:     time.Now(),
+	}
+	identity.UserID = user.ID
+	err = m.store.AddUserWithIdentity(ctx, user, identity)
+	if errors.Is(err, store.ErrIdentityExists) {
+		return m.retryResolve(ctx, identity)
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+	return user, nil
+}
+
+// addName stores the name the provider told for a user who has none. Some providers, like Apple, only tell the
+// name on the first login, so it's kept on the user when the identity is linked.
+func (m *Manager) addName(ctx context.Context, user models.Account, providerUser models.User) (models.Account, error) {
+	name := providerName(providerUser)
+	if name == "" || user.Name != "" {
+		return user, nil
+	}
+	if err := m.store.SetUserName(ctx, user.ID, name); err != nil {
+		return models.Account{}, err
+	}
+	user.Name = name
+	return user, nil
+}
+
+func providerName(providerUser models.User) string {
+	if namedUser, ok := providerUser.(models.NamedUser); ok {
+		return strings.TrimSpace(namedUser.GetName())
+	}
+	return ""
+}
+
+// retryResolve returns the user of an identity that a concurrent first login linked first.
+func (m *Manager) retryResolve(ctx context.Context, identity models.Identity) (models.Account, error) {
+	existing, err := m.store.GetIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil {
+		return models.Account{}, err
+	}
+	return m.store.GetUser(ctx, existing.UserID)
+}
+
+// BeginLink starts linking a provider identity to a signed in user. The returned token must come back
+// with the provider callback of the same login, whose state it's bound to.
+func (m *Manager) BeginLink(ctx context.Context, user models.User, loginState string) (string, error) {
+	token, hash := util.NewOneTimeToken()
+	err := m.store.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:      hash,
+		Purpose:   purposeLink,
+		UserID:    user.GetID(),
+		Email:     user.GetEmail(),
+		Data:      loginState,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(linkTTL),
+	})
+	return token, err
+}
+
+// FinishLink links the provider identity of the callback to the user who started the link.
+// Linking an identity that is already linked to the same user is not an error.
+func (m *Manager) FinishLink(ctx context.Context, token, loginState, provider string, providerUser models.User) (models.Account, error) {
+	if token == "" {
+		return models.Account{}, ErrInvalidLink
+	}
+	t, err := m.store.ConsumeOneTimeToken(ctx, util.HashOneTimeToken(token), purposeLink)
+	if errors.Is(err, store.ErrTokenNotFound) || (err == nil && t.Data != loginState) {
+		return models.Account{}, ErrInvalidLink
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+	if providerUser.GetID() == "" {
+		return models.Account{}, ErrUnknownProviderID
+	}
+
+	email, _ := util.ProviderEmail(providerUser)
+	err = m.store.AddIdentity(ctx, models.Identity{
+		Provider:  provider,
+		Subject:   providerUser.GetID(),
+		UserID:    t.UserID,
+		Email:     email,
+		CreatedAt: time.Now(),
+	})
+	if errors.Is(err, store.ErrIdentityExists) {
+		existing, err := m.store.GetIdentity(ctx, provider, providerUser.GetID())
+		if err != nil {
+			return models.Account{}, err
+		}
+		if existing.UserID != t.UserID {
+			return models.Account{}, ErrIdentityInUse
+		}
+	} else if err != nil {
+		return models.Account{}, err
+	}
+
+	user, err := m.store.GetUser(ctx, t.UserID)
+	if err != nil {
+		return models.Account{}, err
+	}
+	return m.addName(ctx, user, providerUser)
+}
+
+func (m *Manager) ListIdentities(ctx context.Context, userID string) ([]models.Identity, error) {
+	return m.store.ListIdentities(ctx, userID)
+}
+
+// UnlinkIdentity removes a provider identity from the user. The user must keep another way to log in:
+// another identity, a local account or a passkey.
+func (m *Manager) UnlinkIdentity(ctx context.Context, userID, provider, subject string) error {
+	identities, err := m.store.ListIdentities(ctx, userID)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, identity := range identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			found = true
+		}
+	}
+	if !found {
+		return ErrIdentityNotFound
+	}
+
+	if len(identities) == 1 {
+		hasOther, err := m.hasOtherLoginMethod(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !hasOther {
+			return ErrLastLoginMethod
+		}
+	}
+
+	err = m.store.RemoveIdentity(ctx, userID, provider, subject)
+	if errors.Is(err, store.ErrIdentityNotFound) {
+		return ErrIdentityNotFound
+	}
+	return err
+}
+
+func (m *Manager) hasOtherLoginMethod(ctx context.Context, userID string) (bool, error) {
+	user, err := m.store.GetUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	local, err := m.store.GetLocalUserByEmail(ctx, user.Email)
+	if err == nil && local.ID == userID {
+		return true, nil
+	}
+	if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		return false, err
+	}
+
+	passkeys, err := m.store.ListWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return len(passkeys) > 0, nil
+}
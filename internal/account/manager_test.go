@@ -0,0 +1,288 @@
+package account_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+type providerUser struct {
+	id       string
+	email    string
+	verified bool
+}
+
+func (u providerUser) GetID() string         { return u.id }
+func (u providerUser) GetEmail() string      { return u.email }
+func (u providerUser) IsEmailVerified() bool { return u.verified }
+
+// namedUser is a provider user whose provider tells the name, like Apple on the first login.
+type namedUser struct {
+	providerUser
+	name string
+}
+
+func (u namedUser) GetName() string { return u.name }
+
+func initManager(t *testing.T, linkByEmail bool) (*account.Manager, store.Store) {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+	return account.NewManager(tokenStore, linkByEmail), tokenStore
+}
+
+func TestResolveIdentity(t *testing.T) {
+	manager, _ := initManager(t, true)
+	ctx := context.Background()
+
+	first, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "Test@Example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if first.ID == "g-1" || first.Email != "test@example.com" {
+		t.Errorf("unexpected user: %+v\n", first)
+	}
+	again, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("same identity should get the same user, want %s got %s\n", first.ID, again.ID)
+	}
+
+	linked, err := manager.ResolveIdentity(ctx, "github", providerUser{"gh-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if linked.ID != first.ID {
+		t.Errorf("verified email should link to the existing user, want %s got %s\n", first.ID, linked.ID)
+	}
+
+	unverified, err := manager.ResolveIdentity(ctx, "oidc", providerUser{"o-1", "test@example.com", false})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if unverified.ID == first.ID {
+		t.Error("unverified email must not link to the existing user\n")
+	}
+
+	if _, err = manager.ResolveIdentity(ctx, "google", providerUser{"", "x@example.com", true}); !errors.Is(err, account.ErrUnknownProviderID) {
+		t.Errorf("expected ErrUnknownProviderID, got %v\n", err)
+	}
+}
+
+func TestResolveIdentity_EmailLinkingDisabled(t *testing.T) {
+	manager, _ := initManager(t, false)
+	ctx := context.Background()
+
+	first, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	second, err := manager.ResolveIdentity(ctx, "github", providerUser{"gh-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if first.ID == second.ID {
+		t.Error("identities should not be linked by email when linking is disabled\n")
+	}
+}
+
+func TestLink(t *testing.T) {
+	manager, _ := initManager(t, true)
+	ctx := context.Background()
+
+	user, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	other, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-2", "other@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+
+	token, err := manager.BeginLink(ctx, user, "state-1")
+	if err != nil {
+		t.Fatalf("failed to begin link: %s\n", err)
+	}
+	if _, err = manager.FinishLink(ctx, token, "state-2", "github", providerUser{"gh-1", "different@example.com", false}); !errors.Is(err, account.ErrInvalidLink) {
+		t.Errorf("link with another login state should be rejected, got %v\n", err)
+	}
+	if _, err = manager.FinishLink(ctx, token, "state-1", "github", providerUser{"gh-1", "different@example.com", false}); !errors.Is(err, account.ErrInvalidLink) {
+		t.Errorf("link token should only be used once, got %v\n", err)
+	}
+
+	token, err = manager.BeginLink(ctx, user, "state-3")
+	if err != nil {
+		t.Fatalf("failed to begin link: %s\n", err)
+	}
+	linked, err := manager.FinishLink(ctx, token, "state-3", "github", providerUser{"gh-1", "different@example.com", false})
+	if err != nil {
+		t.Fatalf("failed to finish link: %s\n", err)
+	}
+	if linked.ID != user.ID {
+		t.Errorf("identity should be linked to %s, got %s\n", user.ID, linked.ID)
+	}
+	resolved, err := manager.ResolveIdentity(ctx, "github", providerUser{"gh-1", "different@example.com", false})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if resolved.ID != user.ID {
+		t.Errorf("linked identity should log in as %s, got %s\n", user.ID, resolved.ID)
+	}
+
+	// Identity of another user can't be taken over
+	token, err = manager.BeginLink(ctx, user, "state-4")
+	if err != nil {
+		t.Fatalf("failed to begin link: %s\n", err)
+	}
+	if _, err = manager.FinishLink(ctx, token, "state-4", "google", providerUser{"g-2", other.Email, true}); !errors.Is(err, account.ErrIdentityInUse) {
+		t.Errorf("expected ErrIdentityInUse, got %v\n", err)
+	}
+}
+
+func TestResolveIdentity_Name(t *testing.T) {
+	manager, tokenStore := initManager(t, true)
+	ctx := context.Background()
+
+	first, err := manager.ResolveIdentity(ctx, "apple", namedUser{providerUser{"a-1", "test@example.com", true}, "Test User"})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if first.Name != "Test User" {
+		t.Errorf("name of the first login should be kept, got %q\n", first.Name)
+	}
+	// Apple leaves the name out of later logins
+	again, err := manager.ResolveIdentity(ctx, "apple", providerUser{"a-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if again.Name != "Test User" {
+		t.Errorf("stored name should be returned on later logins, got %q\n", again.Name)
+	}
+	if stored, err := tokenStore.GetUser(ctx, first.ID); err != nil || stored.Name != "Test User" {
+		t.Errorf("name should be stored, got %+v %v\n", stored, err)
+	}
+
+	// Identity linked by email gives its name to a user who has none
+	unnamed, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "other@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	linked, err := manager.ResolveIdentity(ctx, "apple", namedUser{providerUser{"a-2", "other@example.com", true}, "Other User"})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if linked.ID != unnamed.ID || linked.Name != "Other User" {
+		t.Errorf("unexpected user: %+v\n", linked)
+	}
+	// A name the user already has isn't replaced
+	renamed, err := manager.ResolveIdentity(ctx, "github", namedUser{providerUser{"gh-1", "other@example.com", true}, "Someone Else"})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if renamed.Name != "Other User" {
+		t.Errorf("existing name should be kept, got %q\n", renamed.Name)
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	manager, tokenStore := initManager(t, true)
+	ctx := context.Background()
+
+	user, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	if err = manager.UnlinkIdentity(ctx, user.ID, "google", "g-1"); !errors.Is(err, account.ErrLastLoginMethod) {
+		t.Errorf("only identity should not be removable, got %v\n", err)
+	}
+	if err = manager.UnlinkIdentity(ctx, user.ID, "github", "g-1"); !errors.Is(err, account.ErrIdentityNotFound) {
+		t.Errorf("expected ErrIdentityNotFound, got %v\n", err)
+	}
+
+	err = tokenStore.AddWebAuthnCredential(ctx, models.WebAuthnCredential{
+		ID:        "cred_abc",
+		UserID:    user.ID,
+		Email:     user.Email,
+		PublicKey: []byte("key"),
+		Algorithm: -7,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add passkey: %s\n", err)
+	}
+	if err = manager.UnlinkIdentity(ctx, user.ID, "google", "g-1"); err != nil {
+		t.Errorf("identity should be removable when the user has a passkey, got %v\n", err)
+	}
+	identities, err := manager.ListIdentities(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("failed to list identities: %s\n", err)
+	}
+	if len(identities) != 0 {
+		t.Errorf("expected no identities, got %+v\n", identities)
+	}
+}
+
+func TestUnlinkIdentity_SameProvider(t *testing.T) {
+	manager, tokenStore := initManager(t, true)
+	ctx := context.Background()
+
+	user, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	second := models.Identity{Provider: "google", Subject: "g-2", UserID: user.ID, Email: "other@example.com", CreatedAt: time.Now()}
+	if err = tokenStore.AddIdentity(ctx, second); err != nil {
+		t.Fatalf("failed to add identity: %s\n", err)
+	}
+
+	if err = manager.UnlinkIdentity(ctx, user.ID, "google", "g-1"); err != nil {
+		t.Fatalf("failed to unlink identity: %s\n", err)
+	}
+	// Only the second account of the provider is left, so it's the last way to log in
+	if err = manager.UnlinkIdentity(ctx, user.ID, "google", "g-2"); !errors.Is(err, account.ErrLastLoginMethod) {
+		t.Errorf("only identity should not be removable, got %v\n", err)
+	}
+	identities, err := manager.ListIdentities(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("failed to list identities: %s\n", err)
+	}
+	if len(identities) != 1 || identities[0].Subject != "g-2" {
+		t.Errorf("unexpected identities: %+v\n", identities)
+	}
+}
+
+func TestResolveIdentity_SignUpCheck(t *testing.T) {
+	manager, _ := initManager(t, true)
+	ctx := context.Background()
+
+	errClosed := errors.New("sign-ups are closed")
+	existing, err := manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true})
+	if err != nil {
+		t.Fatalf("failed to resolve identity: %s\n", err)
+	}
+	manager.SetSignUpCheck(func(ctx context.Context, email string, emailVerified bool) error {
+		return errClosed
+	})
+
+	if _, err = manager.ResolveIdentity(ctx, "google", providerUser{"g-2", "new@example.com", true}); !errors.Is(err, errClosed) {
+		t.Errorf("new user should be checked, got %v\n", err)
+	}
+	// Existing users and identities linked to them are not sign-ups
+	if _, err = manager.ResolveIdentity(ctx, "google", providerUser{"g-1", "test@example.com", true}); err != nil {
+		t.Errorf("existing identity should log in, got %v\n", err)
+	}
+	linked, err := manager.ResolveIdentity(ctx, "github", providerUser{"gh-1", "test@example.com", true})
+	if err != nil || linked.ID != existing.ID {
+		t.Errorf("identity linked by email should log in as %s, got %+v %v\n", existing.ID, linked, err)
+	}
+}
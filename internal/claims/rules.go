@@ -0,0 +1,114 @@
+package claims
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+)
+
+// Rules decide the roles, groups and custom claims of a session from the claim rules of the configuration.
+type Rules struct {
+	rules []rule
+	users store.UserStore
+}
+
+type rule struct {
+	emails    []string
+	domains   []string
+	providers []string
+	claims    models.SessionClaims
+}
+
+func NewRulesFromConf(conf config.SystemConfiguration, users store.UserStore) (*Rules, error) {
+	return NewRules(conf.Claims.Rules, users)
+}
+
+// NewRules checks the rules and prepares them for matching.
+func NewRules(confRules []config.ClaimsRule, users store.UserStore) (*Rules, error) {
+	rules := make([]rule, 0, len(confRules))
+	for i, confRule := range confRules {
+		r := rule{
+			providers: confRule.Providers,
+			claims: models.SessionClaims{
+				Roles:  confRule.Roles,
+				Groups: confRule.Groups,
+				Extra:  confRule.Claims,
+			},
+		}
+		for _, email := range confRule.Emails {
+			normalized, err := util.NormalizeEmail(email)
+			if err != nil {
+				return nil, fmt.Errorf("claim rule %d: invalid email %q", i, email)
+			}
+			r.emails = append(r.emails, normalized)
+		}
+		for _, domain := range confRule.Domains {
+			r.domains = append(r.domains, strings.ToLower(strings.TrimPrefix(domain, "@")))
+		}
+		for name := range confRule.Claims {
+			if models.IsReservedClaim(name) {
+				return nil, fmt.Errorf("claim rule %d: claim %s is set by Salpa", i, name)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return &Rules{rules: rules, users: users}, nil
+}
+
+// Resolve returns the claims of every rule that matches the login.
+// Emails only match once the user has verified them, so nobody gets a role by signing up with someone else's address.
+func (r *Rules) Resolve(ctx context.Context, provider string, user models.User) (models.SessionClaims, error) {
+	var claims models.SessionClaims
+	if len(r.rules) == 0 {
+		return claims, nil
+	}
+
+	email, err := r.verifiedEmail(ctx, user)
+	if err != nil {
+		return claims, err
+	}
+	for _, rule := range r.rules {
+		if rule.matches(provider, email) {
+			claims = claims.Merge(rule.claims)
+		}
+	}
+	return claims, nil
+}
+
+// verifiedEmail returns the email of the user if the user has verified it, otherwise an empty string
+func (r *Rules) verifiedEmail(ctx context.Context, user models.User) (string, error) {
+	account, err := r.users.GetUser(ctx, user.GetID())
+	if errors.Is(err, store.ErrUserNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !account.EmailVerified {
+		return "", nil
+	}
+	return account.Email, nil
+}
+
+func (r rule) matches(provider, email string) bool {
+	if len(r.providers) > 0 && !slices.Contains(r.providers, provider) {
+		return false
+	}
+	if len(r.emails) > 0 && !slices.Contains(r.emails, email) {
+		return false
+	}
+	if len(r.domains) > 0 {
+		_, domain, found := strings.Cut(email, "@")
+		if !found || !slices.Contains(r.domains, domain) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package claims_test
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/claims"
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+func initStore(t *testing.T) store.Store {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+	return tokenStore
+}
+
+func addUser(t *testing.T, s store.Store, id, email string, verified bool) models.Account {
+	user := models.Account{ID: id, Email: email, EmailVerified: verified, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: id, UserID: id, Email: email, CreatedAt: time.Now()}
+	if err := s.AddUserWithIdentity(context.Background(), user, identity); err != nil {
+		t.Fatalf("failed to add user: %s\n", err)
+	}
+	return user
+}
+
+func TestRulesResolve(t *testing.T) {
+	tokenStore := initStore(t)
+	rules, err := claims.NewRules([]config.ClaimsRule{
+		{Roles: []string{"user"}},
+		{Domains: []string{"@Example.com"}, Groups: []string{"staff"}, Claims: map[string]any{"tenantID": "example"}},
+		{Emails: []string{"Admin@example.com"}, Providers: []string{"google"}, Roles: []string{"admin"}},
+	}, tokenStore)
+	if err != nil {
+		t.Fatalf("failed to create rules: %s\n", err)
+	}
+	ctx := context.Background()
+
+	admin := addUser(t, tokenStore, "user-1", "admin@example.com", true)
+	got, err := rules.Resolve(ctx, "google", admin)
+	if err != nil {
+		t.Fatalf("failed to resolve claims: %s\n", err)
+	}
+	if !slices.Equal(got.Roles, []string{"user", "admin"}) || !slices.Equal(got.Groups, []string{"staff"}) {
+		t.Errorf("unexpected roles or groups: %+v\n", got)
+	}
+	if got.Extra["tenantID"] != "example" {
+		t.Errorf("unexpected custom claims: %v\n", got.Extra)
+	}
+
+	// Provider condition of the admin rule doesn't match
+	got, err = rules.Resolve(ctx, "github", admin)
+	if err != nil {
+		t.Fatalf("failed to resolve claims: %s\n", err)
+	}
+	if slices.Contains(got.Roles, "admin") {
+		t.Errorf("admin rule should only match google logins: %+v\n", got)
+	}
+
+	// Unverified email matches only the rule without conditions
+	unverified := addUser(t, tokenStore, "user-2", "admin2@example.com", false)
+	got, err = rules.Resolve(ctx, "google", unverified)
+	if err != nil {
+		t.Fatalf("failed to resolve claims: %s\n", err)
+	}
+	if !slices.Equal(got.Roles, []string{"user"}) || len(got.Groups) != 0 || len(got.Extra) != 0 {
+		t.Errorf("unverified email should not match email rules: %+v\n", got)
+	}
+}
+
+func TestRulesReservedClaim(t *testing.T) {
+	_, err := claims.NewRules([]config.ClaimsRule{{Claims: map[string]any{"sub": "someone-else"}}}, initStore(t))
+	if err == nil {
+		t.Error("rule with a reserved claim should be rejected\n")
+	}
+}
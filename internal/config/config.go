@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -35,11 +36,188 @@ type SystemConfiguration struct {
 	Providers map[string]ProviderConfig `yaml:"providers"`
 	Store     StoreConfig               `yaml:"store"`
 	Service   ServiceConfiguration      `yaml:"service"`
+	Password  PasswordConfig            `yaml:"password"`
+	MagicLink MagicLinkConfig           `yaml:"magicLink"`
+	WebAuthn  WebAuthnConfig            `yaml:"webauthn"`
+	MFA       MFAConfig                 `yaml:"mfa"`
+	Accounts  AccountsConfig            `yaml:"accounts"`
+	Hook      HookConfig                `yaml:"hook"`
+	Claims    ClaimsConfig              `yaml:"claims"`
+	Policy    PolicyConfig              `yaml:"policy"`
+	Admin     AdminConfig               `yaml:"admin"`
+	Mail      MailConfig                `yaml:"mail"`
 }
 
 type ProviderConfig struct {
 	Active               bool              `yaml:"active"`
 	EnvironmentVariables map[string]string `yaml:"env"`
+
+	// Type of the provider, defaults to the provider name.
+	// Setting the type allows configuring e.g. multiple OpenID Connect providers under different names.
+	Type string `yaml:"type"`
+
+	// Issuer URL used to discover OpenID Connect providers
+	Issuer string `yaml:"issuer"`
+	// Scopes requested from the provider, defaults depend on the provider type
+	Scopes []string `yaml:"scopes"`
+
+	// Microsoft authority tenant: common, organizations or a tenant ID
+	Tenant string `yaml:"tenant"`
+	// IDs of the Microsoft tenants allowed to log in, any tenant is allowed when empty
+	AllowedTenants []string `yaml:"allowedTenants"`
+
+	// Apple private key (.p8) used to sign the client secret
+	PrivateKeyFilename string `yaml:"privateKeyFilename"`
+
+	// Endpoints of a generic OAuth2 provider
+	AuthURL     string `yaml:"authURL"`
+	TokenURL    string `yaml:"tokenURL"`
+	UserInfoURL string `yaml:"userInfoURL"`
+	// Dot separated paths of the user ID and email in the userinfo response, default to "id" and "email"
+	IDField    string `yaml:"idField"`
+	EmailField string `yaml:"emailField"`
+}
+
+func (c ProviderConfig) ProviderType(name string) string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return name
+}
+
+// PasswordConfig configures the built-in email and password provider.
+type PasswordConfig struct {
+	Active bool `yaml:"active"`
+	// Without registration, accounts can only be created by other means, e.g. directly in the database
+	AllowRegistration bool `yaml:"allowRegistration"`
+	MinLength         int  `yaml:"minLength"`
+	// Users can't log in before they have verified their email address
+	RequireVerifiedEmail bool `yaml:"requireVerifiedEmail"`
+	// Page of the client application with the new password form, the reset token is added as the token query parameter.
+	// Defaults to {appDomain}/reset-password.
+	ResetURL string `yaml:"resetURL"`
+
+	// Argon2id parameters, zero values fall back to the defaults
+	Argon2 Argon2Config `yaml:"argon2"`
+	// Passwords hashed at the same time, every hash takes the Argon2id memory. Defaults to 4.
+	MaxConcurrentHashes int `yaml:"maxConcurrentHashes"`
+	// Verification and reset emails sent to a single address in an hour, defaults to 5
+	MaxEmailsPerHour int `yaml:"maxEmailsPerHour"`
+}
+
+type Argon2Config struct {
+	Memory      uint32 `yaml:"memory"` // KiB
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+}
+
+// MagicLinkConfig configures passwordless login with links sent by email.
+type MagicLinkConfig struct {
+	Active bool `yaml:"active"`
+	// Opening a link sent to an unknown address creates an account
+	AllowRegistration bool `yaml:"allowRegistration"`
+	// How long a link can be used, defaults to 15 minutes
+	TTL time.Duration `yaml:"ttl"`
+	// Links sent to a single address in an hour, defaults to 5
+	MaxPerHour int `yaml:"maxPerHour"`
+}
+
+// WebAuthnConfig configures passkey login.
+type WebAuthnConfig struct {
+	Active bool `yaml:"active"`
+	// Domain passkeys are bound to, defaults to the host of the app domain
+	RPID string `yaml:"rpID"`
+	// Name shown by authenticators, defaults to the rpID
+	RPName string `yaml:"rpName"`
+	// Origins of the pages that register and use passkeys, defaults to the app domain
+	Origins []string `yaml:"origins"`
+	// required, preferred or discouraged. Defaults to preferred.
+	UserVerification string `yaml:"userVerification"`
+	// How long a ceremony can take, defaults to 5 minutes
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// MFAConfig configures TOTP second factors.
+type MFAConfig struct {
+	Active bool `yaml:"active"`
+	// Name shown in authenticator apps, defaults to the host of the app domain
+	Issuer string `yaml:"issuer"`
+	// Client application page that asks for the code, defaults to appDomain + "/mfa"
+	ChallengeURL string `yaml:"challengeURL"`
+}
+
+// AccountsConfig configures how provider logins are mapped to users.
+type AccountsConfig struct {
+	// By default the first login with a provider is linked to the user who has the same verified email
+	DisableEmailLinking bool `yaml:"disableEmailLinking"`
+}
+
+// HookConfig configures the webhook that can deny logins or add claims before a session is created.
+type HookConfig struct {
+	// Endpoint the logins are posted to, no webhook is called when empty
+	URL string `yaml:"url"`
+	// Environment variable of the secret the requests are signed with, under the key secret
+	EnvironmentVariables map[string]string `yaml:"env"`
+	// How long to wait for the webhook, defaults to 5 seconds
+	Timeout time.Duration `yaml:"timeout"`
+	// Let users log in when the webhook fails. By default the login is denied.
+	FailOpen bool `yaml:"failOpen"`
+}
+
+// ClaimsConfig configures the roles, groups and custom claims of access tokens.
+type ClaimsConfig struct {
+	// Every matching rule adds its claims. Custom claims of later rules replace the ones of earlier rules.
+	Rules []ClaimsRule `yaml:"rules"`
+}
+
+// ClaimsRule gives claims to the users it matches. Every condition that is set must match,
+// a rule without conditions matches every user.
+type ClaimsRule struct {
+	// Verified email addresses and their domains
+	Emails  []string `yaml:"emails"`
+	Domains []string `yaml:"domains"`
+	// Names of the providers or login methods used to log in
+	Providers []string `yaml:"providers"`
+
+	Roles  []string       `yaml:"roles"`
+	Groups []string       `yaml:"groups"`
+	Claims map[string]any `yaml:"claims"`
+}
+
+// PolicyConfig restricts who can log in with a provider.
+type PolicyConfig struct {
+	// Only verified emails of these domains and the allowed emails can log in. Any email can log in when both are empty.
+	AllowedDomains []string `yaml:"allowedDomains"`
+	AllowedEmails  []string `yaml:"allowedEmails"`
+	// Emails of these domains can't log in, even if they are allowed otherwise
+	BlockedDomains []string `yaml:"blockedDomains"`
+	// Users whose provider hasn't verified their email can't log in
+	RequireVerifiedEmail bool `yaml:"requireVerifiedEmail"`
+	// New users need an invitation, which is created with the admin API
+	InviteOnly bool `yaml:"inviteOnly"`
+}
+
+// AdminConfig configures access to the admin API. The API is only available when either way to access it is set.
+type AdminConfig struct {
+	// Environment variable of a comma separated list of API keys, under the key apiKeys
+	EnvironmentVariables map[string]string `yaml:"env"`
+	// Users with this role in their access token can use the admin API
+	Role string `yaml:"role"`
+}
+
+// MailConfig configures how Salpa sends emails.
+type MailConfig struct {
+	// smtp, file or log. Defaults to log.
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+
+	// SMTP server, the username and password are read from the environment variables in env
+	Host                 string            `yaml:"host"`
+	Port                 int               `yaml:"port"`
+	EnvironmentVariables map[string]string `yaml:"env"`
+
+	// File the file driver appends emails to
+	Filename string `yaml:"filename"`
 }
 
 type StoreConfig struct {
@@ -50,8 +228,41 @@ type StoreConfig struct {
 type ServiceConfiguration struct {
 	PrivateKeyFilename string `yaml:"privateKeyFilename"`
 
+	// Signing key is rotated when it gets older than this. Zero disables scheduled rotation.
+	KeyRotationInterval time.Duration `yaml:"keyRotationInterval"`
+
 	Port int `yaml:"port"`
 
 	ServiceDomain string `yaml:"serviceDomain"`
 	AppDomain     string `yaml:"appDomain"`
+
+	// Origins with an optional path prefix users can be sent back to after login and logout.
+	// Defaults to the app domain.
+	AllowedReturnTo []string `yaml:"allowedReturnTo"`
+
+	// Header the reverse proxy puts the client address in, e.g. X-Forwarded-For or X-Real-IP.
+	// Rate limits count requests by the address, which is the proxy's own without the header.
+	ClientIPHeader string `yaml:"clientIPHeader"`
+
+	// Values of the iss and aud claims of access tokens.
+	// Issuer defaults to the service domain and audience to the app domain.
+	Issuer   string   `yaml:"issuer"`
+	Audience []string `yaml:"audience"`
+}
+
+func (c ServiceConfiguration) TokenIssuer() string {
+	if c.Issuer != "" {
+		return c.Issuer
+	}
+	return c.ServiceDomain
+}
+
+func (c ServiceConfiguration) TokenAudience() []string {
+	if len(c.Audience) != 0 {
+		return c.Audience
+	}
+	if c.AppDomain != "" {
+		return []string{c.AppDomain}
+	}
+	return nil
 }
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/policy"
+	"github.com/lattots/salpa/internal/util"
+)
+
+// Admin requests are small JSON documents
+const maxAdminBodySize = 64 << 10
+
+// adminEnabled tells whether the admin API has any way to authenticate, it isn't served otherwise.
+func (h *Handler) adminEnabled() bool {
+	return len(h.adminKeys) > 0 || h.adminRole != ""
+}
+
+// requireAdmin allows requests with an admin API key or an access token with the admin role,
+// either as a bearer token or in the access token cookie.
+func (h *Handler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			http.Error(w, "Admin access required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *Handler) isAdmin(r *http.Request) bool {
+	bearer, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if hasBearer {
+		for _, key := range h.adminKeys {
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(key)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if h.adminRole == "" {
+		return false
+	}
+	accessToken := bearer
+	if !hasBearer {
+		// Cookie is Lax, so cross-site requests that change something don't carry it
+		cookie, err := r.Cookie("access_token")
+		if err != nil {
+			return false
+		}
+		accessToken = cookie.Value
+	}
+	claims, err := h.token.VerifyAccessToken(accessToken)
+	return err == nil && claims.HasRole(h.adminRole)
+}
+
+type invitationResponse struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+func newInvitationResponse(invitation models.Invitation) invitationResponse {
+	response := invitationResponse{
+		ID:        invitation.ID,
+		Email:     invitation.Email,
+		CreatedAt: invitation.CreatedAt,
+		ExpiresAt: invitation.ExpiresAt,
+	}
+	if !invitation.UsedAt.IsZero() {
+		response.UsedAt = &invitation.UsedAt
+	}
+	return response
+}
+
+// HandleCreateInvitation invites an email to sign up. JSON body: email and optionally expiresIn,
+// a duration such as "72h". Invitations expire in a week by default.
+func (h *Handler) HandleCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize)).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ttl := policy.DefaultInvitationTTL
+	if body.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.ExpiresIn); err != nil {
+			http.Error(w, "Invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+	}
+
+	invitation, err := h.policy.Invite(r.Context(), body.Email, ttl)
+	if errors.Is(err, util.ErrInvalidEmail) || errors.Is(err, policy.ErrInvalidInvitationTTL) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error creating invitation", http.StatusInternalServerError)
+		log.Println("error creating invitation:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newInvitationResponse(invitation))
+}
+
+// HandleListInvitations returns every invitation as JSON, the newest first.
+func (h *Handler) HandleListInvitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := h.policy.ListInvitations(r.Context())
+	if err != nil {
+		http.Error(w, "Error listing invitations", http.StatusInternalServerError)
+		log.Println("error listing invitations:", err)
+		return
+	}
+
+	response := make([]invitationResponse, 0, len(invitations))
+	for _, invitation := range invitations {
+		response = append(response, newInvitationResponse(invitation))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleRevokeInvitation removes an invitation, so it can't be used anymore.
+func (h *Handler) HandleRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	err := h.policy.RevokeInvitation(r.Context(), r.PathValue("id"))
+	if errors.Is(err, policy.ErrInvitationNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking invitation", http.StatusInternalServerError)
+		log.Println("error revoking invitation:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
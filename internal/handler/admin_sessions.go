@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+)
+
+const (
+	defaultSessionPageSize = 50
+	maxSessionPageSize     = 500
+)
+
+type sessionResponse struct {
+	ID          string         `json:"id"`
+	UserID      string         `json:"userID"`
+	Email       string         `json:"email"`
+	AMR         []string       `json:"amr"`
+	Roles       []string       `json:"roles"`
+	Groups      []string       `json:"groups"`
+	Claims      map[string]any `json:"claims"`
+	CreatedAt   *time.Time     `json:"createdAt,omitempty"`
+	RefreshedAt *time.Time     `json:"refreshedAt,omitempty"`
+	ExpiresAt   time.Time      `json:"expiresAt"`
+}
+
+func newSessionResponse(session models.Session) sessionResponse {
+	response := sessionResponse{
+		ID:        session.ID,
+		UserID:    session.UserID,
+		Email:     session.Email,
+		AMR:       nonNil(session.AMR),
+		Roles:     nonNil(session.Claims.Roles),
+		Groups:    nonNil(session.Claims.Groups),
+		Claims:    session.Claims.Extra,
+		ExpiresAt: session.ExpiresAt,
+	}
+	if response.Claims == nil {
+		response.Claims = map[string]any{}
+	}
+	// Sessions started before the times were recorded don't have them
+	if !session.CreatedAt.IsZero() {
+		response.CreatedAt = &session.CreatedAt
+	}
+	if !session.RefreshedAt.IsZero() {
+		response.RefreshedAt = &session.RefreshedAt
+	}
+	return response
+}
+
+// Lists are encoded as [] instead of null
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+type sessionListResponse struct {
+	Sessions []sessionResponse `json:"sessions"`
+	Total    int               `json:"total"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+}
+
+// HandleListSessions returns the active sessions as JSON, the most recently refreshed first.
+// Query parameters userID and email filter the sessions, limit and offset page through them.
+func (h *Handler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := store.SessionFilter{UserID: query.Get("userID")}
+	if email := query.Get("email"); email != "" {
+		var err error
+		if filter.Email, err = util.NormalizeEmail(email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var err error
+	filter.Limit, err = queryInt(query.Get("limit"), defaultSessionPageSize)
+	if err != nil || filter.Limit < 1 || filter.Limit > maxSessionPageSize {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSessionPageSize), http.StatusBadRequest)
+		return
+	}
+	filter.Offset, err = queryInt(query.Get("offset"), 0)
+	if err != nil || filter.Offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	sessions, total, err := h.token.ListSessions(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error listing sessions", http.StatusInternalServerError)
+		log.Println("error listing sessions:", err)
+		return
+	}
+
+	response := sessionListResponse{
+		Sessions: make([]sessionResponse, 0, len(sessions)),
+		Total:    total,
+		Limit:    filter.Limit,
+		Offset:   filter.Offset,
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, newSessionResponse(session))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleGetSession returns an active session as JSON.
+func (h *Handler) HandleGetSession(w http.ResponseWriter, r *http.Request) {
+	session, err := h.token.GetSession(r.Context(), r.PathValue("id"))
+	if errors.Is(err, token.ErrSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error getting session", http.StatusInternalServerError)
+		log.Println("error getting session:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newSessionResponse(session))
+}
+
+// HandleRevokeSession ends a session, so it can't be refreshed anymore.
+func (h *Handler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	err := h.token.RevokeSession(r.Context(), r.PathValue("id"))
+	if errors.Is(err, token.ErrSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		log.Println("error revoking session:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeUserSessions ends every session of a user.
+func (h *Handler) HandleRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	if err := h.token.RevokeUserRefreshTokens(r.PathValue("userID")); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		log.Println("error revoking sessions:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryInt parses an integer query parameter, an empty parameter is the default
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
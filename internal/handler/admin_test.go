@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+const testAdminKey = "test-admin-key"
+
+func initAdminHandler(t *testing.T) *Handler {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating signing key: %s", err)
+	}
+	return &Handler{
+		token:     token.NewManager(tokenStore, signingKey),
+		adminKeys: []string{testAdminKey},
+		adminRole: "admin",
+	}
+}
+
+// newAccessToken starts a session with the roles and returns its access token.
+func newAccessToken(t *testing.T, h *Handler, email string, roles ...string) string {
+	refreshToken, err := h.token.NewRefreshTokenWithClaims("user-"+email, email, models.SessionClaims{Roles: roles})
+	if err != nil {
+		t.Fatalf("error creating refresh token: %s", err)
+	}
+	accessToken, _, err := h.token.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatalf("error creating access token: %s", err)
+	}
+	return accessToken
+}
+
+func TestRequireAdmin(t *testing.T) {
+	h := initAdminHandler(t)
+	adminToken := newAccessToken(t, h, "admin@example.com", "admin")
+	userToken := newAccessToken(t, h, "user@example.com", "editor")
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		want          int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"api key", "Bearer " + testAdminKey, "", http.StatusOK},
+		{"wrong api key", "Bearer wrong-key", "", http.StatusUnauthorized},
+		{"api key without bearer scheme", testAdminKey, "", http.StatusUnauthorized},
+		{"bearer token with admin role", "Bearer " + adminToken, "", http.StatusOK},
+		{"bearer token without admin role", "Bearer " + userToken, "", http.StatusUnauthorized},
+		{"invalid bearer token", "Bearer " + adminToken + "x", "", http.StatusUnauthorized},
+		{"cookie with admin role", "", adminToken, http.StatusOK},
+		{"cookie without admin role", "", userToken, http.StatusUnauthorized},
+		// Bearer is checked instead of the cookie when both are sent
+		{"wrong api key with admin cookie", "Bearer wrong-key", adminToken, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "access_token", Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		h.requireAdmin(h.HandleListSessions)(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, w.Code)
+		}
+	}
+}
+
+func TestRequireAdmin_WithoutRole(t *testing.T) {
+	h := initAdminHandler(t)
+	adminToken := newAccessToken(t, h, "admin@example.com", "admin")
+	// Only API keys are accepted when no admin role is configured
+	h.adminRole = ""
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	h.requireAdmin(h.HandleListSessions)(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestListSessionsPagination(t *testing.T) {
+	h := initAdminHandler(t)
+	newAccessToken(t, h, "alice@example.com")
+	newAccessToken(t, h, "bob@example.com")
+
+	listSessions := func(query string) (int, sessionListResponse) {
+		w := httptest.NewRecorder()
+		h.HandleListSessions(w, httptest.NewRequest(http.MethodGet, "/admin/sessions?"+query, nil))
+		var response sessionListResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid response: %s", err)
+			}
+		}
+		return w.Code, response
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=501", "limit=ten", "offset=-1", "offset=one", "email=not-an-email"} {
+		if code, _ := listSessions(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, code)
+		}
+	}
+
+	code, response := listSessions("")
+	if code != http.StatusOK || response.Limit != defaultSessionPageSize || response.Total != 2 || len(response.Sessions) != 2 {
+		t.Errorf("default page: unexpected response %d %+v", code, response)
+	}
+	code, response = listSessions("limit=500")
+	if code != http.StatusOK || response.Limit != maxSessionPageSize {
+		t.Errorf("largest page: unexpected response %d %+v", code, response)
+	}
+
+	code, first := listSessions("limit=1")
+	if code != http.StatusOK || first.Total != 2 || len(first.Sessions) != 1 {
+		t.Fatalf("first page: unexpected response %d %+v", code, first)
+	}
+	code, second := listSessions("limit=1&offset=1")
+	if code != http.StatusOK || second.Offset != 1 || len(second.Sessions) != 1 {
+		t.Fatalf("second page: unexpected response %d %+v", code, second)
+	}
+	if first.Sessions[0].ID == second.Sessions[0].ID {
+		t.Error("pages should have different sessions")
+	}
+	if code, past := listSessions("offset=2"); code != http.StatusOK || past.Total != 2 || len(past.Sessions) != 0 {
+		t.Errorf("past the end: unexpected response %d %+v", code, past)
+	}
+
+	code, filtered := listSessions("email=Alice@Example.com")
+	if code != http.StatusOK || filtered.Total != 1 || filtered.Sessions[0].Email != "alice@example.com" {
+		t.Errorf("email filter: unexpected response %d %+v", code, filtered)
+	}
+}
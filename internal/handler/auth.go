@@ -2,14 +2,18 @@ package handler
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/hook"
 	"github.com/lattots/salpa/internal/models"
 	"github.com/lattots/salpa/internal/oauth"
+	"github.com/lattots/salpa/internal/policy"
 	"github.com/lattots/salpa/internal/token"
 )
 
@@ -19,29 +23,28 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No return_to found in request", http.StatusBadRequest)
 		return
 	}
+	returnToURL, err := h.validateReturnTo(returnTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	authProvider, err := h.getAuthProvider(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "return_to",
-		Value:    returnTo,
-		Path:     "/",
-		Expires:  time.Now().Add(10 * time.Minute),
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
-	})
-
-	state := generateStateCookie(w)
-	url := authProvider.GetAuthCodeURL(state)
+	setReturnToCookie(w, returnToURL)
+	login := setLoginStateCookies(w)
+	// Link that was abandoned at the provider would otherwise turn this login into a link
+	clearLinkCookie(w)
+	url := authProvider.GetAuthCodeURL(login)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
 func (h *Handler) HandleCallback(w http.ResponseWriter, r *http.Request) {
-	err := verifyRequestStateCookie(r)
+	login, err := readLoginState(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -56,89 +59,286 @@ func (h *Handler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	authProvider, err := h.getAuthProvider(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	user, err := authProvider.ExchangeUserInfo(code)
+	// Login state is single use, whatever the outcome of the exchange
+	clearLoginStateCookies(w)
+
+	var user models.User
+	if formProvider, ok := authProvider.(oauth.FormPostProvider); ok {
+		user, err = formProvider.ExchangeUserInfoFromForm(code, login, r.PostForm)
+	} else {
+		user, err = authProvider.ExchangeUserInfo(code, login)
+	}
 	if err != nil {
 		http.Error(w, "Error exchangin user info", http.StatusInternalServerError)
-		log.Println("error exchangin user info with Google:", err)
+		log.Println("error exchangin user info with provider:", err)
+		return
+	}
+
+	returnToCookie, err := r.Cookie("return_to")
+	if err != nil {
+		http.Error(w, "No return_to cookie found", http.StatusBadRequest)
+		return
+	}
+	if returnToCookie.Value == "" {
+		http.Error(w, "Empty return_to URL found", http.StatusBadRequest)
+		return
+	}
+	// Cookie was validated at login, but cookies can be planted by other subdomains
+	returnToURL, err := h.validateReturnTo(returnToCookie.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	refreshToken, err := h.token.NewRefreshToken(user.GetID(), user.GetEmail())
+	// Signed in user is adding this provider to their account
+	if linkCookie, err := r.Cookie(linkCookieName); err == nil {
+		clearLinkCookie(w)
+		h.finishLink(w, r, linkCookie.Value, login.State, user, returnToURL)
+		return
+	}
+
+	// Sign-up policy is checked before a user is created or any tokens are issued
+	if !h.checkLogin(w, user) {
+		return
+	}
+
+	// Provider user IDs are mapped to Salpa user IDs, so each person has one ID regardless of the provider
+	resolved, err := h.accounts.ResolveIdentity(r.Context(), r.PathValue("provider"), user)
+	if errors.Is(err, account.ErrUnknownProviderID) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, policy.ErrNotInvited) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error resolving user", http.StatusInternalServerError)
+		log.Println("error resolving provider identity:", err)
+		return
+	}
+
+	h.startSession(w, r, resolved, r.PathValue("provider"), []string{models.AMRFederated}, returnToURL)
+}
+
+// checkLogin applies the sign-up policy to a user who is about to get a session. Every login method checks it,
+// so no method gets around blocked domains or the allowlist. On failure it writes the error response and returns false.
+func (h *Handler) checkLogin(w http.ResponseWriter, user models.User) bool {
+	if err := h.policy.CheckLogin(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// startSession issues the tokens of an authenticated user and redirects them to returnToURL.
+// Every login method ends here, so sessions are created the same way regardless of how the user logged in.
+// provider names the OAuth2 provider or login method and amr lists the methods the user logged in with.
+// Users with a second factor are sent to enter their code instead.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, user models.User, provider string, amr []string, returnToURL string) {
+	challenged, ok := h.startMFAChallenge(w, r, user, provider, amr, returnToURL)
+	if !ok {
+		return
+	}
+	if challenged {
+		http.Redirect(w, r, h.mfaChallengeURL, http.StatusSeeOther)
+		return
+	}
+
+	if !h.issueTokens(w, r, user, provider, amr) {
+		return
+	}
+	clearReturnToCookie(w)
+
+	http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+}
+
+// issueTokens creates a new session for the user and sets the token cookies.
+// The claim rules and the pre-issuance hook decide the claims of the session, and the hook can deny the login.
+// On failure it writes the error response and returns false.
+func (h *Handler) issueTokens(w http.ResponseWriter, r *http.Request, user models.User, provider string, amr []string) bool {
+	sessionClaims, err := h.claimRules.Resolve(r.Context(), provider, user)
+	if err != nil {
+		http.Error(w, "Error resolving claims", http.StatusInternalServerError)
+		log.Println("error resolving claim rules:", err)
+		return false
+	}
+	if h.hook != nil {
+		hookClaims, err := hook.Run(r.Context(), h.hook, hook.Request{Provider: provider, User: user, AMR: amr})
+		if errors.Is(err, hook.ErrDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+		if err != nil {
+			http.Error(w, "Error checking login", http.StatusInternalServerError)
+			log.Println("error running pre-issuance hook:", err)
+			return false
+		}
+		sessionClaims = sessionClaims.Merge(hookClaims)
+	}
+
+	refreshToken, err := h.token.NewRefreshTokenWithClaims(user.GetID(), user.GetEmail(), sessionClaims, amr...)
 	if err != nil {
 		http.Error(w, "Error creating refresh token", http.StatusInternalServerError)
 		log.Println("error creating access token:", err)
-		return
+		return false
 	}
 
 	accessToken, expiresAt, err := h.token.NewAccessToken(refreshToken.TokenID)
 	if err != nil {
 		http.Error(w, "Error creating access token", http.StatusInternalServerError)
 		log.Println("error creating access token:", err)
+		return false
+	}
+
+	h.setTokenCookies(w, accessToken, expiresAt, refreshToken)
+	return true
+}
+
+// setReturnToCookie remembers where to send the user after the provider login.
+func setReturnToCookie(w http.ResponseWriter, returnToURL string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "return_to",
+		Value:    returnToURL,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		// Providers using form_post call back with a cross-site POST
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// clearReturnToCookie removes the return_to cookie of the login flow once the login is over.
+func clearReturnToCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "return_to",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
 		return
 	}
 
-	returnToCookie, err := r.Cookie("return_to")
+	// Every refresh issues a new refresh token, so a stolen token is only usable until the next refresh
+	refreshToken, err := h.token.RotateRefreshToken(cookie.Value)
+	if errors.Is(err, token.ErrTokenReused) {
+		log.Println("refresh token reuse detected, revoked the token family")
+		h.clearTokenCookies(w)
+		http.Error(w, "Refresh token invalid", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, token.ErrTokenInvalid) {
+		http.Error(w, "Refresh token invalid", http.StatusUnauthorized)
+		return
+	}
+	// The other request sets the new cookies, so the client keeps its session
+	if errors.Is(err, token.ErrTokenRotated) {
+		http.Error(w, "Refresh token is already being refreshed", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, "No return_to cookie found", http.StatusBadRequest)
+		http.Error(w, "Failed to rotate refresh token", http.StatusInternalServerError)
+		log.Println("error rotating refresh token:", err)
 		return
 	}
-	returnToURL := returnToCookie.Value
-	if returnToURL == "" {
-		http.Error(w, "Empty return_to URL found", http.StatusBadRequest)
+
+	newAccessToken, expiresAt, err := h.token.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
 		return
 	}
 
-	// This handles setting token cookies as well as removing return_to cookie from the response
-	h.setRedirectCookies(w, r, accessToken, expiresAt, refreshToken)
+	h.setTokenCookies(w, newAccessToken, expiresAt, refreshToken)
 
-	http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	returnToURL := ""
+	if returnTo := r.FormValue("return_to"); returnTo != "" {
+		var err error
+		returnToURL, err = h.validateReturnTo(returnTo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Logging out without a session is fine, the cookies are cleared either way
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		if err = h.token.RevokeRefreshToken(cookie.Value); err != nil {
+			http.Error(w, "Failed to revoke refresh token", http.StatusInternalServerError)
+			log.Println("error revoking refresh token:", err)
+			return
+		}
+	}
+
+	h.clearTokenCookies(w)
+
+	if returnToURL != "" {
+		http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("refresh_token")
 	if err != nil {
 		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
 		return
 	}
 
-	newAccessToken, expiresAt, err := h.token.NewAccessToken(cookie.Value)
+	user, err := h.token.RevokeAllRefreshTokens(cookie.Value)
 	if errors.Is(err, token.ErrTokenInvalid) {
 		http.Error(w, "Refresh token invalid", http.StatusUnauthorized)
 		return
 	}
 	if err != nil {
-		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
+		http.Error(w, "Failed to revoke refresh tokens", http.StatusInternalServerError)
+		log.Println("error revoking refresh tokens:", err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    newAccessToken,
-		Path:     "/",
-		Domain:   h.appDomain,
-		Expires:  expiresAt,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	log.Printf("revoked all sessions of user %s\n", user.GetID())
 
+	h.clearTokenCookies(w)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// GetPublicKey serves the verification keys as PEM blocks.
+// The current key comes first, so clients that only read one block get the key new tokens are signed with.
 func (h *Handler) GetPublicKey(w http.ResponseWriter, r *http.Request) {
-	pubASN1, _ := x509.MarshalPKIXPublicKey(h.token.AccessTokenPublic)
-	pemBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pubASN1,
+	for _, pub := range h.token.PublicKeys() {
+		pubASN1, _ := x509.MarshalPKIXPublicKey(pub)
+		pemBlock := &pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pubASN1,
+		}
+		pem.Encode(w, pemBlock)
 	}
-	pem.Encode(w, pemBlock)
 }
 
-func (h *Handler) setRedirectCookies(
+func (h *Handler) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(h.token.JWKS()); err != nil {
+		log.Println("error encoding JWKS:", err)
+	}
+}
+
+func (h *Handler) setTokenCookies(
 	w http.ResponseWriter,
-	r *http.Request,
 	accessToken string,
 	accessTokenExpiresAt time.Time,
 	refreshToken models.RefreshToken,
@@ -157,19 +357,37 @@ func (h *Handler) setRedirectCookies(
 	http.SetCookie(w, &http.Cookie{
 		Name:     "refresh_token",
 		Value:    refreshToken.TokenID,
-		Path:     "/auth/refresh",
+		Path:     "/auth",
 		Domain:   h.serviceDomain,
 		Expires:  refreshToken.ExpiresAt,
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteStrictMode,
 	})
+}
 
+// clearTokenCookies expires the token cookies. Domain and path must match the ones used in setTokenCookies.
+func (h *Handler) clearTokenCookies(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
-		Name:   "return_to",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
+		Name:     "access_token",
+		Value:    "",
+		Path:     "/",
+		Domain:   h.appDomain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/auth",
+		Domain:   h.serviceDomain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
 	})
 }
 
@@ -185,3 +403,32 @@ func (h *Handler) getAuthProvider(r *http.Request) (oauth.Provider, error) {
 
 	return authProvider, nil
 }
+
+// sessionUser returns the owner of the refresh token cookie. On failure it writes the error response and returns false.
+func (h *Handler) sessionUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	user, err := h.token.VerifyRefreshToken(cookie.Value)
+	if errors.Is(err, token.ErrTokenInvalid) {
+		http.Error(w, "Refresh token invalid", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Error checking refresh token", http.StatusInternalServerError)
+		log.Println("error checking refresh token:", err)
+		return nil, false
+	}
+	return user, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error encoding response:", err)
+	}
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+type testProvider struct{}
+
+func (testProvider) GetAuthCodeURL(login oauth.LoginState) string {
+	return "https://provider.test.com/authorize?state=" + login.State
+}
+
+func (testProvider) ExchangeUserInfo(code string, login oauth.LoginState) (models.User, error) {
+	return nil, nil
+}
+
+func TestLoginClearsLinkCookie(t *testing.T) {
+	allowlist, err := newReturnToAllowlist("https://app.test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		providers:       map[string]oauth.Provider{"test": testProvider{}},
+		appDomain:       "https://app.test.com",
+		allowedReturnTo: allowlist,
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/login/test?return_to=/home", nil)
+	r.SetPathValue("provider", "test")
+	// Left behind by a link that was abandoned at the provider
+	r.AddCookie(&http.Cookie{Name: linkCookieName, Value: "abandoned"})
+	w := httptest.NewRecorder()
+	h.HandleLogin(w, r)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected %d, got %d: %s", http.StatusTemporaryRedirect, w.Code, w.Body)
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == linkCookieName {
+			if cookie.MaxAge >= 0 {
+				t.Errorf("link cookie should be cleared, got %+v", cookie)
+			}
+			return
+		}
+	}
+	t.Error("login should clear the link cookie")
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/lattots/salpa/internal/util"
+)
+
+// openIDConfiguration is a partial OpenID Connect discovery document. Salpa is not an OpenID Provider: it signs in
+// users through upstream providers and issues access tokens, not ID tokens. So the document leaves out the
+// authorization_endpoint, token_endpoint and response_types_supported members a provider must have, and only tells
+// resource servers the issuer and keys of the access tokens. The provider login URLs are published in the
+// non-standard login_endpoints member instead.
+type openIDConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+	// Algorithm of the access tokens. OIDC libraries pick the verification algorithm from this member
+	// and fall back to RS256 without it.
+	IDTokenSigningAlgValuesSupported []string          `json:"id_token_signing_alg_values_supported"`
+	SubjectTypesSupported            []string          `json:"subject_types_supported"`
+	ClaimsSupported                  []string          `json:"claims_supported"`
+	EndSessionEndpoint               string            `json:"end_session_endpoint"`
+	LoginEndpoints                   map[string]string `json:"login_endpoints"`
+	RefreshEndpoint                  string            `json:"refresh_endpoint"`
+	LogoutAllEndpoint                string            `json:"logout_all_endpoint"`
+}
+
+func (h *Handler) newOpenIDConfiguration() openIDConfiguration {
+	loginEndpoints := make(map[string]string)
+	for provider := range h.providers {
+		loginEndpoints[provider] = util.BuildURL(h.serviceDomain, "login", provider)
+	}
+
+	return openIDConfiguration{
+		Issuer:                           h.issuer,
+		JWKSURI:                          h.serviceDomain + "/.well-known/jwks.json",
+		IDTokenSigningAlgValuesSupported: []string{"EdDSA"},
+		SubjectTypesSupported:            []string{"public"},
+		ClaimsSupported:                  []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "userID", "email"},
+		EndSessionEndpoint:               h.serviceDomain + "/auth/logout",
+		LoginEndpoints:                   loginEndpoints,
+		RefreshEndpoint:                  h.serviceDomain + "/auth/refresh",
+		LogoutAllEndpoint:                h.serviceDomain + "/auth/logout-all",
+	}
+}
+
+func (h *Handler) GetOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := json.NewEncoder(w).Encode(h.newOpenIDConfiguration()); err != nil {
+		log.Println("error encoding OpenID configuration:", err)
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+func TestOpenIDConfiguration(t *testing.T) {
+	h := &Handler{
+		providers:     map[string]oauth.Provider{"google": testProvider{}, "github": testProvider{}},
+		serviceDomain: "https://auth.test.com",
+		issuer:        "https://issuer.test.com",
+	}
+
+	w := httptest.NewRecorder()
+	h.GetOpenIDConfiguration(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	var document map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("invalid document: %s", err)
+	}
+	if document["issuer"] != "https://issuer.test.com" {
+		t.Errorf("unexpected issuer: %v", document["issuer"])
+	}
+	if document["jwks_uri"] != "https://auth.test.com/.well-known/jwks.json" {
+		t.Errorf("unexpected jwks_uri: %v", document["jwks_uri"])
+	}
+	algs, _ := document["id_token_signing_alg_values_supported"].([]any)
+	if len(algs) != 1 || algs[0] != "EdDSA" {
+		t.Errorf("unexpected signing algorithms: %v", algs)
+	}
+
+	loginEndpoints, _ := document["login_endpoints"].(map[string]any)
+	want := map[string]string{
+		"google": "https://auth.test.com/auth/login/google",
+		"github": "https://auth.test.com/auth/login/github",
+	}
+	if len(loginEndpoints) != len(want) {
+		t.Errorf("unexpected login endpoints: %v", loginEndpoints)
+	}
+	for provider, url := range want {
+		if loginEndpoints[provider] != url {
+			t.Errorf("login endpoint of %s: want %s got %v", provider, url, loginEndpoints[provider])
+		}
+	}
+}
@@ -1,39 +1,219 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"maps"
+	"net"
+	"net/http"
+	"os"
 	"slices"
+	"strings"
 
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/claims"
 	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/hook"
+	"github.com/lattots/salpa/internal/magiclink"
+	"github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/mfa"
 	"github.com/lattots/salpa/internal/oauth"
+	"github.com/lattots/salpa/internal/password"
+	"github.com/lattots/salpa/internal/policy"
+	"github.com/lattots/salpa/internal/ratelimit"
 	"github.com/lattots/salpa/internal/token"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/webauthn"
 )
 
 type Handler struct {
 	providers     map[string]oauth.Provider
+	accounts      *account.Manager
+	passwords     *password.Provider  // Nil when the password provider is not active
+	magicLinks    *magiclink.Provider // Nil when magic link login is not active
+	passkeys      *webauthn.Provider  // Nil when passkey login is not active
+	mfa           *mfa.Provider       // Nil when second factors are not active
+	hook          hook.Hook           // Nil when no pre-issuance hook is set
+	claimRules    *claims.Rules
+	policy        *policy.Policy
 	token         *token.Manager
 	appDomain     string // This is the domain name of the client application
 	serviceDomain string // This is the domain name of the auth service
+	issuer        string // This is the iss claim of access tokens
+
+	mfaChallengeURL string // Client application page that asks for the second factor
+
+	clientIPHeader    string             // Header with the client address set by the reverse proxy
+	passwordAttempts  *ratelimit.Limiter // Password logins and registrations by client address
+	magicLinkRequests *ratelimit.Limiter // Login link requests by client address
+	passkeyLogins     *ratelimit.Limiter // Passkey login challenges by client address
+	emailSlots        chan struct{}      // Emails being sent in the background
+
+	adminKeys []string // API keys of the admin API
+	adminRole string   // Role that gives users access to the admin API
+
+	allowedReturnTo returnToAllowlist
 }
 
-func CreateHandlerFromConf(conf config.SystemConfiguration, tokenManager *token.Manager) (*Handler, error) {
-	if len(conf.Providers) == 0 {
+func CreateHandlerFromConf(conf config.SystemConfiguration, tokenManager *token.Manager, tokenStore store.Store) (*Handler, error) {
+	// Password, magic link and passkey logins don't need any OAuth2 providers
+	localLogin := conf.Password.Active || conf.MagicLink.Active || conf.WebAuthn.Active
+
+	if len(conf.Providers) == 0 && !localLogin {
 		return nil, errors.New("error no auth providers")
 	}
 
 	providers := oauth.CreateProviders(conf.Service.ServiceDomain, conf.Providers)
-	if len(slices.Collect(maps.Keys(providers))) == 0 {
+	if len(slices.Collect(maps.Keys(providers))) == 0 && !localLogin {
 		return nil, fmt.Errorf("no providers set in conf. Please set providers in configuration file\n")
 	}
 
+	var passwords *password.Provider
+	var magicLinks *magiclink.Provider
+	if conf.Password.Active || conf.MagicLink.Active {
+		mailer, err := mail.NewMailerFromConf(conf.Mail)
+		if err != nil {
+			return nil, fmt.Errorf("error creating mailer: %w", err)
+		}
+		if conf.Password.Active {
+			passwords, err = password.NewProviderFromConf(conf, tokenStore, mailer)
+			if err != nil {
+				return nil, fmt.Errorf("error creating password provider: %w", err)
+			}
+		}
+		if conf.MagicLink.Active {
+			magicLinks = magiclink.NewProviderFromConf(conf, tokenStore, mailer)
+		}
+	}
+
+	var passkeys *webauthn.Provider
+	if conf.WebAuthn.Active {
+		var err error
+		passkeys, err = webauthn.NewProviderFromConf(conf, tokenStore)
+		if err != nil {
+			return nil, fmt.Errorf("error creating passkey provider: %w", err)
+		}
+	}
+
+	var mfaProvider *mfa.Provider
+	mfaChallengeURL := conf.MFA.ChallengeURL
+	if conf.MFA.Active {
+		mfaProvider = mfa.NewProviderFromConf(conf, tokenStore)
+		if mfaChallengeURL == "" {
+			mfaChallengeURL = conf.Service.AppDomain + "/mfa"
+		}
+	}
+
+	preIssuanceHook, err := hook.NewHookFromConf(conf.Hook)
+	if err != nil {
+		return nil, fmt.Errorf("error creating pre-issuance hook: %w", err)
+	}
+	claimRules, err := claims.NewRulesFromConf(conf, tokenStore)
+	if err != nil {
+		return nil, fmt.Errorf("error reading claim rules: %w", err)
+	}
+	signUpPolicy, err := policy.NewPolicyFromConf(conf, tokenStore)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sign-up policy: %w", err)
+	}
+	// Every way of creating a user goes through the sign-up policy
+	accounts := account.NewManagerFromConf(conf, tokenStore)
+	accounts.SetSignUpCheck(signUpPolicy.SignUp)
+	if passwords != nil {
+		passwords.SetSignUpCheck(signUpPolicy.SignUp)
+	}
+	if magicLinks != nil {
+		magicLinks.SetSignUpCheck(signUpPolicy.SignUp)
+	}
+
+	allowedReturnTo, err := newReturnToAllowlist(conf.Service.AppDomain, conf.Service.AllowedReturnTo)
+	if err != nil {
+		return nil, err
+	}
+
 	h := &Handler{
 		providers:     providers,
+		accounts:      accounts,
+		passwords:     passwords,
+		magicLinks:    magicLinks,
+		passkeys:      passkeys,
+		mfa:           mfaProvider,
+		hook:          preIssuanceHook,
+		claimRules:    claimRules,
+		policy:        signUpPolicy,
 		token:         tokenManager,
 		appDomain:     conf.Service.AppDomain,
 		serviceDomain: conf.Service.ServiceDomain,
+		issuer:        conf.Service.TokenIssuer(),
+
+		mfaChallengeURL: mfaChallengeURL,
+
+		clientIPHeader:    conf.Service.ClientIPHeader,
+		passwordAttempts:  ratelimit.New(maxPasswordAttemptsPerIP, passwordAttemptWindow),
+		magicLinkRequests: ratelimit.New(maxMagicLinksPerIP, magicLinkWindow),
+		passkeyLogins:     ratelimit.New(maxPasskeyLoginsPerIP, passkeyLoginWindow),
+		emailSlots:        make(chan struct{}, maxConcurrentEmails),
+
+		adminKeys: adminKeys(conf.Admin),
+		adminRole: conf.Admin.Role,
+
+		allowedReturnTo: allowedReturnTo,
 	}
 
 	return h, nil
 }
+
+// Emails sent in the background at the same time, each holds an SMTP connection for up to the mailer's timeout
+const maxConcurrentEmails = 16
+
+// sendInBackground runs send without making the client wait, so response times don't reveal whether an email was sent.
+// It reports false without running send when too many emails are being sent already.
+func (h *Handler) sendInBackground(r *http.Request, description string, send func(ctx context.Context) error) bool {
+	select {
+	case h.emailSlots <- struct{}{}:
+	default:
+		return false
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		defer func() { <-h.emailSlots }()
+		if err := send(ctx); err != nil {
+			log.Printf("error sending %s: %s\n", description, err)
+		}
+	}()
+	return true
+}
+
+// clientIP returns the address of the client, which rate limits are counted by.
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.clientIPHeader != "" {
+		// Proxies append the address they saw, so only the last one can't be forged by the client
+		if value := r.Header.Get(h.clientIPHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func adminKeys(conf config.AdminConfig) []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv(conf.EnvironmentVariables["apiKeys"]), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SetPreIssuanceHook replaces the hook of the configuration with an in-process one. Nil removes the hook.
+func (h *Handler) SetPreIssuanceHook(preIssuanceHook hook.Hook) {
+	h.hook = preIssuanceHook
+}
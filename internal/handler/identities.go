@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Link cookie marks a provider login that adds an identity to the signed in user instead of logging in
+const linkCookieName = "link_token"
+
+// HandleLink starts a provider login that links the provider to the signed in user.
+// Query parameter: return_to, where the user is sent once the provider is linked.
+func (h *Handler) HandleLink(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+	returnToURL, err := h.validateReturnTo(r.URL.Query().Get("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	authProvider, err := h.getAuthProvider(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	setReturnToCookie(w, returnToURL)
+	login := setLoginStateCookies(w)
+
+	// Token is bound to the state of this login, so it can't be used with another callback
+	token, err := h.accounts.BeginLink(r.Context(), user, login.State)
+	if err != nil {
+		http.Error(w, "Error starting link", http.StatusInternalServerError)
+		log.Println("error starting identity link:", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookieName,
+		Value:    token,
+		Path:     loginStateCookiePath,
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		// Sent with form_post callbacks like the login state cookies
+		SameSite: http.SameSiteNoneMode,
+	})
+
+	http.Redirect(w, r, authProvider.GetAuthCodeURL(login), http.StatusTemporaryRedirect)
+}
+
+// finishLink links the provider user of the callback and sends the user back. The session stays as it was.
+func (h *Handler) finishLink(w http.ResponseWriter, r *http.Request, token, loginState string, user models.User, returnToURL string) {
+	_, err := h.accounts.FinishLink(r.Context(), token, loginState, r.PathValue("provider"), user)
+	switch {
+	case errors.Is(err, account.ErrInvalidLink), errors.Is(err, account.ErrUnknownProviderID):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, account.ErrIdentityInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Error linking identity", http.StatusInternalServerError)
+		log.Println("error linking identity:", err)
+		return
+	}
+
+	clearReturnToCookie(w)
+	http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+}
+
+type identityResponse struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HandleListIdentities returns the providers linked to the signed in user as JSON.
+func (h *Handler) HandleListIdentities(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	identities, err := h.accounts.ListIdentities(r.Context(), user.GetID())
+	if err != nil {
+		http.Error(w, "Error listing identities", http.StatusInternalServerError)
+		log.Println("error listing identities:", err)
+		return
+	}
+
+	response := make([]identityResponse, 0, len(identities))
+	for _, identity := range identities {
+		response = append(response, identityResponse{
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleUnlink removes a provider identity from the signed in user, unless it's their only way to log in.
+func (h *Handler) HandleUnlink(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.accounts.UnlinkIdentity(r.Context(), user.GetID(), r.PathValue("provider"), r.PathValue("subject"))
+	if errors.Is(err, account.ErrIdentityNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, account.ErrLastLoginMethod) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error unlinking identity", http.StatusInternalServerError)
+		log.Println("error unlinking identity:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func clearLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   linkCookieName,
+		Value:  "",
+		Path:   loginStateCookiePath,
+		MaxAge: -1,
+	})
+}
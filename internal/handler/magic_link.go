@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/hook"
+	"github.com/lattots/salpa/internal/magiclink"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/policy"
+)
+
+const (
+	// Link requests from one address, so it can't fill the database with links to any number of addresses
+	maxMagicLinksPerIP = 20
+	magicLinkWindow    = 15 * time.Minute
+)
+
+// HandleMagicLinkRequest emails a login link. Form values: email and return_to.
+// The response doesn't tell whether the address has an account: every address has the same rate limit and the link
+// is sent in the background, so response times are the same as well.
+func (h *Handler) HandleMagicLinkRequest(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.PostFormValue("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.magicLinkRequests.Allow(h.clientIP(r)) {
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	send, err := h.magicLinks.CreateLink(r.Context(), r.PostFormValue("email"), returnToURL)
+	if errors.Is(err, magiclink.ErrInvalidEmail) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, magiclink.ErrRateLimited) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error sending login link", http.StatusInternalServerError)
+		log.Println("error creating magic link:", err)
+		return
+	}
+
+	if !h.sendInBackground(r, "magic link", send) {
+		http.Error(w, "Too many requests, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMagicLinkLogin is the target of login links. It logs the user in and sends them to the return_to of the link.
+func (h *Handler) HandleMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	user, returnTo, err := h.magicLinks.Login(r.Context(), r.URL.Query().Get("token"))
+	if errors.Is(err, magiclink.ErrInvalidToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, policy.ErrNotInvited) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		log.Println("error logging in with magic link:", err)
+		return
+	}
+	if !h.checkLogin(w, user) {
+		return
+	}
+
+	// Allowlist may have changed since the link was sent
+	returnToURL, err := h.validateReturnTo(returnTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.startSession(w, r, user, hook.ProviderMagicLink, []string{models.AMREmail}, returnToURL)
+}
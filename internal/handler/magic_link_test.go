@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/ratelimit"
+)
+
+func TestMagicLinkRequestsPerIP(t *testing.T) {
+	allowlist, err := newReturnToAllowlist("https://app.test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{allowedReturnTo: allowlist, magicLinkRequests: ratelimit.New(1, time.Hour)}
+	// The only request of the address is used up
+	h.magicLinkRequests.Add("192.0.2.1")
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("email=test@example.com&return_to=/home"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.HandleMagicLinkRequest(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
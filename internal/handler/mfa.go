@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/mfa"
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Pending login cookie is only sent to the verify endpoint
+const (
+	mfaChallengeCookie     = "mfa_challenge"
+	mfaChallengeCookiePath = "/auth/mfa"
+)
+
+// startMFAChallenge stores a login that has passed the first factor if the user has a second factor, and reports
+// whether it did. The caller sends the user to mfaChallengeURL to enter their code.
+// On failure it writes the error response and returns false.
+func (h *Handler) startMFAChallenge(w http.ResponseWriter, r *http.Request, user models.User, provider string, amr []string, returnToURL string) (challenged bool, ok bool) {
+	if h.mfa == nil {
+		return false, true
+	}
+	enabled, err := h.mfa.Enabled(r.Context(), user.GetID())
+	if err != nil {
+		http.Error(w, "Error checking two-factor authentication", http.StatusInternalServerError)
+		log.Println("error checking MFA enrollment:", err)
+		return false, false
+	}
+	if !enabled {
+		return false, true
+	}
+
+	token, err := h.mfa.BeginChallenge(r.Context(), user, provider, amr, returnToURL)
+	if err != nil {
+		http.Error(w, "Error starting two-factor authentication", http.StatusInternalServerError)
+		log.Println("error starting MFA challenge:", err)
+		return false, false
+	}
+
+	setMFAChallengeCookie(w, token)
+	clearReturnToCookie(w)
+	return true, true
+}
+
+// HandleMFAVerify completes a pending login with a code from the authenticator app or a backup code.
+// Form value: code. On success the user is redirected to the return_to of the login.
+func (h *Handler) HandleMFAVerify(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(mfaChallengeCookie)
+	if err != nil {
+		http.Error(w, "No pending login", http.StatusUnauthorized)
+		return
+	}
+
+	challenge, next, err := h.mfa.FinishChallenge(r.Context(), cookie.Value, r.PostFormValue("code"))
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		// Each attempt gets a new token, no token means the attempts ran out
+		if next != "" {
+			setMFAChallengeCookie(w, next)
+		} else {
+			clearMFAChallengeCookie(w)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, mfa.ErrInvalidChallenge) {
+		clearMFAChallengeCookie(w)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, mfa.ErrTooManyAttempts) {
+		clearMFAChallengeCookie(w)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying code", http.StatusInternalServerError)
+		log.Println("error finishing MFA challenge:", err)
+		return
+	}
+	clearMFAChallengeCookie(w)
+
+	// Allowlist may have changed since the login started
+	returnToURL, err := h.validateReturnTo(challenge.ReturnTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.issueTokens(w, r, challenge.User, challenge.Provider, challenge.AMR) {
+		return
+	}
+	http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+}
+
+// HandleTOTPEnroll creates a TOTP secret for the logged in user and returns it with its provisioning URI as JSON.
+// The second factor is used only after it has been confirmed.
+func (h *Handler) HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	enrollment, err := h.mfa.Enroll(r.Context(), user)
+	if errors.Is(err, mfa.ErrAlreadyEnrolled) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error enrolling two-factor authentication", http.StatusInternalServerError)
+		log.Println("error enrolling TOTP:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, enrollment)
+}
+
+// HandleTOTPConfirm turns on the second factor with a code from the app. Form value: code.
+// The response holds the backup codes, which are never shown again.
+func (h *Handler) HandleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	backupCodes, err := h.mfa.Confirm(r.Context(), user.GetID(), r.PostFormValue("code"))
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode), errors.Is(err, mfa.ErrNotEnrolled):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, mfa.ErrAlreadyEnrolled):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Error confirming two-factor authentication", http.StatusInternalServerError)
+		log.Println("error confirming TOTP:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"backupCodes": backupCodes})
+}
+
+// HandleTOTPDisable removes the second factor. Form value: code, a TOTP or backup code.
+func (h *Handler) HandleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.mfa.Disable(r.Context(), user.GetID(), r.PostFormValue("code"))
+	if errors.Is(err, mfa.ErrInvalidCode) || errors.Is(err, mfa.ErrNotEnrolled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, mfa.ErrTooManyAttempts) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		log.Println("error disabling TOTP:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setMFAChallengeCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaChallengeCookie,
+		Value:    token,
+		Path:     mfaChallengeCookiePath,
+		Expires:  time.Now().Add(5 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearMFAChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   mfaChallengeCookie,
+		Value:  "",
+		Path:   mfaChallengeCookiePath,
+		MaxAge: -1,
+	})
+}
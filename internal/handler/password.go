@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/hook"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/password"
+	"github.com/lattots/salpa/internal/policy"
+)
+
+const (
+	// Password logins and registrations from one address, which also limits the hashing work it can cause
+	maxPasswordAttemptsPerIP = 50
+	passwordAttemptWindow    = 15 * time.Minute
+)
+
+// HandlePasswordRegister creates a password account from a form post and emails a verification link.
+// The new user is logged in right away unless a verified email is required.
+// Form values: email, password and return_to.
+func (h *Handler) HandlePasswordRegister(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.PostFormValue("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.passwordAttempts.Allow(h.clientIP(r)) {
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := h.passwords.Register(r.Context(), r.PostFormValue("email"), r.PostFormValue("password"))
+	switch {
+	case errors.Is(err, password.ErrRegistrationClosed), errors.Is(err, policy.ErrNotInvited):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, password.ErrEmailAlreadyInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, password.ErrInvalidEmail),
+		errors.Is(err, password.ErrPasswordTooShort),
+		errors.Is(err, password.ErrPasswordTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Error registering user", http.StatusInternalServerError)
+		log.Println("error registering password user:", err)
+		return
+	}
+
+	sent := h.sendInBackground(r, "verification email", func(ctx context.Context) error {
+		return h.passwords.SendVerificationEmail(ctx, user, returnToURL)
+	})
+	if !sent {
+		// The user can ask for a new link, so the registration still succeeds
+		log.Println("verification email not sent, too many emails being sent")
+	}
+
+	if h.passwords.RequireVerifiedEmail() {
+		http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+		return
+	}
+	if !h.checkLogin(w, user) {
+		return
+	}
+	h.startSession(w, r, user, hook.ProviderPassword, []string{models.AMRPassword}, returnToURL)
+}
+
+// HandlePasswordLogin logs a user in with the email and password from a form post.
+// Form values: email, password and return_to.
+func (h *Handler) HandlePasswordLogin(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.PostFormValue("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.passwordAttempts.Allow(h.clientIP(r)) {
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := h.passwords.Login(r.Context(), r.PostFormValue("email"), r.PostFormValue("password"))
+	if errors.Is(err, password.ErrInvalidCredentials) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, password.ErrTooManyAttempts) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, password.ErrEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		log.Println("error logging in password user:", err)
+		return
+	}
+	if !h.checkLogin(w, user) {
+		return
+	}
+
+	h.startSession(w, r, user, hook.ProviderPassword, []string{models.AMRPassword}, returnToURL)
+}
+
+// HandleForgotPassword emails a password reset link. Form value: email.
+// The response is the same whether or not the email is registered.
+func (h *Handler) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	email := r.PostFormValue("email")
+	if email == "" {
+		http.Error(w, "Email missing", http.StatusBadRequest)
+		return
+	}
+
+	// Sending takes time only when the account exists, so it's done in the background to keep response times equal
+	sending := h.sendInBackground(r, "password reset email", func(ctx context.Context) error {
+		return h.passwords.RequestPasswordReset(ctx, email)
+	})
+	if !sending {
+		http.Error(w, "Too many requests, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleResetPassword sets a new password with the token from a reset link and logs the user in.
+// Form values: token, password and return_to.
+func (h *Handler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.PostFormValue("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.passwords.ResetPassword(r.Context(), r.PostFormValue("token"), r.PostFormValue("password"))
+	switch {
+	case errors.Is(err, password.ErrInvalidToken),
+		errors.Is(err, password.ErrPasswordTooShort),
+		errors.Is(err, password.ErrPasswordTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		log.Println("error resetting password:", err)
+		return
+	}
+
+	// Whoever knew the old password must not stay logged in
+	if err = h.token.RevokeUserRefreshTokens(user.GetID()); err != nil {
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		log.Println("error revoking sessions after password reset:", err)
+		return
+	}
+
+	// The reset link proved control of the email
+	if !h.checkLogin(w, user) {
+		return
+	}
+	h.startSession(w, r, user, hook.ProviderPassword, []string{models.AMREmail}, returnToURL)
+}
+
+// HandleVerifyEmail is the target of verification links. Query parameters: token and return_to.
+func (h *Handler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.URL.Query().Get("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.passwords.VerifyEmail(r.Context(), r.URL.Query().Get("token"))
+	if errors.Is(err, password.ErrInvalidToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		log.Println("error verifying email:", err)
+		return
+	}
+
+	http.Redirect(w, r, returnToURL, http.StatusSeeOther)
+}
+
+// HandleResendVerification emails a new verification link. Form values: email and return_to.
+func (h *Handler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	returnToURL, err := h.validateReturnTo(r.PostFormValue("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email := r.PostFormValue("email")
+	if email == "" {
+		http.Error(w, "Email missing", http.StatusBadRequest)
+		return
+	}
+
+	sending := h.sendInBackground(r, "verification email", func(ctx context.Context) error {
+		return h.passwords.ResendVerificationEmail(ctx, email, returnToURL)
+	})
+	if !sending {
+		http.Error(w, "Too many requests, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
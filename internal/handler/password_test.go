@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/ratelimit"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		header, value, remoteAddr string
+		want                      string
+	}{
+		{"", "", "192.0.2.1:1234", "192.0.2.1"},
+		{"", "", "[2001:db8::1]:1234", "2001:db8::1"},
+		// The header is ignored unless the proxy is configured to set it
+		{"", "203.0.113.7", "192.0.2.1:1234", "192.0.2.1"},
+		{"X-Real-IP", "203.0.113.7", "192.0.2.1:1234", "203.0.113.7"},
+		// Client can send its own X-Forwarded-For, the proxy appends the real address
+		{"X-Forwarded-For", "198.51.100.1, 203.0.113.7", "192.0.2.1:1234", "203.0.113.7"},
+		{"X-Forwarded-For", "", "192.0.2.1:1234", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		h := &Handler{clientIPHeader: test.header}
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.value != "" {
+			r.Header.Set("X-Real-IP", test.value)
+			r.Header.Set("X-Forwarded-For", test.value)
+		}
+		if got := h.clientIP(r); got != test.want {
+			t.Errorf("header %q value %q: want %s got %s", test.header, test.value, test.want, got)
+		}
+	}
+}
+
+func TestPasswordAttemptsPerIP(t *testing.T) {
+	allowlist, err := newReturnToAllowlist("https://app.test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{allowedReturnTo: allowlist, passwordAttempts: ratelimit.New(1, time.Hour)}
+	// The only attempt of the address is used up
+	h.passwordAttempts.Add("192.0.2.1")
+
+	for _, handler := range []http.HandlerFunc{h.HandlePasswordLogin, h.HandlePasswordRegister} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("email=test@example.com&password=password&return_to=/home"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected %d, got %d", http.StatusTooManyRequests, w.Code)
+		}
+	}
+}
+
+func TestSendInBackgroundLimit(t *testing.T) {
+	h := &Handler{emailSlots: make(chan struct{}, 1)}
+
+	sent := make(chan struct{})
+	release := make(chan struct{})
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	ok := h.sendInBackground(r, "test email", func(ctx context.Context) error {
+		close(sent)
+		<-release
+		return nil
+	})
+	if !ok {
+		t.Fatal("first send should start")
+	}
+	<-sent
+
+	// The only slot is taken, so the request is turned away before the account is looked up
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("email=test@example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.HandleForgotPassword(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	close(release)
+	for len(h.emailSlots) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !h.sendInBackground(r, "test email", func(ctx context.Context) error { return nil }) {
+		t.Error("slot should be free after the send finished")
+	}
+}
+
+func TestRegisterSendsInBackground(t *testing.T) {
+	h, _, mailer := initPolicyHandler(t, config.PolicyConfig{})
+	// Every slot is taken, so the verification email can't be sent right now
+	for range cap(h.emailSlots) {
+		h.emailSlots <- struct{}{}
+	}
+
+	form := url.Values{"email": {"alice@example.com"}, "password": {"long enough password"}, "return_to": {"/home"}}
+	if w := postForm(h.HandlePasswordRegister, form); w.Code != http.StatusSeeOther {
+		t.Errorf("registration should succeed without the email, expected %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body)
+	}
+	if sent := mailer.messages(); len(sent) != 0 {
+		t.Errorf("no email should be sent while every slot is taken, got %d", len(sent))
+	}
+
+	// The email is sent in the background once a slot is free
+	for range cap(h.emailSlots) {
+		<-h.emailSlots
+	}
+	form.Set("email", "bob@example.com")
+	if w := postForm(h.HandlePasswordRegister, form); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body)
+	}
+	waitForEmails(h)
+	if sent := mailer.messages(); len(sent) != 1 || sent[0].To != "bob@example.com" {
+		t.Errorf("expected the verification email of the second user, got %+v", sent)
+	}
+}
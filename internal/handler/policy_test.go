@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/claims"
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/magiclink"
+	"github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/password"
+	"github.com/lattots/salpa/internal/policy"
+	"github.com/lattots/salpa/internal/ratelimit"
+	"github.com/lattots/salpa/internal/token"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/webauthn"
+)
+
+// testMailer keeps the sent emails, so tests can read the links in them
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *testMailer) messages() []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sent)
+}
+
+// lastToken returns the token query parameter of the link in the last email.
+func (m *testMailer) lastToken(t *testing.T) string {
+	sent := m.messages()
+	if len(sent) == 0 {
+		t.Fatal("no email sent")
+	}
+	body := sent[len(sent)-1].Body
+	start := strings.Index(body, "https://")
+	if start == -1 {
+		t.Fatalf("no link in email: %s", body)
+	}
+	link, err := url.Parse(strings.Fields(body[start:])[0])
+	if err != nil {
+		t.Fatalf("invalid link in email: %s", err)
+	}
+	return link.Query().Get("token")
+}
+
+// initPolicyHandler returns a handler with the local login methods and the given sign-up policy.
+func initPolicyHandler(t *testing.T, conf config.PolicyConfig) (*Handler, store.Store, *testMailer) {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	signUpPolicy, err := policy.NewPolicy(conf, tokenStore)
+	if err != nil {
+		t.Fatalf("error creating policy: %s", err)
+	}
+
+	mailer := &testMailer{}
+	passwords, err := password.NewProvider(tokenStore, mailer, password.Settings{
+		Params:            password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		MinLength:         10,
+		AllowRegistration: true,
+		VerifyURL:         "https://auth.test.com/auth/password/verify",
+		ResetURL:          "https://app.test.com/reset-password",
+	})
+	if err != nil {
+		t.Fatalf("error creating password provider: %s", err)
+	}
+	passwords.SetSignUpCheck(signUpPolicy.SignUp)
+
+	magicLinks := magiclink.NewProvider(tokenStore, mailer, magiclink.Settings{
+		TTL:               time.Minute,
+		MaxPerHour:        5,
+		AllowRegistration: true,
+		LoginURL:          "https://auth.test.com/auth/magic-link/verify",
+	})
+	magicLinks.SetSignUpCheck(signUpPolicy.SignUp)
+
+	passkeys, err := webauthn.NewProvider(tokenStore, webauthn.Settings{
+		RPID:    "app.test.com",
+		Origins: []string{"https://app.test.com"},
+	})
+	if err != nil {
+		t.Fatalf("error creating passkey provider: %s", err)
+	}
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating signing key: %s", err)
+	}
+	claimRules, err := claims.NewRules(nil, tokenStore)
+	if err != nil {
+		t.Fatalf("error creating claim rules: %s", err)
+	}
+	allowlist, err := newReturnToAllowlist("https://app.test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		passwords:         passwords,
+		magicLinks:        magicLinks,
+		passkeys:          passkeys,
+		policy:            signUpPolicy,
+		claimRules:        claimRules,
+		token:             token.NewManager(tokenStore, signingKey),
+		appDomain:         "https://app.test.com",
+		passwordAttempts:  ratelimit.New(maxPasswordAttemptsPerIP, passwordAttemptWindow),
+		magicLinkRequests: ratelimit.New(maxMagicLinksPerIP, magicLinkWindow),
+		passkeyLogins:     ratelimit.New(maxPasskeyLoginsPerIP, passkeyLoginWindow),
+		emailSlots:        make(chan struct{}, maxConcurrentEmails),
+		allowedReturnTo:   allowlist,
+	}
+	return h, tokenStore, mailer
+}
+
+// waitForEmails waits until the emails being sent in the background have been sent.
+func waitForEmails(h *Handler) {
+	for len(h.emailSlots) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func postForm(handler http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	h, tokenStore, mailer := initPolicyHandler(t, config.PolicyConfig{BlockedDomains: []string{"blocked.com"}})
+	ctx := context.Background()
+	form := url.Values{"email": {"eve@blocked.com"}, "password": {"long enough password"}, "return_to": {"/home"}}
+
+	if w := postForm(h.HandlePasswordRegister, form); w.Code != http.StatusForbidden {
+		t.Errorf("register: expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+	// Verification email of the registration is sent before the reset email below
+	waitForEmails(h)
+	if w := postForm(h.HandlePasswordLogin, form); w.Code != http.StatusForbidden {
+		t.Errorf("login: expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if err := h.passwords.RequestPasswordReset(ctx, "eve@blocked.com"); err != nil {
+		t.Fatalf("failed to request password reset: %s", err)
+	}
+	reset := url.Values{"token": {mailer.lastToken(t)}, "password": {"a new long password"}, "return_to": {"/home"}}
+	if w := postForm(h.HandleResetPassword, reset); w.Code != http.StatusForbidden {
+		t.Errorf("reset: expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if _, err := tokenStore.GetLocalUserByEmail(ctx, "eve@blocked.com"); err != nil {
+		t.Errorf("account should exist even though it can't log in, got %v", err)
+	}
+}
+
+func TestPasswordPolicy_InviteOnly(t *testing.T) {
+	h, tokenStore, _ := initPolicyHandler(t, config.PolicyConfig{InviteOnly: true})
+	ctx := context.Background()
+	if _, err := h.policy.Invite(ctx, "alice@example.com", time.Hour); err != nil {
+		t.Fatalf("failed to invite: %s", err)
+	}
+
+	// Nobody has verified the email, so even an invited address can't register with a password
+	form := url.Values{"email": {"alice@example.com"}, "password": {"long enough password"}, "return_to": {"/home"}}
+	if w := postForm(h.HandlePasswordRegister, form); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if _, err := tokenStore.GetLocalUserByEmail(ctx, "alice@example.com"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("no account should be created, got %v", err)
+	}
+}
+
+func TestMagicLinkPolicy(t *testing.T) {
+	h, tokenStore, mailer := initPolicyHandler(t, config.PolicyConfig{InviteOnly: true, BlockedDomains: []string{"blocked.com"}})
+	ctx := context.Background()
+
+	openLink := func(email string) int {
+		send, err := h.magicLinks.CreateLink(ctx, email, "/home")
+		if err != nil {
+			t.Fatalf("failed to create login link: %s", err)
+		}
+		if err = send(ctx); err != nil {
+			t.Fatalf("failed to send login link: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/?token="+mailer.lastToken(t), nil)
+		w := httptest.NewRecorder()
+		h.HandleMagicLinkLogin(w, r)
+		return w.Code
+	}
+
+	// Uninvited address can't sign up by opening a link
+	if code := openLink("alice@example.com"); code != http.StatusForbidden {
+		t.Errorf("sign-up: expected %d, got %d", http.StatusForbidden, code)
+	}
+	if _, err := tokenStore.GetLocalUserByEmail(ctx, "alice@example.com"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("no account should be created, got %v", err)
+	}
+
+	// Existing account in a blocked domain can't log in
+	user := models.LocalUser{ID: "user-1", Email: "eve@blocked.com", EmailVerified: true, CreatedAt: time.Now()}
+	if err := tokenStore.AddLocalUser(ctx, user); err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+	if code := openLink(user.Email); code != http.StatusForbidden {
+		t.Errorf("login: expected %d, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestWebAuthnPolicy(t *testing.T) {
+	h, tokenStore, _ := initPolicyHandler(t, config.PolicyConfig{BlockedDomains: []string{"blocked.com"}})
+	ctx := context.Background()
+
+	user := models.Account{ID: "user-1", Email: "eve@blocked.com", EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: "123", UserID: user.ID, Email: user.Email, CreatedAt: time.Now()}
+	if err := tokenStore.AddUserWithIdentity(ctx, user, identity); err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error encoding key: %s", err)
+	}
+	credentialID := []byte("credential-1")
+	err = tokenStore.AddWebAuthnCredential(ctx, models.WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(credentialID),
+		UserID:    user.ID,
+		Email:     user.Email,
+		PublicKey: publicKey,
+		Algorithm: -7, // ES256
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to add credential: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleWebAuthnLoginBegin(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	var options webauthn.RequestOptions
+	if err = json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("invalid login options: %s", err)
+	}
+
+	// Assertion of a user verified passkey, which logs in without a second factor
+	rpIDHash := sha256.Sum256([]byte("app.test.com"))
+	authData := binary.BigEndian.AppendUint32(append(rpIDHash[:], 0x01|0x04), 1)
+	clientData, _ := json.Marshal(map[string]string{
+		"type": "webauthn.get", "challenge": options.PublicKey.Challenge, "origin": "https://app.test.com",
+	})
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("error signing assertion: %s", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		},
+	})
+
+	w = httptest.NewRecorder()
+	h.HandleWebAuthnLoginFinish(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d: %s", http.StatusForbidden, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var ErrInvalidReturnTo = errors.New("return_to is not an allowed redirect target")
+
+// returnToTarget is an origin and a path prefix users can be redirected to after login and logout.
+type returnToTarget struct {
+	scheme     string
+	host       string
+	pathPrefix string
+}
+
+type returnToAllowlist struct {
+	appURL  *url.URL // Relative return_to paths are resolved against this
+	targets []returnToTarget
+}
+
+// newReturnToAllowlist parses the allowed return_to targets.
+// If no targets are configured, any path in the app domain is allowed.
+func newReturnToAllowlist(appDomain string, allowed []string) (returnToAllowlist, error) {
+	appURL, err := url.Parse(appDomain)
+	if err != nil || appURL.Host == "" {
+		return returnToAllowlist{}, fmt.Errorf("invalid app domain: %s", appDomain)
+	}
+
+	if len(allowed) == 0 {
+		allowed = []string{appDomain}
+	}
+
+	allowlist := returnToAllowlist{appURL: appURL}
+	for _, a := range allowed {
+		u, err := url.Parse(a)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return returnToAllowlist{}, fmt.Errorf("invalid allowed return_to target: %s", a)
+		}
+		allowlist.targets = append(allowlist.targets, returnToTarget{
+			scheme:     u.Scheme,
+			host:       strings.ToLower(u.Host),
+			pathPrefix: strings.TrimSuffix(u.Path, "/"),
+		})
+	}
+	return allowlist, nil
+}
+
+// validate returns the absolute URL of returnTo if it's an allowed redirect target.
+func (l returnToAllowlist) validate(returnTo string) (string, error) {
+	// Backslashes and control characters are interpreted inconsistently by browsers
+	if strings.ContainsAny(returnTo, "\\\r\n\t") {
+		return "", ErrInvalidReturnTo
+	}
+
+	target, err := url.Parse(returnTo)
+	if err != nil || target.User != nil {
+		return "", ErrInvalidReturnTo
+	}
+
+	if !target.IsAbs() {
+		// Protocol relative URLs (//evil.com) would escape the app domain
+		if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+			return "", ErrInvalidReturnTo
+		}
+		target = l.appURL.ResolveReference(target)
+	}
+
+	// Browsers resolve dot segments (also percent encoded ones), which would escape the path prefix
+	if slices.Contains(strings.Split(target.Path, "/"), "..") {
+		return "", ErrInvalidReturnTo
+	}
+
+	for _, t := range l.targets {
+		if target.Scheme != t.scheme || strings.ToLower(target.Host) != t.host {
+			continue
+		}
+		// Prefix must end at a path segment boundary, /app doesn't allow /application
+		if t.pathPrefix == "" || target.Path == t.pathPrefix || strings.HasPrefix(target.Path, t.pathPrefix+"/") {
+			return target.String(), nil
+		}
+	}
+	return "", ErrInvalidReturnTo
+}
+
+func (h *Handler) validateReturnTo(returnTo string) (string, error) {
+	return h.allowedReturnTo.validate(returnTo)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import "testing"
+
+func TestReturnToAllowlist(t *testing.T) {
+	allowlist, err := newReturnToAllowlist("https://app.test.com", []string{
+		"https://app.test.com",
+		"https://admin.test.com/dashboard",
+	})
+	if err != nil {
+		t.Fatalf("failed to create allowlist: %s", err)
+	}
+
+	tests := []struct {
+		returnTo string
+		want     string // Empty if return_to must be rejected
+	}{
+		{"https://app.test.com/home?tab=1", "https://app.test.com/home?tab=1"},
+		{"https://APP.test.com/", "https://APP.test.com/"},
+		{"/home", "https://app.test.com/home"},
+		{"https://admin.test.com/dashboard", "https://admin.test.com/dashboard"},
+		{"https://admin.test.com/dashboard/users", "https://admin.test.com/dashboard/users"},
+		{"https://admin.test.com/dashboards", ""},
+		{"https://admin.test.com/dashboard/../settings", ""},
+		{"https://admin.test.com/dashboard/%2e%2e/settings", ""},
+		{"https://admin.test.com/", ""},
+		{"http://app.test.com/home", ""},
+		{"https://evil.com", ""},
+		{"https://app.test.com.evil.com/", ""},
+		{"https://app.test.com@evil.com/", ""},
+		{"//evil.com", ""},
+		{"/\\evil.com", ""},
+		{"home", ""},
+		{"javascript:alert(1)", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := allowlist.validate(tt.returnTo)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s should be rejected, got %s", tt.returnTo, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s should be allowed, got error %s", tt.returnTo, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("wrong URL for %s, want %s got %s", tt.returnTo, tt.want, got)
+		}
+	}
+}
+
+func TestReturnToAllowlistDefaultsToAppDomain(t *testing.T) {
+	allowlist, err := newReturnToAllowlist("https://app.test.com", nil)
+	if err != nil {
+		t.Fatalf("failed to create allowlist: %s", err)
+	}
+
+	if _, err = allowlist.validate("https://app.test.com/anything"); err != nil {
+		t.Errorf("app domain should be allowed by default, got %s", err)
+	}
+	if _, err = allowlist.validate("https://other.test.com/"); err == nil {
+		t.Error("other domains should not be allowed by default")
+	}
+}
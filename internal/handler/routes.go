@@ -7,12 +7,79 @@ func (h *Handler) SetRoutes(router *http.ServeMux) {
 	router.HandleFunc("GET /auth/login/{provider}", h.HandleLogin)
 
 	// OAuth2 callback function. This creates the refresh token for the authenticated user
+	// Providers redirect back with GET by default and with POST when using the form_post response mode
+	router.HandleFunc("GET /auth/callback/{provider}", h.HandleCallback)
 	router.HandleFunc("POST /auth/callback/{provider}", h.HandleCallback)
 
+	// Linked providers of the signed in user. Linking goes through the provider login and its callback
+	router.HandleFunc("GET /auth/link/{provider}", h.HandleLink)
+	router.HandleFunc("GET /auth/identities", h.HandleListIdentities)
+	router.HandleFunc("POST /auth/unlink/{provider}/{subject}", h.HandleUnlink)
+
+	// Email and password login form endpoints, only available when the password provider is active
+	if h.passwords != nil {
+		router.HandleFunc("POST /auth/password/register", h.HandlePasswordRegister)
+		router.HandleFunc("POST /auth/password/login", h.HandlePasswordLogin)
+
+		// Password reset: the forgot endpoint emails a link to the reset form of the app, which posts to reset
+		router.HandleFunc("POST /auth/password/forgot", h.HandleForgotPassword)
+		router.HandleFunc("POST /auth/password/reset", h.HandleResetPassword)
+
+		// Email verification links point here
+		router.HandleFunc("GET /auth/password/verify", h.HandleVerifyEmail)
+		router.HandleFunc("POST /auth/password/resend-verification", h.HandleResendVerification)
+	}
+
+	// Passwordless login: the first endpoint emails a single use link that points to the second one
+	if h.magicLinks != nil {
+		router.HandleFunc("POST /auth/magic-link", h.HandleMagicLinkRequest)
+		router.HandleFunc("GET /auth/magic-link/verify", h.HandleMagicLinkLogin)
+	}
+
+	// Passkeys: registration adds a passkey to the logged in user, login sets the token cookies
+	if h.passkeys != nil {
+		router.HandleFunc("POST /auth/webauthn/register/begin", h.HandleWebAuthnRegisterBegin)
+		router.HandleFunc("POST /auth/webauthn/register/finish", h.HandleWebAuthnRegisterFinish)
+		router.HandleFunc("POST /auth/webauthn/login/begin", h.HandleWebAuthnLoginBegin)
+		router.HandleFunc("POST /auth/webauthn/login/finish", h.HandleWebAuthnLoginFinish)
+	}
+
+	// Second factor: verify completes a login waiting for a code, the rest manage the TOTP of the logged in user
+	if h.mfa != nil {
+		router.HandleFunc("POST /auth/mfa/verify", h.HandleMFAVerify)
+		router.HandleFunc("POST /auth/mfa/totp/enroll", h.HandleTOTPEnroll)
+		router.HandleFunc("POST /auth/mfa/totp/confirm", h.HandleTOTPConfirm)
+		router.HandleFunc("POST /auth/mfa/totp/disable", h.HandleTOTPDisable)
+	}
+
+	// Admin API, authenticated with an API key or an access token with the admin role
+	if h.adminEnabled() {
+		router.HandleFunc("POST /admin/invitations", h.requireAdmin(h.HandleCreateInvitation))
+		router.HandleFunc("GET /admin/invitations", h.requireAdmin(h.HandleListInvitations))
+		router.HandleFunc("DELETE /admin/invitations/{id}", h.requireAdmin(h.HandleRevokeInvitation))
+
+		router.HandleFunc("GET /admin/sessions", h.requireAdmin(h.HandleListSessions))
+		router.HandleFunc("GET /admin/sessions/{id}", h.requireAdmin(h.HandleGetSession))
+		router.HandleFunc("DELETE /admin/sessions/{id}", h.requireAdmin(h.HandleRevokeSession))
+		router.HandleFunc("DELETE /admin/users/{userID}/sessions", h.requireAdmin(h.HandleRevokeUserSessions))
+	}
+
 	// Refres expiring access token
 	router.HandleFunc("POST /auth/refresh", h.HandleRefresh)
 
+	// Revoke the current refresh token and clear token cookies
+	router.HandleFunc("POST /auth/logout", h.HandleLogout)
+
+	// Revoke every session of the user who owns the current refresh token
+	router.HandleFunc("POST /auth/logout-all", h.HandleLogoutAll)
+
 	// Get access token verification key
 	// This is used by the server to verify incoming access tokens
 	router.HandleFunc("GET /auth/verification-key", h.GetPublicKey)
+
+	// Verification keys as a JSON Web Key Set for non-Go services and API gateways
+	router.HandleFunc("GET /.well-known/jwks.json", h.GetJWKS)
+
+	// Partial OpenID Connect discovery document, so OIDC middleware can find the issuer and keys
+	router.HandleFunc("GET /.well-known/openid-configuration", h.GetOpenIDConfiguration)
 }
@@ -1,44 +1,85 @@
 package handler
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
 	"net/http"
 	"time"
+
+	"github.com/lattots/salpa/internal/oauth"
 )
 
-func generateStateCookie(w http.ResponseWriter) string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	state := base64.URLEncoding.EncodeToString(b)
+// Login state cookies are only needed by the callback, which is under /auth
+const loginStateCookiePath = "/auth"
+
+// setLoginStateCookies starts a new login and stores its state, PKCE code verifier and nonce in cookies.
+func setLoginStateCookies(w http.ResponseWriter) oauth.LoginState {
+	login := oauth.NewLoginState()
 
-	cookie := http.Cookie{
-		Name:     "state",
-		Value:    state,
-		Expires:  time.Now().Add(10 * time.Minute),
-		HttpOnly: true,
+	for name, value := range map[string]string{
+		"state":         login.State,
+		"code_verifier": login.CodeVerifier,
+		"nonce":         login.Nonce,
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     loginStateCookiePath,
+			Expires:  time.Now().Add(10 * time.Minute),
+			HttpOnly: true,
+			Secure:   true,
+			// Lax cookies aren't sent with the cross-site POST of form_post callbacks, the state parameter protects the callback
+			SameSite: http.SameSiteNoneMode,
+		})
 	}
-	http.SetCookie(w, &cookie)
 
-	return state
+	return login
+}
+
+// clearLoginStateCookies removes the login state cookies, so a login can't be completed twice.
+func clearLoginStateCookies(w http.ResponseWriter) {
+	for _, name := range []string{"state", "code_verifier", "nonce"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   loginStateCookiePath,
+			MaxAge: -1,
+		})
+	}
 }
 
 var (
-	ErrNoStateCookie      = errors.New("Cookie missing: no state cookie in request")
-	ErrInvalidStateCookie = errors.New("Invalid cookie: state cookie doesn't match the query parameter")
+	ErrNoStateCookie        = errors.New("Cookie missing: no state cookie in request")
+	ErrInvalidStateCookie   = errors.New("Invalid cookie: state cookie doesn't match the query parameter")
+	ErrNoCodeVerifierCookie = errors.New("Cookie missing: no code_verifier cookie in request")
+	ErrNoNonceCookie        = errors.New("Cookie missing: no nonce cookie in request")
 )
 
-func verifyRequestStateCookie(r *http.Request) error {
+// readLoginState verifies the state parameter of the callback request and returns the login state.
+func readLoginState(r *http.Request) (oauth.LoginState, error) {
 	cookie, err := r.Cookie("state")
 	if err != nil {
-		return ErrNoStateCookie
+		return oauth.LoginState{}, ErrNoStateCookie
 	}
 
 	param := r.FormValue("state")
 
 	if cookie.Value != param {
-		return ErrInvalidStateCookie
+		return oauth.LoginState{}, ErrInvalidStateCookie
 	}
-	return nil
+
+	verifierCookie, err := r.Cookie("code_verifier")
+	if err != nil || verifierCookie.Value == "" {
+		return oauth.LoginState{}, ErrNoCodeVerifierCookie
+	}
+
+	nonceCookie, err := r.Cookie("nonce")
+	if err != nil || nonceCookie.Value == "" {
+		return oauth.LoginState{}, ErrNoNonceCookie
+	}
+
+	return oauth.LoginState{
+		State:        cookie.Value,
+		CodeVerifier: verifierCookie.Value,
+		Nonce:        nonceCookie.Value,
+	}, nil
 }
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/hook"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/webauthn"
+)
+
+// Credentials are a few kilobytes at most
+const maxWebAuthnBodySize = 64 << 10
+
+const (
+	// Login challenges from one address, each of them is stored until it expires
+	maxPasskeyLoginsPerIP = 50
+	passkeyLoginWindow    = 15 * time.Minute
+)
+
+// HandleWebAuthnRegisterBegin returns the options for navigator.credentials.create.
+// Passkeys are added to an existing account, so the user must be logged in.
+func (h *Handler) HandleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	options, err := h.passkeys.BeginRegistration(r.Context(), user)
+	if err != nil {
+		http.Error(w, "Error starting passkey registration", http.StatusInternalServerError)
+		log.Println("error starting passkey registration:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, options)
+}
+
+// HandleWebAuthnRegisterFinish stores the passkey from the JSON encoded PublicKeyCredential in the body.
+func (h *Handler) HandleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.sessionUser(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebAuthnBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	credential, err := h.passkeys.FinishRegistration(r.Context(), user, body)
+	if errors.Is(err, webauthn.ErrVerificationFailed) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error registering passkey", http.StatusInternalServerError)
+		log.Println("error registering passkey:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"id": credential.ID})
+}
+
+// HandleWebAuthnLoginBegin returns the options for navigator.credentials.get.
+func (h *Handler) HandleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if !h.passkeyLogins.Allow(h.clientIP(r)) {
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	options, err := h.passkeys.BeginLogin(r.Context())
+	if err != nil {
+		http.Error(w, "Error starting passkey login", http.StatusInternalServerError)
+		log.Println("error starting passkey login:", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, options)
+}
+
+// HandleWebAuthnLoginFinish verifies the assertion in the body and sets the token cookies.
+// The ceremony runs in JavaScript, so the client navigates on its own instead of being redirected.
+// A passkey used without user verification is only something the user has, so users with a second factor must
+// enter their code as after any other login. The response then tells the client to go to the challenge page.
+// Query parameter: return_to, where the challenge page sends the user. Defaults to the app domain.
+func (h *Handler) HandleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("return_to")
+	if returnTo == "" {
+		returnTo = h.appDomain
+	}
+	returnToURL, err := h.validateReturnTo(returnTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebAuthnBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	user, userVerified, err := h.passkeys.FinishLogin(r.Context(), body)
+	if errors.Is(err, webauthn.ErrVerificationFailed) {
+		http.Error(w, "Passkey verification failed", http.StatusUnauthorized)
+		log.Println("passkey login failed:", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		log.Println("error logging in with passkey:", err)
+		return
+	}
+	if !h.checkLogin(w, user) {
+		return
+	}
+
+	amr := []string{models.AMRPasskey}
+	if !userVerified {
+		challenged, ok := h.startMFAChallenge(w, r, user, hook.ProviderPasskey, amr, returnToURL)
+		if !ok {
+			return
+		}
+		if challenged {
+			writeJSON(w, http.StatusOK, map[string]string{"mfaChallengeURL": h.mfaChallengeURL})
+			return
+		}
+	}
+
+	if !h.issueTokens(w, r, user, hook.ProviderPasskey, amr) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
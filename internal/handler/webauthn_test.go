@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/ratelimit"
+)
+
+func TestPasskeyLoginsPerIP(t *testing.T) {
+	h := &Handler{passkeyLogins: ratelimit.New(1, time.Hour)}
+	// The only login of the address is used up
+	h.passkeyLogins.Add("192.0.2.1")
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.HandleWebAuthnLoginBegin(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
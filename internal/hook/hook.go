@@ -0,0 +1,118 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Hook runs custom logic after a user has logged in but before their session is created.
+// It can deny the login or add roles, groups and claims to the user's access tokens.
+type Hook interface {
+	PreIssuance(ctx context.Context, req Request) (Result, error)
+}
+
+// Func lets an ordinary function be used as a Hook.
+type Func func(ctx context.Context, req Request) (Result, error)
+
+func (f Func) PreIssuance(ctx context.Context, req Request) (Result, error) {
+	return f(ctx, req)
+}
+
+// Names of the built-in login methods in Request.Provider. OAuth2 providers use their configured name.
+const (
+	ProviderPassword  = "password"
+	ProviderMagicLink = "magic-link"
+	ProviderPasskey   = "webauthn"
+)
+
+// Request describes the login the hook decides on.
+type Request struct {
+	// Configured name of the OAuth2 provider or one of the built-in login methods
+	Provider string
+	User     models.User
+	// Authentication methods of the login, see the AMR constants in models
+	AMR []string
+}
+
+// Result is the decision of the hook.
+type Result struct {
+	Allow bool
+	// Told to the user when the login is denied
+	Reason string
+	// Added to the roles and groups of the claim rules
+	Roles  []string
+	Groups []string
+	// Added to the access tokens of the session. Claims Salpa sets itself can't be replaced.
+	Claims map[string]any
+}
+
+// Allow lets the login through without extra claims.
+func Allow() Result {
+	return Result{Allow: true}
+}
+
+// Deny stops the login and tells the user why.
+func Deny(reason string) Result {
+	return Result{Reason: reason}
+}
+
+var (
+	ErrDenied        = errors.New("login denied")
+	ErrReservedClaim = errors.New("hook returned a claim reserved for Salpa")
+)
+
+// Run calls the hook and returns the claims of an allowed login.
+// A denied login returns an error wrapping ErrDenied with the reason of the hook.
+func Run(ctx context.Context, h Hook, req Request) (models.SessionClaims, error) {
+	result, err := h.PreIssuance(ctx, req)
+	if err != nil {
+		return models.SessionClaims{}, err
+	}
+	if !result.Allow {
+		if result.Reason == "" {
+			return models.SessionClaims{}, ErrDenied
+		}
+		return models.SessionClaims{}, fmt.Errorf("%w: %s", ErrDenied, result.Reason)
+	}
+
+	for name := range result.Claims {
+		if models.IsReservedClaim(name) {
+			return models.SessionClaims{}, fmt.Errorf("%w: %s", ErrReservedClaim, name)
+		}
+	}
+	return models.SessionClaims{Roles: result.Roles, Groups: result.Groups, Extra: result.Claims}, nil
+}
+
+// NewHookFromConf returns the webhook of the configuration, or nil when no webhook is configured.
+func NewHookFromConf(conf config.HookConfig) (Hook, error) {
+	if conf.URL == "" {
+		return nil, nil
+	}
+	webhook, err := NewWebhookFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.FailOpen {
+		return failOpen{webhook}, nil
+	}
+	return webhook, nil
+}
+
+// failOpen allows logins when the wrapped hook fails, so an unavailable webhook doesn't lock everyone out
+type failOpen struct {
+	hook Hook
+}
+
+func (f failOpen) PreIssuance(ctx context.Context, req Request) (Result, error) {
+	result, err := f.hook.PreIssuance(ctx, req)
+	if err != nil {
+		log.Println("pre-issuance hook failed, allowing login:", err)
+		return Allow(), nil
+	}
+	return result, nil
+}
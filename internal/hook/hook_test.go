@@ -0,0 +1,140 @@
+package hook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/hook"
+	"github.com/lattots/salpa/internal/models"
+)
+
+const testSecret = "test-secret"
+
+var testRequest = hook.Request{
+	Provider: "google",
+	User:     models.LocalUser{ID: "user-1", Email: "alice@example.com"},
+	AMR:      []string{models.AMRFederated},
+}
+
+// newWebhookServer answers signed requests with the response and rejects the rest
+func newWebhookServer(t *testing.T, response string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading request: %s\n", err)
+		}
+		signature := hook.Sign([]byte(testSecret), r.Header.Get(hook.TimestampHeader), body)
+		if r.Header.Get(hook.SignatureHeader) != signature {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Provider string `json:"provider"`
+			User     struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		if err = json.Unmarshal(body, &req); err != nil || req.Provider != "google" || req.User.ID != "user-1" {
+			t.Errorf("unexpected request: %s\n", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebhookUserName(t *testing.T) {
+	var name string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			User struct {
+				Name string `json:"name"`
+			} `json:"user"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("error decoding request: %s\n", err)
+		}
+		name = req.User.Name
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"allow": true}`)
+	}))
+	t.Cleanup(server.Close)
+	webhook := hook.NewWebhook(server.URL, testSecret, time.Second)
+
+	req := hook.Request{
+		Provider: "apple",
+		User:     models.Account{ID: "user-1", Email: "alice@example.com", Name: "Alice Example"},
+		AMR:      []string{models.AMRFederated},
+	}
+	if _, err := hook.Run(context.Background(), webhook, req); err != nil {
+		t.Fatalf("login should be allowed, got %s\n", err)
+	}
+	if name != "Alice Example" {
+		t.Errorf("expected the user's name in the request, got %q\n", name)
+	}
+}
+
+func TestWebhookAllow(t *testing.T) {
+	server := newWebhookServer(t, `{"allow": true, "roles": ["admin"], "claims": {"tenantID": "tenant-1"}}`)
+	webhook := hook.NewWebhook(server.URL, testSecret, time.Second)
+
+	claims, err := hook.Run(context.Background(), webhook, testRequest)
+	if err != nil {
+		t.Fatalf("login should be allowed, got %s\n", err)
+	}
+	if claims.Extra["tenantID"] != "tenant-1" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Errorf("unexpected claims: %v\n", claims)
+	}
+}
+
+func TestWebhookDeny(t *testing.T) {
+	server := newWebhookServer(t, `{"allow": false, "reason": "account suspended"}`)
+	webhook := hook.NewWebhook(server.URL, testSecret, time.Second)
+
+	_, err := hook.Run(context.Background(), webhook, testRequest)
+	if !errors.Is(err, hook.ErrDenied) || err.Error() != "login denied: account suspended" {
+		t.Errorf("login should be denied with the reason, got %v\n", err)
+	}
+}
+
+func TestWebhookWrongSecret(t *testing.T) {
+	server := newWebhookServer(t, `{"allow": true}`)
+	webhook := hook.NewWebhook(server.URL, "wrong-secret", time.Second)
+
+	if _, err := hook.Run(context.Background(), webhook, testRequest); !errors.Is(err, hook.ErrWebhookFailed) {
+		t.Errorf("expected %s, got %v\n", hook.ErrWebhookFailed, err)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	}))
+	t.Cleanup(server.Close)
+	webhook := hook.NewWebhook(server.URL, testSecret, 50*time.Millisecond)
+
+	if _, err := hook.Run(context.Background(), webhook, testRequest); !errors.Is(err, hook.ErrWebhookFailed) {
+		t.Errorf("expected %s, got %v\n", hook.ErrWebhookFailed, err)
+	}
+}
+
+func TestRunReservedClaim(t *testing.T) {
+	inProcess := hook.Func(func(ctx context.Context, req hook.Request) (hook.Result, error) {
+		return hook.Result{Allow: true, Claims: map[string]any{"sub": "someone-else"}}, nil
+	})
+
+	if _, err := hook.Run(context.Background(), inProcess, testRequest); !errors.Is(err, hook.ErrReservedClaim) {
+		t.Errorf("expected %s, got %v\n", hook.ErrReservedClaim, err)
+	}
+}
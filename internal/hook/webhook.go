@@ -0,0 +1,149 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Headers of the webhook request. The signature is the hex encoded HMAC-SHA256 of "{timestamp}.{body}".
+const (
+	TimestampHeader = "X-Salpa-Timestamp"
+	SignatureHeader = "X-Salpa-Signature"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	// Responses are small JSON documents
+	maxWebhookResponseSize = 64 << 10
+)
+
+var ErrWebhookFailed = errors.New("pre-issuance webhook failed")
+
+// Webhook posts the login to an HTTP endpoint, which answers with the decision.
+type Webhook struct {
+	url     string
+	secret  []byte
+	timeout time.Duration
+	client  *http.Client
+}
+
+type webhookUser struct {
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"emailVerified,omitempty"`
+	Name          string `json:"name,omitempty"`
+}
+
+type webhookRequest struct {
+	Provider string      `json:"provider"`
+	User     webhookUser `json:"user"`
+	AMR      []string    `json:"amr"`
+}
+
+type webhookResponse struct {
+	Allow  bool           `json:"allow"`
+	Reason string         `json:"reason"`
+	Roles  []string       `json:"roles"`
+	Groups []string       `json:"groups"`
+	Claims map[string]any `json:"claims"`
+}
+
+func NewWebhookFromConf(conf config.HookConfig) (*Webhook, error) {
+	secret := os.Getenv(conf.EnvironmentVariables["secret"])
+	if secret == "" {
+		return nil, errors.New("pre-issuance webhook secret is not set")
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return NewWebhook(conf.URL, secret, timeout), nil
+}
+
+func NewWebhook(url, secret string, timeout time.Duration) *Webhook {
+	return &Webhook{
+		url:     url,
+		secret:  []byte(secret),
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (wh *Webhook) PreIssuance(ctx context.Context, req Request) (Result, error) {
+	body, err := json.Marshal(newWebhookRequest(req))
+	if err != nil {
+		return Result{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wh.timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(TimestampHeader, timestamp)
+	httpReq.Header.Set(SignatureHeader, Sign(wh.secret, timestamp, body))
+
+	res, err := wh.client.Do(httpReq)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %w", ErrWebhookFailed, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("%w: unexpected status %s", ErrWebhookFailed, res.Status)
+	}
+
+	var decoded webhookResponse
+	if err = json.NewDecoder(io.LimitReader(res.Body, maxWebhookResponseSize)).Decode(&decoded); err != nil {
+		return Result{}, fmt.Errorf("%w: error decoding response: %w", ErrWebhookFailed, err)
+	}
+	return Result{
+		Allow:  decoded.Allow,
+		Reason: decoded.Reason,
+		Roles:  decoded.Roles,
+		Groups: decoded.Groups,
+		Claims: decoded.Claims,
+	}, nil
+}
+
+// Sign returns the signature of a webhook request body sent at the given unix timestamp.
+// Receivers compute it with their copy of the secret and compare it to the signature header.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookRequest(req Request) webhookRequest {
+	user := webhookUser{ID: req.User.GetID(), Email: req.User.GetEmail()}
+	if verifiedUser, ok := req.User.(models.VerifiedEmailUser); ok {
+		verified := verifiedUser.IsEmailVerified()
+		user.EmailVerified = &verified
+	}
+	if namedUser, ok := req.User.(models.NamedUser); ok {
+		user.Name = namedUser.GetName()
+	}
+	amr := req.AMR
+	if amr == nil {
+		amr = []string{}
+	}
+	return webhookRequest{Provider: req.Provider, User: user, AMR: amr}
+}
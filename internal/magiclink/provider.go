@@ -0,0 +1,232 @@
+package magiclink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/config"
+	mailer "github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/google/uuid"
+)
+
+// Store is the part of the token store the magic link provider uses.
+type Store interface {
+	store.UserStore
+	store.LocalUserStore
+	store.OneTimeTokenStore
+
+	RemoveAllForUser(ctx context.Context, userID string) error
+}
+
+// Settings of the magic link provider.
+type Settings struct {
+	// How long a link can be used
+	TTL time.Duration
+	// Links sent to a single address in an hour
+	MaxPerHour int
+	// Opening a link sent to an unknown address creates an account
+	AllowRegistration bool
+
+	// Salpa endpoint the links point to
+	LoginURL string
+}
+
+// Provider logs users in with single use links sent to their email address.
+// Users are local accounts, so the same person can log in with a password and a magic link.
+type Provider struct {
+	users    Store
+	mailer   mailer.Mailer
+	settings Settings
+
+	// Called before a new account is created, nil allows every sign-up
+	signUp account.SignUpFunc
+}
+
+const purposeMagicLink = "magic_link"
+
+const (
+	defaultTTL        = 15 * time.Minute
+	defaultMaxPerHour = 5
+)
+
+var (
+	ErrInvalidEmail = util.ErrInvalidEmail
+	ErrRateLimited  = errors.New("too many login links requested, try again later")
+	ErrInvalidToken = errors.New("login link is invalid or has expired")
+)
+
+func NewProviderFromConf(conf config.SystemConfiguration, users Store, m mailer.Mailer) *Provider {
+	ttl := conf.MagicLink.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	maxPerHour := conf.MagicLink.MaxPerHour
+	if maxPerHour == 0 {
+		maxPerHour = defaultMaxPerHour
+	}
+
+	return NewProvider(users, m, Settings{
+		TTL:               ttl,
+		MaxPerHour:        maxPerHour,
+		AllowRegistration: conf.MagicLink.AllowRegistration,
+		LoginURL:          util.BuildURL(conf.Service.ServiceDomain, "magic-link", "verify"),
+	})
+}
+
+func NewProvider(users Store, m mailer.Mailer, settings Settings) *Provider {
+	return &Provider{users: users, mailer: m, settings: settings}
+}
+
+// SetSignUpCheck sets the function that decides whether opening a link may create a new account.
+func (p *Provider) SetSignUpCheck(signUp account.SignUpFunc) {
+	p.signUp = signUp
+}
+
+// CreateLink stores a login link for the address and returns the function that emails it, so the caller can send it
+// in the background. Requests are counted per address whether or not it has an account, which stops flooding anyone's
+// inbox without revealing accounts. Links to unknown addresses are not sent when registration is not allowed.
+func (p *Provider) CreateLink(ctx context.Context, email, returnTo string) (func(ctx context.Context) error, error) {
+	email, err := util.NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	sent, err := p.users.CountOneTimeTokens(ctx, email, purposeMagicLink, time.Now().Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if sent >= p.settings.MaxPerHour {
+		return nil, ErrRateLimited
+	}
+
+	token, hash := util.NewOneTimeToken()
+	err = p.users.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:    hash,
+		Purpose: purposeMagicLink,
+		// The user is found by the email when the link is opened
+		Email:     email,
+		Data:      returnTo,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(p.settings.TTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) error {
+		return p.send(ctx, email, token)
+	}, nil
+}
+
+func (p *Provider) send(ctx context.Context, email, token string) error {
+	if !p.settings.AllowRegistration {
+		_, err := p.users.GetLocalUserByEmail(ctx, email)
+		if errors.Is(err, store.ErrUserNotFound) {
+			// Users who have logged in with a provider using the address can log in without registering
+			_, err = p.users.GetUserByVerifiedEmail(ctx, email)
+		}
+		if errors.Is(err, store.ErrUserNotFound) {
+			// Opening the link would fail, so there's no point in sending it
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	link, err := util.AddQuery(p.settings.LoginURL, url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	return p.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Open the link below to log in. The link expires in %s and can only be used once.\n"+
+			"If you didn't ask to log in, you can ignore this email.\n\n%s\n",
+			p.settings.TTL, link),
+	})
+}
+
+// Login uses up the token of a login link and returns the user and the return_to URL stored with the link.
+// Opening the link proves the user controls the address, so the email is marked verified.
+func (p *Provider) Login(ctx context.Context, token string) (models.User, string, error) {
+	if token == "" {
+		return nil, "", ErrInvalidToken
+	}
+	t, err := p.users.ConsumeOneTimeToken(ctx, util.HashOneTimeToken(token), purposeMagicLink)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return nil, "", ErrInvalidToken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, err := p.users.GetLocalUserByEmail(ctx, t.Email)
+	if errors.Is(err, store.ErrUserNotFound) {
+		user, err = p.register(ctx, t.Email)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !user.EmailVerified {
+		// Anyone could have registered the address with a password before its owner opened the link.
+		// The password and the sessions started with it must not survive the owner taking over the account.
+		if user.PasswordHash != "" {
+			if err = p.users.UpdateLocalUserPassword(ctx, user.ID, ""); err != nil {
+				return nil, "", err
+			}
+			user.PasswordHash = ""
+		}
+		if err = p.users.RemoveAllForUser(ctx, user.ID); err != nil {
+			return nil, "", err
+		}
+		// The account joins the user who already had the verified email, if there is one
+		if user, err = p.users.SetLocalUserEmailVerified(ctx, user.ID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return user, t.Data, nil
+}
+
+// register creates an account without a password. A password can be added later with a reset link.
+// The link proves the user controls the email, so a user who logged in with a provider using the same verified
+// email gets the account instead of a new user.
+func (p *Provider) register(ctx context.Context, email string) (models.LocalUser, error) {
+	userID := uuid.NewString()
+	existing, err := p.users.GetUserByVerifiedEmail(ctx, email)
+	if err == nil {
+		userID = existing.ID
+	} else if !errors.Is(err, store.ErrUserNotFound) {
+		return models.LocalUser{}, err
+	} else if !p.settings.AllowRegistration {
+		return models.LocalUser{}, ErrInvalidToken
+	} else if p.signUp != nil {
+		// Opening the link verified the email, so it can use an invitation
+		if err = p.signUp(ctx, email, true); err != nil {
+			return models.LocalUser{}, err
+		}
+	}
+
+	user := models.LocalUser{
+		ID:            userID,
+		Email:         email,
+		EmailVerified: true,
+		CreatedAt:     time.Now(),
+	}
+	err = p.users.AddLocalUser(ctx, user)
+	// Two links to the same new address were opened at the same time
+	if errors.Is(err, store.ErrUserExists) {
+		return p.users.GetLocalUserByEmail(ctx, email)
+	}
+	return user, err
+}
@@ -0,0 +1,216 @@
+package magiclink_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/magiclink"
+	"github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+func initProvider(t *testing.T, allowRegistration bool) (*magiclink.Provider, store.Store, <-chan string) {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	port, received, closeFunc := mail.CreateMockSMTPServer()
+	t.Cleanup(closeFunc)
+	mailer := mail.NewSMTPMailer("localhost", port, "", "", "salpa@example.com")
+
+	provider := magiclink.NewProvider(tokenStore, mailer, magiclink.Settings{
+		TTL:               15 * time.Minute,
+		MaxPerHour:        2,
+		AllowRegistration: allowRegistration,
+		LoginURL:          "https://auth.example.com/auth/magic-link/verify",
+	})
+	return provider, tokenStore, received
+}
+
+func sendLink(ctx context.Context, provider *magiclink.Provider, email, returnTo string) error {
+	send, err := provider.CreateLink(ctx, email, returnTo)
+	if err != nil {
+		return err
+	}
+	return send(ctx)
+}
+
+// readToken returns the token of the login link in the next email the mock SMTP server receives.
+func readToken(t *testing.T, received <-chan string) string {
+	var msg string
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received\n")
+	}
+	start := strings.Index(msg, "https://auth.example.com/")
+	if start == -1 {
+		t.Fatalf("no login link in email: %s\n", msg)
+	}
+	link, err := url.Parse(strings.Fields(msg[start:])[0])
+	if err != nil {
+		t.Fatalf("invalid login link: %s\n", err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	provider, tokenStore, received := initProvider(t, true)
+	ctx := context.Background()
+
+	if err := sendLink(ctx, provider, "Test-User@Example.com", "https://app.example.com/dashboard"); err != nil {
+		t.Fatalf("failed to send login link: %s\n", err)
+	}
+	token := readToken(t, received)
+
+	user, returnTo, err := provider.Login(ctx, token)
+	if err != nil {
+		t.Fatalf("failed to log in: %s\n", err)
+	}
+	if user.GetEmail() != "test-user@example.com" {
+		t.Errorf("wrong email, want test-user@example.com got %s\n", user.GetEmail())
+	}
+	if returnTo != "https://app.example.com/dashboard" {
+		t.Errorf("return_to should be the one stored with the link, got %s\n", returnTo)
+	}
+
+	stored, err := tokenStore.GetLocalUserByEmail(ctx, "test-user@example.com")
+	if err != nil || stored.ID != user.GetID() || !stored.EmailVerified {
+		t.Errorf("verified account should have been created, got %+v %v\n", stored, err)
+	}
+
+	if _, _, err = provider.Login(ctx, token); !errors.Is(err, magiclink.ErrInvalidToken) {
+		t.Errorf("login link should be single use, got %v\n", err)
+	}
+
+	// Second login uses the same account
+	if err = sendLink(ctx, provider, "test-user@example.com", "https://app.example.com"); err != nil {
+		t.Fatalf("failed to send login link: %s\n", err)
+	}
+	again, _, err := provider.Login(ctx, readToken(t, received))
+	if err != nil || again.GetID() != user.GetID() {
+		t.Errorf("existing account should log in, got %v %v\n", again, err)
+	}
+}
+
+func TestMagicLinkRateLimit(t *testing.T) {
+	provider, _, received := initProvider(t, true)
+	ctx := context.Background()
+
+	for range 2 {
+		if err := sendLink(ctx, provider, "test-user@example.com", "https://app.example.com"); err != nil {
+			t.Fatalf("failed to send login link: %s\n", err)
+		}
+		readToken(t, received)
+	}
+	if err := sendLink(ctx, provider, "test-user@example.com", "https://app.example.com"); !errors.Is(err, magiclink.ErrRateLimited) {
+		t.Errorf("third link within an hour should be rate limited, got %v\n", err)
+	}
+	if err := sendLink(ctx, provider, "other-user@example.com", "https://app.example.com"); err != nil {
+		t.Errorf("rate limit should be per address, got %v\n", err)
+	}
+}
+
+func TestMagicLinkExpired(t *testing.T) {
+	provider, tokenStore, _ := initProvider(t, true)
+	ctx := context.Background()
+
+	err := tokenStore.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:      "expired",
+		Purpose:   "magic_link",
+		Email:     "test-user@example.com",
+		CreatedAt: time.Now().Add(-time.Hour),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("failed to add token: %s\n", err)
+	}
+	if _, _, err = provider.Login(ctx, "expired"); !errors.Is(err, magiclink.ErrInvalidToken) {
+		t.Errorf("expired link should be rejected, got %v\n", err)
+	}
+}
+
+func TestMagicLinkRegistrationClosed(t *testing.T) {
+	provider, _, received := initProvider(t, false)
+	ctx := context.Background()
+
+	for range 2 {
+		if err := sendLink(ctx, provider, "unknown@example.com", "https://app.example.com"); err != nil {
+			t.Fatalf("unknown address should be ignored without an error, got %s\n", err)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("no email should be sent to an unknown address, got %s\n", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Unknown addresses are limited like registered ones, so the limit doesn't reveal accounts
+	if err := sendLink(ctx, provider, "unknown@example.com", "https://app.example.com"); !errors.Is(err, magiclink.ErrRateLimited) {
+		t.Errorf("third link within an hour should be rate limited, got %v\n", err)
+	}
+}
+
+func TestMagicLinkUnverifiedPasswordUser(t *testing.T) {
+	provider, tokenStore, received := initProvider(t, false)
+	ctx := context.Background()
+
+	// Someone registered the address with a password before its owner
+	user := models.LocalUser{ID: "user_abc", Email: "test-user@example.com", PasswordHash: "attacker's hash", CreatedAt: time.Now()}
+	if err := tokenStore.AddLocalUser(ctx, user); err != nil {
+		t.Fatalf("failed to add user: %s\n", err)
+	}
+	session := models.RefreshToken{TokenID: "token_abc", FamilyID: "token_abc", UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := tokenStore.Add(ctx, session, user.Email); err != nil {
+		t.Fatalf("failed to add session: %s\n", err)
+	}
+
+	if err := sendLink(ctx, provider, user.Email, "https://app.example.com"); err != nil {
+		t.Fatalf("failed to send login link: %s\n", err)
+	}
+	if _, _, err := provider.Login(ctx, readToken(t, received)); err != nil {
+		t.Fatalf("failed to log in: %s\n", err)
+	}
+
+	stored, err := tokenStore.GetLocalUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("failed to get user: %s\n", err)
+	}
+	if !stored.EmailVerified || stored.PasswordHash != "" {
+		t.Errorf("account should be verified without the earlier password, got %+v\n", stored)
+	}
+	if valid, _, _ := tokenStore.Check(ctx, session.TokenID); valid {
+		t.Error("sessions started before the email was verified should be revoked\n")
+	}
+}
+
+func TestMagicLinkExistingUser(t *testing.T) {
+	provider, tokenStore, received := initProvider(t, false)
+	ctx := context.Background()
+
+	// User who has logged in with a provider can use a link even though registration is closed
+	user := models.Account{ID: "user_abc", Email: "test-user@example.com", EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: "123", UserID: user.ID, Email: user.Email, CreatedAt: time.Now()}
+	if err := tokenStore.AddUserWithIdentity(ctx, user, identity); err != nil {
+		t.Fatalf("failed to add user: %s\n", err)
+	}
+
+	if err := sendLink(ctx, provider, user.Email, "https://app.example.com"); err != nil {
+		t.Fatalf("failed to send login link: %s\n", err)
+	}
+	got, _, err := provider.Login(ctx, readToken(t, received))
+	if err != nil {
+		t.Fatalf("failed to log in: %s\n", err)
+	}
+	if got.GetID() != user.ID {
+		t.Errorf("link should log in the existing user %s, got %s\n", user.ID, got.GetID())
+	}
+}
@@ -0,0 +1,47 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/lattots/salpa/internal/config"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails of the password reset and email verification flows.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+func NewMailerFromConf(conf config.MailConfig) (Mailer, error) {
+	switch conf.Driver {
+	case "smtp":
+		if conf.Host == "" || conf.From == "" {
+			return nil, fmt.Errorf("SMTP mailer needs host and from")
+		}
+		port := conf.Port
+		if port == 0 {
+			port = defaultSMTPPort
+		}
+		username := os.Getenv(conf.EnvironmentVariables["username"])
+		password := os.Getenv(conf.EnvironmentVariables["password"])
+		return NewSMTPMailer(conf.Host, port, username, password, conf.From), nil
+	case "file":
+		if conf.Filename == "" {
+			return nil, fmt.Errorf("file mailer needs a filename")
+		}
+		return NewFileMailer(conf.Filename, conf.From), nil
+	case "log", "":
+		// Emails only end up in the server log, which is fine for development but useless in production
+		return NewLogMailer(conf.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver: %s", conf.Driver)
+	}
+}
@@ -0,0 +1,54 @@
+package mail_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lattots/salpa/internal/mail"
+)
+
+func TestSMTPMailer(t *testing.T) {
+	port, received, closeFunc := mail.CreateMockSMTPServer()
+	defer closeFunc()
+
+	// PlainAuth only allows unencrypted connections to localhost
+	mailer := mail.NewSMTPMailer("localhost", port, "user", "password", "salpa@example.com")
+
+	err := mailer.Send(context.Background(), mail.Message{
+		To:      "test-user@example.com",
+		Subject: "Verify your email",
+		Body:    "Open this link:\nhttps://example.com/verify",
+	})
+	if err != nil {
+		t.Fatalf("failed to send email: %s\n", err)
+	}
+
+	msg := <-received
+	for _, want := range []string{"From: salpa@example.com\r\n", "To: test-user@example.com\r\n", "Subject: Verify your email\r\n", "https://example.com/verify"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message should contain %q, got:\n%s\n", want, msg)
+		}
+	}
+}
+
+func TestWriterMailer(t *testing.T) {
+	var buf bytes.Buffer
+	mailer := mail.NewWriterMailer(&buf, "salpa@example.com")
+
+	err := mailer.Send(context.Background(), mail.Message{
+		To:      "test-user@example.com",
+		Subject: "Reset your password\r\nBcc: attacker@example.com",
+		Body:    "Reset link",
+	})
+	if err != nil {
+		t.Fatalf("failed to write email: %s\n", err)
+	}
+	if strings.Contains(buf.String(), "\r\nBcc:") {
+		t.Errorf("line breaks in headers should be removed, got:\n%s\n", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Reset link") {
+		t.Errorf("body missing from email:\n%s\n", buf.String())
+	}
+}
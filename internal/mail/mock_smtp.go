@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CreateMockSMTPServer runs a local SMTP server that accepts every message and sends it to the returned channel.
+// It supports AUTH PLAIN without TLS, which net/smtp only allows for localhost.
+func CreateMockSMTPServer() (int, <-chan string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveMockSMTP(conn, received)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, received, func() { listener.Close() }
+}
+
+func serveMockSMTP(conn net.Conn, received chan<- string) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP")
+
+	var data strings.Builder
+	inData := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if inData {
+			if line == ".\r\n" {
+				inData = false
+				received <- data.String()
+				data.Reset()
+				reply("250 OK")
+				continue
+			}
+			data.WriteString(line)
+			continue
+		}
+
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH PLAIN"):
+			reply("235 Authentication successful")
+		case strings.HasPrefix(cmd, "DATA"):
+			inData = true
+			reply("354 Go ahead")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// writerMailer writes emails to a writer instead of sending them. It's meant for development.
+type writerMailer struct {
+	mu   sync.Mutex
+	open func() (io.WriteCloser, error)
+	from string
+}
+
+// NewLogMailer writes emails to the server log.
+func NewLogMailer(from string) Mailer {
+	return &writerMailer{
+		open: func() (io.WriteCloser, error) { return nopCloser{log.Writer()}, nil },
+		from: from,
+	}
+}
+
+// NewFileMailer appends emails to a file.
+func NewFileMailer(filename, from string) Mailer {
+	return &writerMailer{
+		open: func() (io.WriteCloser, error) {
+			return os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		},
+		from: from,
+	}
+}
+
+// NewWriterMailer writes emails to w.
+func NewWriterMailer(w io.Writer, from string) Mailer {
+	return &writerMailer{
+		open: func() (io.WriteCloser, error) { return nopCloser{w}, nil },
+		from: from,
+	}
+}
+
+func (m *writerMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, err := m.open()
+	if err != nil {
+		return fmt.Errorf("error opening mail output: %w", err)
+	}
+	defer w.Close()
+
+	_, err = fmt.Fprintf(w, "%s\n", formatMessage(m.from, msg))
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
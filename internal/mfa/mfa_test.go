@@ -0,0 +1,280 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238 appendix B, truncated to six digits
+	secret := []byte("12345678901234567890")
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	}
+	for unix, want := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(unix, 0))); got != want {
+			t.Errorf("code at %d: want %s got %s\n", unix, want, got)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("example.com", "alice@example.com", "SECRET"))
+	if err != nil {
+		t.Fatalf("invalid URI: %s\n", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/example.com:alice@example.com" {
+		t.Errorf("unexpected URI: %s\n", uri)
+	}
+	if uri.Query().Get("secret") != "SECRET" || uri.Query().Get("issuer") != "example.com" {
+		t.Errorf("unexpected query: %s\n", uri.RawQuery)
+	}
+}
+
+func initProvider(t *testing.T) *Provider {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+	return NewProvider(tokenStore, "example.com")
+}
+
+func currentCode(t *testing.T, secret string, offset int64) string {
+	key, err := secretEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret: %s\n", err)
+	}
+	return totpCode(key, totpStep(time.Now())+offset)
+}
+
+// enroll adds the user and turns on TOTP for them. It returns the secret, the code used to confirm it and the backup codes.
+func enroll(t *testing.T, p *Provider, user models.User) (string, string, []string) {
+	ctx := context.Background()
+	account := models.Account{ID: user.GetID(), Email: user.GetEmail(), EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: user.GetID(), UserID: user.GetID(), Email: user.GetEmail(), CreatedAt: time.Now()}
+	if err := p.store.AddUserWithIdentity(ctx, account, identity); err != nil {
+		t.Fatalf("error adding user: %s\n", err)
+	}
+
+	enrollment, err := p.Enroll(ctx, user)
+	if err != nil {
+		t.Fatalf("error enrolling: %s\n", err)
+	}
+
+	if enabled, _ := p.Enabled(ctx, user.GetID()); enabled {
+		t.Error("unconfirmed enrollment should not be enabled\n")
+	}
+	confirmCode := currentCode(t, enrollment.Secret, -1)
+	backupCodes, err := p.Confirm(ctx, user.GetID(), confirmCode)
+	if err != nil {
+		t.Fatalf("error confirming enrollment: %s\n", err)
+	}
+	if len(backupCodes) != backupCodeCount {
+		t.Errorf("want %d backup codes, got %d\n", backupCodeCount, len(backupCodes))
+	}
+	if enabled, _ := p.Enabled(ctx, user.GetID()); !enabled {
+		t.Error("confirmed enrollment should be enabled\n")
+	}
+	return enrollment.Secret, confirmCode, backupCodes
+}
+
+func TestChallenge(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	secret, confirmCode, _ := enroll(t, p, user)
+
+	if _, err := p.Enroll(ctx, user); !errors.Is(err, ErrAlreadyEnrolled) {
+		t.Errorf("expected %s, got %v\n", ErrAlreadyEnrolled, err)
+	}
+
+	token, err := p.BeginChallenge(ctx, user, "google", []string{models.AMRFederated}, "https://app.example.com/home")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+
+	// Code of the step used to confirm the enrollment can't be used again
+	_, next, err := p.FinishChallenge(ctx, token, confirmCode)
+	if !errors.Is(err, ErrInvalidCode) || next == "" {
+		t.Fatalf("expected %s with a retry token, got %v\n", ErrInvalidCode, err)
+	}
+	if _, _, err = p.FinishChallenge(ctx, token, currentCode(t, secret, 0)); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("failed attempt should replace the challenge token, got %v\n", err)
+	}
+
+	challenge, _, err := p.FinishChallenge(ctx, next, currentCode(t, secret, 0))
+	if err != nil {
+		t.Fatalf("error finishing challenge: %s\n", err)
+	}
+	if challenge.User.GetID() != user.ID || challenge.Provider != "google" || challenge.ReturnTo != "https://app.example.com/home" {
+		t.Errorf("unexpected challenge: %+v\n", challenge)
+	}
+	// The stored user, not just the ID and email of the pending login
+	if account, ok := challenge.User.(models.Account); !ok || !account.EmailVerified {
+		t.Errorf("challenge should return the stored account, got %+v\n", challenge.User)
+	}
+	if !slices.Equal(challenge.AMR, []string{models.AMRFederated, models.AMROTP, models.AMRMFA}) {
+		t.Errorf("unexpected amr: %v\n", challenge.AMR)
+	}
+}
+
+func TestChallengeAttemptLimit(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	enroll(t, p, user)
+
+	token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+	for i := 1; i <= maxAttempts; i++ {
+		_, token, err = p.FinishChallenge(ctx, token, "000000")
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("expected %s, got %v\n", ErrInvalidCode, err)
+		}
+		if (token == "") != (i == maxAttempts) {
+			t.Fatalf("attempt %d: unexpected retry token %q\n", i, token)
+		}
+	}
+}
+
+func TestChallengeCleanup(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	enroll(t, p, user)
+
+	// Challenge of a login that was abandoned long ago
+	err := p.store.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:      "abandoned",
+		Purpose:   purposeChallenge,
+		UserID:    user.ID,
+		Email:     user.Email,
+		CreatedAt: time.Now().Add(-72 * time.Hour),
+		ExpiresAt: time.Now().Add(-48 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("error adding challenge: %s\n", err)
+	}
+
+	token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+	for range 2 {
+		if _, token, err = p.FinishChallenge(ctx, token, "000000"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("expected %s, got %v\n", ErrInvalidCode, err)
+		}
+	}
+
+	// Wrong codes replace the challenge instead of adding to it, and the abandoned one is gone
+	count, err := p.store.CountOneTimeTokens(ctx, user.Email, purposeChallenge, time.Now().Add(-96*time.Hour))
+	if err != nil {
+		t.Fatalf("error counting challenges: %s\n", err)
+	}
+	if count != 1 {
+		t.Errorf("expected only the pending challenge to be stored, got %d\n", count)
+	}
+}
+
+func TestFailedCodeLockout(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	secret, _, _ := enroll(t, p, user)
+
+	// Every login gets new attempts, but the failures of the user add up
+	failures := 0
+	for failures < maxFailedCodes {
+		token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+		if err != nil {
+			t.Fatalf("error beginning challenge: %s\n", err)
+		}
+		for token != "" && failures < maxFailedCodes {
+			if _, token, err = p.FinishChallenge(ctx, token, "000000"); !errors.Is(err, ErrInvalidCode) {
+				t.Fatalf("expected %s, got %v\n", ErrInvalidCode, err)
+			}
+			failures++
+		}
+	}
+
+	token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+	if _, _, err = p.FinishChallenge(ctx, token, currentCode(t, secret, 0)); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("right code should be rejected during the lockout, got %v\n", err)
+	}
+	if err = p.Disable(ctx, user.ID, currentCode(t, secret, 0)); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("disabling should be locked out as well, got %v\n", err)
+	}
+}
+
+func TestFailedCodesResetOnSuccess(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	secret, _, _ := enroll(t, p, user)
+
+	token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+	if _, token, err = p.FinishChallenge(ctx, token, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("expected %s, got %v\n", ErrInvalidCode, err)
+	}
+	if _, _, err = p.FinishChallenge(ctx, token, currentCode(t, secret, 0)); err != nil {
+		t.Fatalf("error finishing challenge: %s\n", err)
+	}
+
+	enrollment, err := p.store.GetTOTPEnrollment(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting enrollment: %s\n", err)
+	}
+	if enrollment.FailedAttempts != 0 {
+		t.Errorf("accepted code should reset the failures, got %d\n", enrollment.FailedAttempts)
+	}
+}
+
+func TestBackupCodes(t *testing.T) {
+	p := initProvider(t)
+	ctx := context.Background()
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	_, _, backupCodes := enroll(t, p, user)
+
+	token, err := p.BeginChallenge(ctx, user, "password", []string{models.AMRPassword}, "")
+	if err != nil {
+		t.Fatalf("error beginning challenge: %s\n", err)
+	}
+	challenge, _, err := p.FinishChallenge(ctx, token, backupCodes[0])
+	if err != nil {
+		t.Fatalf("error finishing challenge with a backup code: %s\n", err)
+	}
+	if !slices.Contains(challenge.AMR, models.AMRBackupCode) {
+		t.Errorf("unexpected amr: %v\n", challenge.AMR)
+	}
+
+	// Each backup code works once
+	if err = p.Disable(ctx, user.ID, backupCodes[0]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected %s, got %v\n", ErrInvalidCode, err)
+	}
+	if err = p.Disable(ctx, user.ID, backupCodes[1]); err != nil {
+		t.Fatalf("error disabling: %s\n", err)
+	}
+	if enabled, _ := p.Enabled(ctx, user.ID); enabled {
+		t.Error("second factor should be disabled\n")
+	}
+}
@@ -0,0 +1,350 @@
+package mfa
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+)
+
+// Store is the part of the token store the MFA provider uses.
+type Store interface {
+	store.MFAStore
+	store.OneTimeTokenStore
+	store.UserStore
+}
+
+// Provider enrolls TOTP second factors and completes logins that are waiting for one.
+type Provider struct {
+	store Store
+	// Shown next to the account in authenticator apps
+	issuer string
+}
+
+const (
+	// Pending logins are one-time tokens, a wrong code replaces the token with a new one
+	purposeChallenge = "mfa_challenge"
+	challengeTTL     = 5 * time.Minute
+	// Wrong codes allowed per login, after that the user has to log in again
+	maxAttempts = 5
+	// Wrong codes of a user across logins, after that no code is accepted until the lockout ends.
+	// A new login gets new attempts, so without this anyone who knows the password could guess codes forever.
+	maxFailedCodes    = 10
+	failedCodeLockout = 15 * time.Minute
+
+	backupCodeCount = 10
+)
+
+var (
+	ErrInvalidCode      = errors.New("invalid code")
+	ErrAlreadyEnrolled  = errors.New("two-factor authentication is already enabled")
+	ErrNotEnrolled      = errors.New("two-factor authentication is not enabled")
+	ErrInvalidChallenge = errors.New("login is invalid or has expired")
+	ErrTooManyAttempts  = errors.New("too many wrong codes, try again later")
+)
+
+func NewProviderFromConf(conf config.SystemConfiguration, s Store) *Provider {
+	issuer := conf.MFA.Issuer
+	if issuer == "" {
+		if appURL, err := url.Parse(conf.Service.AppDomain); err == nil {
+			issuer = appURL.Hostname()
+		}
+	}
+	return NewProvider(s, issuer)
+}
+
+func NewProvider(s Store, issuer string) *Provider {
+	return &Provider{store: s, issuer: issuer}
+}
+
+// Enabled reports whether the user has a confirmed TOTP enrollment, i.e. whether logins need a second factor.
+func (p *Provider) Enabled(ctx context.Context, userID string) (bool, error) {
+	enrollment, err := p.store.GetTOTPEnrollment(ctx, userID)
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enrollment.Confirmed, nil
+}
+
+// Enrollment is shown to the user once, as a QR code of the URI or as the secret for manual entry.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// Enroll creates a new TOTP secret for the user. It's not used at login until Confirm is called with a code from it,
+// so an enrollment that was never finished doesn't lock the user out.
+func (p *Provider) Enroll(ctx context.Context, user models.User) (Enrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	err = p.store.SetTOTPEnrollment(ctx, models.TOTPEnrollment{
+		UserID:    user.GetID(),
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	})
+	if errors.Is(err, store.ErrCredentialExists) {
+		return Enrollment{}, ErrAlreadyEnrolled
+	}
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{Secret: secret, URI: ProvisioningURI(p.issuer, user.GetEmail(), secret)}, nil
+}
+
+// Confirm turns on the second factor once the user proves their app generates the right codes.
+// It returns the backup codes of the user. Only their hashes are stored, so they can't be shown again.
+func (p *Provider) Confirm(ctx context.Context, userID, code string) ([]string, error) {
+	enrollment, err := p.store.GetTOTPEnrollment(ctx, userID)
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		return nil, ErrNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.Confirmed {
+		return nil, ErrAlreadyEnrolled
+	}
+	if err = p.verifyTOTP(ctx, enrollment, code); err != nil {
+		return nil, err
+	}
+
+	if err = p.store.ConfirmTOTPEnrollment(ctx, userID); err != nil {
+		return nil, err
+	}
+	return p.newBackupCodes(ctx, userID)
+}
+
+// Disable removes the second factor. A confirmed enrollment can only be removed with a valid code.
+func (p *Provider) Disable(ctx context.Context, userID, code string) error {
+	enrollment, err := p.store.GetTOTPEnrollment(ctx, userID)
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		return ErrNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if enrollment.Confirmed {
+		if _, err = p.verify(ctx, enrollment, code); err != nil {
+			return err
+		}
+	}
+	return p.store.RemoveTOTPEnrollment(ctx, userID)
+}
+
+// Challenge is a login that has passed the first factor and waits for the second one.
+type Challenge struct {
+	User models.User
+	// Provider or login method of the first factor
+	Provider string
+	// Methods of the first factor
+	AMR      []string
+	ReturnTo string
+}
+
+type challengeData struct {
+	Provider string   `json:"provider"`
+	AMR      []string `json:"amr"`
+	ReturnTo string   `json:"returnTo"`
+	Attempts int      `json:"attempts"`
+}
+
+// BeginChallenge stores a pending login and returns the token that identifies it.
+func (p *Provider) BeginChallenge(ctx context.Context, user models.User, provider string, amr []string, returnTo string) (string, error) {
+	data := challengeData{Provider: provider, AMR: amr, ReturnTo: returnTo}
+	return p.storeChallenge(ctx, user.GetID(), user.GetEmail(), data, time.Now().Add(challengeTTL))
+}
+
+// FinishChallenge completes a pending login with a TOTP or backup code. The returned AMR includes the second factor.
+// A wrong code returns ErrInvalidCode and the token of the next attempt, which is empty once no attempts are left.
+// While the user is locked out, it returns ErrTooManyAttempts and the login has to be started again.
+func (p *Provider) FinishChallenge(ctx context.Context, token, code string) (Challenge, string, error) {
+	if token == "" {
+		return Challenge{}, "", ErrInvalidChallenge
+	}
+	t, err := p.store.ConsumeOneTimeToken(ctx, util.HashOneTimeToken(token), purposeChallenge)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return Challenge{}, "", ErrInvalidChallenge
+	}
+	if err != nil {
+		return Challenge{}, "", err
+	}
+	var data challengeData
+	if err = json.Unmarshal([]byte(t.Data), &data); err != nil {
+		return Challenge{}, "", err
+	}
+
+	enrollment, err := p.store.GetTOTPEnrollment(ctx, t.UserID)
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		// Second factor was removed while the login was pending
+		return Challenge{}, "", ErrInvalidChallenge
+	}
+	if err != nil {
+		return Challenge{}, "", err
+	}
+
+	method, err := p.verify(ctx, enrollment, code)
+	if errors.Is(err, ErrTooManyAttempts) {
+		return Challenge{}, "", err
+	}
+	if errors.Is(err, ErrInvalidCode) {
+		data.Attempts++
+		if data.Attempts >= maxAttempts {
+			return Challenge{}, "", ErrInvalidCode
+		}
+		next, err := p.storeChallenge(ctx, t.UserID, t.Email, data, t.ExpiresAt)
+		if err != nil {
+			return Challenge{}, "", err
+		}
+		return Challenge{}, next, ErrInvalidCode
+	}
+	if err != nil {
+		return Challenge{}, "", err
+	}
+
+	// The stored user, so the session gets the same user as a login without a second factor
+	user, err := p.store.GetUser(ctx, t.UserID)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return Challenge{}, "", ErrInvalidChallenge
+	}
+	if err != nil {
+		return Challenge{}, "", err
+	}
+
+	return Challenge{
+		User:     user,
+		Provider: data.Provider,
+		AMR:      append(data.AMR, method, models.AMRMFA),
+		ReturnTo: data.ReturnTo,
+	}, "", nil
+}
+
+// storeChallenge adds a challenge row. A retry replaces the consumed row, and the store removes the rows of
+// abandoned logins once they have long expired.
+func (p *Provider) storeChallenge(ctx context.Context, userID, email string, data challengeData, expiresAt time.Time) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	token, hash := util.NewOneTimeToken()
+	err = p.store.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:      hash,
+		Purpose:   purposeChallenge,
+		UserID:    userID,
+		Email:     email,
+		Data:      string(encoded),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	})
+	return token, err
+}
+
+// verify accepts a code from the authenticator app or a backup code and returns the AMR value of the one used.
+// Wrong codes are counted per user, and too many of them lock the user out for a while.
+func (p *Provider) verify(ctx context.Context, enrollment models.TOTPEnrollment, code string) (string, error) {
+	if time.Now().Before(enrollment.LockedUntil) {
+		return "", ErrTooManyAttempts
+	}
+
+	method, err := p.verifyCode(ctx, enrollment, code)
+	if errors.Is(err, ErrInvalidCode) {
+		lockUntil := time.Now().Add(failedCodeLockout)
+		if err := p.store.AddTOTPFailure(ctx, enrollment.UserID, maxFailedCodes, lockUntil); err != nil {
+			return "", err
+		}
+		return "", ErrInvalidCode
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if enrollment.FailedAttempts > 0 {
+		if err = p.store.ResetTOTPFailures(ctx, enrollment.UserID); err != nil {
+			return "", err
+		}
+	}
+	return method, nil
+}
+
+func (p *Provider) verifyCode(ctx context.Context, enrollment models.TOTPEnrollment, code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if isTOTPCode(code) {
+		return models.AMROTP, p.verifyTOTP(ctx, enrollment, code)
+	}
+
+	err := p.store.ConsumeBackupCode(ctx, enrollment.UserID, hashBackupCode(code))
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return "", ErrInvalidCode
+	}
+	if err != nil {
+		return "", err
+	}
+	return models.AMRBackupCode, nil
+}
+
+func (p *Provider) verifyTOTP(ctx context.Context, enrollment models.TOTPEnrollment, code string) error {
+	secret, err := secretEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		return err
+	}
+
+	now := totpStep(time.Now())
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		// A code seen once, e.g. over the user's shoulder, can't be used again
+		err = p.store.UseTOTPStep(ctx, enrollment.UserID, step)
+		if errors.Is(err, store.ErrTokenReused) {
+			return ErrInvalidCode
+		}
+		return err
+	}
+	return ErrInvalidCode
+}
+
+// Backup codes have 80 bits of entropy, so a fast hash is enough to protect them
+var backupCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func (p *Provider) newBackupCodes(ctx context.Context, userID string) ([]string, error) {
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := backupCodeEncoding.EncodeToString(b)
+		// Groups of four are easier to copy by hand, e.g. abcd-efgh-ijkl-mnop
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		hashes[i] = hashBackupCode(code)
+	}
+
+	if err := p.store.ReplaceBackupCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashBackupCode ignores case, dashes and spaces, since users type the codes from paper.
+func hashBackupCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return util.HashOneTimeToken(code)
+}
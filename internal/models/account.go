@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Account is a Salpa user. Its ID is issued by Salpa and stays the same whichever way the user logs in.
+type Account struct {
+	ID    string
+	Email string
+	// Verified by a provider, an email link or a password reset. Only verified emails are used to link identities.
+	EmailVerified bool
+	// Display name from the provider, empty if no provider has told it
+	Name      string
+	CreatedAt time.Time
+}
+
+func (a Account) GetID() string {
+	return a.ID
+}
+
+func (a Account) GetEmail() string {
+	return a.Email
+}
+
+func (a Account) IsEmailVerified() bool {
+	return a.EmailVerified
+}
+
+func (a Account) GetName() string {
+	return a.Name
+}
+
+// Identity links a provider account to a Salpa user.
+type Identity struct {
+	// Name of the provider in the configuration
+	Provider string
+	// User ID the provider returned
+	Subject   string
+	UserID    string
+	Email     string
+	CreatedAt time.Time
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Invitation lets a new user sign up when sign-ups are invite only. It's used up by the first sign-up with the email.
+type Invitation struct {
+	ID        string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// Zero until the invitation is used
+	UsedAt time.Time
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// LocalUser is an account of the built-in password provider.
+type LocalUser struct {
+	ID    string
+	Email string
+	// Argon2id hash in the PHC string format, never the password itself
+	PasswordHash  string
+	EmailVerified bool
+	CreatedAt     time.Time
+}
+
+func (u LocalUser) GetID() string {
+	return u.ID
+}
+
+func (u LocalUser) GetEmail() string {
+	return u.Email
+}
+
+func (u LocalUser) IsEmailVerified() bool {
+	return u.EmailVerified
+}
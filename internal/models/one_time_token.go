@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// OneTimeToken is a single use token sent to a user, e.g. in a password reset link.
+// Only the hash of the token is stored, so a leaked database doesn't leak usable tokens.
+type OneTimeToken struct {
+	Hash    string
+	Purpose string
+	UserID  string
+	Email   string
+	// Purpose specific data, e.g. where to send the user after a magic link login
+	Data string
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
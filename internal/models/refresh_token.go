@@ -6,4 +6,16 @@ type RefreshToken struct {
 	UserID    string
 	TokenID   string
 	ExpiresAt time.Time
+
+	// Every rotation creates a new token in the same family.
+	// FamilyID is the ID of the first token in the family.
+	FamilyID string
+	ParentID string
+	// Public ID of the session, shared by the whole family. Admins see it instead of the token IDs
+	SessionID string
+
+	// Authentication methods of the login that started the session, carried over on rotation
+	AMR []string
+	// Roles, groups and custom claims of the access tokens, decided at login
+	Claims SessionClaims
 }
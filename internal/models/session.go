@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Session is a login as admins see it: the token family of one login, described by its current refresh token.
+type Session struct {
+	// Public ID of the session. Refresh token IDs are secrets, so they are never shown
+	ID     string
+	UserID string
+	Email  string
+
+	AMR    []string
+	Claims SessionClaims
+
+	// Zero for sessions started before the times were recorded
+	CreatedAt   time.Time
+	RefreshedAt time.Time
+	ExpiresAt   time.Time
+}
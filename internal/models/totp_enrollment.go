@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// TOTPEnrollment is the authenticator app second factor of a user.
+type TOTPEnrollment struct {
+	UserID string
+	// Base32 encoded shared secret. It's needed to compute codes, so it can't be hashed.
+	Secret string
+	// Codes are only asked at login once the user has confirmed the enrollment with a code from their app
+	Confirmed bool
+	// Time step of the last accepted code, older and equal steps are rejected so a code works only once
+	LastUsedStep int64
+	// Wrong codes since the last lockout or accepted code, counted across logins
+	FailedAttempts int
+	// No codes are accepted before this time
+	LockedUntil time.Time
+	CreatedAt   time.Time
+}
@@ -4,3 +4,34 @@ type User interface {
 	GetID() string
 	GetEmail() string
 }
+
+// VerifiedEmailUser is implemented by provider users whose provider tells whether it has verified the email.
+// Only verified emails are used to link accounts.
+type VerifiedEmailUser interface {
+	User
+	IsEmailVerified() bool
+}
+
+// NamedUser is implemented by provider users whose provider tells the user's name.
+type NamedUser interface {
+	User
+	GetName() string
+}
+
+// SessionUser is the user of a session. It knows how the user logged in and the extra claims of the session.
+type SessionUser interface {
+	User
+	GetAMR() []string
+	GetClaims() SessionClaims
+}
+
+// Authentication method references of the amr claim. The values follow RFC 8176 where it defines one.
+const (
+	AMRFederated  = "fed"   // OAuth2 or OpenID Connect provider
+	AMRPassword   = "pwd"   // Email and password
+	AMREmail      = "email" // Magic link sent to the user's email
+	AMRPasskey    = "hwk"   // WebAuthn passkey
+	AMROTP        = "otp"   // TOTP code
+	AMRBackupCode = "rec"   // Single use backup code of the second factor
+	AMRMFA        = "mfa"   // Added when a second factor was used
+)
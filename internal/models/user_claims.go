@@ -1,24 +1,131 @@
 package models
 
 import (
+	"encoding/json"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 type UserClaims struct {
 	UserID string `json:"userID"`
 	Email  string `json:"email"`
+	// Authentication methods used to log in, see the AMR constants
+	AMR []string `json:"amr,omitempty"`
+	// Roles and groups given to the user by the claim rules or the pre-issuance hook
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Custom claims of the claim rules and the pre-issuance hook. They are top level claims of the token.
+	Extra map[string]any `json:"-"`
 	jwt.RegisteredClaims
 }
 
+// HasRole tells whether the user has any of the roles.
+func (c UserClaims) HasRole(roles ...string) bool {
+	return slices.ContainsFunc(roles, func(role string) bool { return slices.Contains(c.Roles, role) })
+}
+
+// SessionClaims are the authorization claims of a session. They are decided at login and added to every
+// access token of the session.
+type SessionClaims struct {
+	Roles  []string
+	Groups []string
+	Extra  map[string]any
+}
+
+// Merge adds the roles and groups of other to c. Custom claims of other replace the ones of c with the same name.
+func (c SessionClaims) Merge(other SessionClaims) SessionClaims {
+	merged := SessionClaims{
+		Roles:  appendMissing(slices.Clone(c.Roles), other.Roles...),
+		Groups: appendMissing(slices.Clone(c.Groups), other.Groups...),
+	}
+	if len(c.Extra)+len(other.Extra) > 0 {
+		merged.Extra = make(map[string]any, len(c.Extra)+len(other.Extra))
+		maps.Copy(merged.Extra, c.Extra)
+		maps.Copy(merged.Extra, other.Extra)
+	}
+	return merged
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		if !slices.Contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// Names of the claims Salpa sets itself, extra claims can't replace them
+var reservedClaims = map[string]bool{
+	"userID": true, "email": true, "amr": true, "roles": true, "groups": true,
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+}
+
+// IsReservedClaim tells whether the claim is set by Salpa and therefore can't be used as an extra claim.
+func IsReservedClaim(name string) bool {
+	return reservedClaims[name]
+}
+
+// userClaims has the fields of UserClaims without its JSON methods
+type userClaims UserClaims
+
+func (c UserClaims) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(userClaims(c))
+	if err != nil || len(c.Extra) == 0 {
+		return encoded, err
+	}
+
+	claims := make(map[string]any, len(c.Extra))
+	for name, value := range c.Extra {
+		if !IsReservedClaim(name) {
+			claims[name] = value
+		}
+	}
+	if err = json.Unmarshal(encoded, &claims); err != nil {
+		return nil, err
+	}
+	return json.Marshal(claims)
+}
+
+func (c *UserClaims) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*userClaims)(c)); err != nil {
+		return err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	c.Extra = nil
+	for name, value := range claims {
+		if IsReservedClaim(name) {
+			continue
+		}
+		if c.Extra == nil {
+			c.Extra = make(map[string]any)
+		}
+		c.Extra[name] = value
+	}
+	return nil
+}
+
+// NewUserClaims creates claims valid from now for the given duration.
+// Issuer and audience are left for the caller to set.
 func NewUserClaims(id, email string, duration time.Duration) UserClaims {
+	now := time.Now()
 	return UserClaims{
 		UserID: id,
 		Email:  email,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   id,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ID:        uuid.New().String(),
 		},
 	}
 }
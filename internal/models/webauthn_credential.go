@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// WebAuthnCredential is a passkey registered by a user.
+type WebAuthnCredential struct {
+	// Credential ID chosen by the authenticator, base64url encoded
+	ID     string
+	UserID string
+	Email  string
+
+	// PKIX encoded public key and its COSE algorithm identifier
+	PublicKey []byte
+	Algorithm int64
+	// Signature counter of the authenticator, a counter that doesn't increase reveals a cloned authenticator
+	SignCount uint32
+	// Hints on how the client can reach the authenticator, e.g. usb, nfc or internal
+	Transports []string
+
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
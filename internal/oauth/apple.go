@@ -0,0 +1,281 @@
+package oauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+type appleUser struct {
+	ID            string
+	Email         string
+	EmailVerified bool
+	// Apple sends the name only on the first login, it's empty on later logins
+	Name string
+}
+
+func (u appleUser) GetID() string {
+	return u.ID
+}
+
+func (u appleUser) GetEmail() string {
+	return u.Email
+}
+
+func (u appleUser) IsEmailVerified() bool {
+	return u.EmailVerified
+}
+
+func (u appleUser) GetName() string {
+	return u.Name
+}
+
+type appleIDTokenClaims struct {
+	idTokenClaims
+}
+
+// appleFormUser is the user form value Apple posts to the callback on the first login only.
+type appleFormUser struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+}
+
+type appleProvider struct {
+	conf     *oauth2.Config
+	verifier *idTokenVerifier
+
+	// The client secret is a JWT signed with the private key of the Apple developer account
+	teamID     string
+	keyID      string
+	privateKey *ecdsa.PrivateKey
+}
+
+const (
+	AppleIssuer  = "https://appleid.apple.com"
+	AppleKeysURL = "https://appleid.apple.com/auth/keys"
+
+	// Apple accepts client secrets valid for up to six months, but a fresh one is created for every exchange
+	appleClientSecretTTL = 5 * time.Minute
+)
+
+var AppleEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://appleid.apple.com/auth/authorize",
+	TokenURL: "https://appleid.apple.com/auth/token",
+	// Client secret is generated per request and passed as a parameter
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+func NewAppleProviderFromConf(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
+	clientID := os.Getenv(conf.EnvironmentVariables["clientID"]) // This is the Services ID
+	teamID := os.Getenv(conf.EnvironmentVariables["teamID"])
+	keyID := os.Getenv(conf.EnvironmentVariables["keyID"])
+	if clientID == "" || teamID == "" || keyID == "" {
+		return nil, errors.New("Apple provider needs clientID, teamID and keyID")
+	}
+
+	keyBytes, err := os.ReadFile(conf.PrivateKeyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Apple private key: %w", err)
+	}
+	privateKey, err := ParseApplePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURL := util.BuildURL(serviceDomain, "callback", providerName)
+	oauthConf := &oauth2.Config{
+		ClientID:    clientID,
+		RedirectURL: redirectURL,
+		Scopes:      []string{"name", "email"},
+		Endpoint:    AppleEndpoint,
+	}
+
+	return NewAppleProvider(oauthConf, AppleKeysURL, AppleIssuer, teamID, keyID, privateKey), nil
+}
+
+func NewAppleProvider(conf *oauth2.Config, keysURL, issuer, teamID, keyID string, privateKey *ecdsa.PrivateKey) Provider {
+	return &appleProvider{
+		conf: conf,
+		verifier: &idTokenVerifier{
+			keys:     newRemoteKeySet(keysURL, http.DefaultClient),
+			clientID: conf.ClientID,
+			issuer:   issuer,
+		},
+		teamID:     teamID,
+		keyID:      keyID,
+		privateKey: privateKey,
+	}
+}
+
+// ParseApplePrivateKey parses the PKCS #8 encoded .p8 key downloaded from the Apple developer account.
+func ParseApplePrivateKey(keyBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Apple private key: %w", err)
+	}
+	ecKey, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("Apple private key is not a P-256 key")
+	}
+	return ecKey, nil
+}
+
+func (p *appleProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State,
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+		oauth2.SetAuthURLParam("nonce", login.Nonce),
+		// Apple requires form_post when name or email scopes are requested
+		oauth2.SetAuthURLParam("response_mode", "form_post"),
+	)
+}
+
+func (p *appleProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	return p.ExchangeUserInfoFromForm(code, login, nil)
+}
+
+func (p *appleProvider) ExchangeUserInfoFromForm(code string, login LoginState, form url.Values) (models.User, error) {
+	clientSecret, err := p.clientSecret()
+	if err != nil {
+		return nil, fmt.Errorf("error creating Apple client secret: %w", err)
+	}
+
+	token, err := p.conf.Exchange(context.Background(), code,
+		oauth2.VerifierOption(login.CodeVerifier),
+		oauth2.SetAuthURLParam("client_secret", clientSecret),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, err := idTokenFromOAuth2Token(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims appleIDTokenClaims
+	if err = p.verifier.verify(rawIDToken, login.Nonce, &claims); err != nil {
+		return nil, err
+	}
+
+	user := appleUser{ID: claims.Subject, Email: claims.Email, EmailVerified: bool(claims.EmailVerified)}
+
+	// The user form value is not signed, so it's only used for the name. The email always comes from the ID token
+	if formUser := form.Get("user"); formUser != "" {
+		var u appleFormUser
+		if err = json.Unmarshal([]byte(formUser), &u); err != nil {
+			return nil, fmt.Errorf("error decoding Apple user: %w", err)
+		}
+		user.Name = strings.TrimSpace(u.Name.FirstName + " " + u.Name.LastName)
+	}
+
+	return user, nil
+}
+
+func (p *appleProvider) clientSecret() (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    p.teamID,
+		Subject:   p.conf.ClientID,
+		Audience:  jwt.ClaimStrings{p.verifier.issuer},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(appleClientSecretTTL)),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = p.keyID
+	return token.SignedString(p.privateKey)
+}
+
+// CreateMockAppleProvider runs a mock Apple ID server that only accepts client secrets signed with the provider's key.
+// Its ID tokens have the verified email, or no email claim when email is empty.
+func CreateMockAppleProvider(nonce, email string) (Provider, func()) {
+	signingKey := newMockSigningKey()
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	const (
+		clientID = "com.example.service"
+		teamID   = "TEAM123456"
+		keyID    = "KEY1234567"
+	)
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/auth/keys":
+			signingKey.writeJWKS(w)
+		case "/auth/token":
+			_, err := jwt.Parse(r.FormValue("client_secret"),
+				func(t *jwt.Token) (any, error) {
+					if t.Header["kid"] != keyID {
+						return nil, errors.New("unknown key")
+					}
+					return &clientKey.PublicKey, nil
+				},
+				jwt.WithValidMethods([]string{"ES256"}),
+				jwt.WithIssuer(teamID),
+				jwt.WithSubject(clientID),
+				jwt.WithAudience(ts.URL),
+			)
+			if err != nil || r.FormValue("client_id") != clientID {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_client"}`)
+				return
+			}
+			writeMockTokenResponse(w, r, signingKey.sign(appleIDTokenClaims{
+				idTokenClaims: idTokenClaims{
+					Email:         email,
+					EmailVerified: email != "",
+					Nonce:         nonce,
+					RegisteredClaims: jwt.RegisteredClaims{
+						Issuer:    ts.URL,
+						Subject:   "001234.abcdef0123456789.1234",
+						Audience:  jwt.ClaimStrings{clientID},
+						IssuedAt:  jwt.NewNumericDate(time.Now()),
+						ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+					},
+				},
+			}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	conf := &oauth2.Config{
+		ClientID:    clientID,
+		RedirectURL: "http://localhost:8080/callback",
+		Scopes:      []string{"name", "email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   ts.URL + "/auth/authorize",
+			TokenURL:  ts.URL + "/auth/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+	provider := NewAppleProvider(conf, ts.URL+"/auth/keys", ts.URL, teamID, keyID, clientKey)
+
+	return provider, ts.Close
+}
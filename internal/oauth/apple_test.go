@@ -0,0 +1,87 @@
+package oauth_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+func TestAppleLogin(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockAppleProvider(login.Nonce, "test-user@privaterelay.appleid.com")
+	defer closeFunc()
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", login)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetID() != "001234.abcdef0123456789.1234" {
+		t.Errorf("wrong user ID: %s\n", user.GetID())
+	}
+	if user.GetEmail() != "test-user@privaterelay.appleid.com" {
+		t.Errorf("wrong email, want test-user@privaterelay.appleid.com got %s\n", user.GetEmail())
+	}
+	if verified, ok := user.(models.VerifiedEmailUser); !ok || !verified.IsEmailVerified() {
+		t.Error("email verified by Apple should be reported as verified\n")
+	}
+}
+
+func TestAppleLoginFirstLoginName(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockAppleProvider(login.Nonce, "test-user@privaterelay.appleid.com")
+	defer closeFunc()
+
+	formProvider, ok := provider.(oauth.FormPostProvider)
+	if !ok {
+		t.Fatal("Apple provider should handle form_post callbacks\n")
+	}
+
+	form := url.Values{"user": {`{"name": {"firstName": "Test", "lastName": "User"}, "email": "test-user@privaterelay.appleid.com"}`}}
+	user, err := formProvider.ExchangeUserInfoFromForm("some-fake-code", login, form)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	named, ok := user.(interface{ GetName() string })
+	if !ok || named.GetName() != "Test User" {
+		t.Errorf("name from the first login should be returned, got %v\n", user)
+	}
+}
+
+func TestAppleLoginIgnoresFormEmail(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockAppleProvider(login.Nonce, "")
+	defer closeFunc()
+
+	// Anyone can post the user form value, only the signed ID token is trusted for the email
+	form := url.Values{"user": {`{"name": {"firstName": "Test", "lastName": "User"}, "email": "victim@example.com"}`}}
+	user, err := provider.(oauth.FormPostProvider).ExchangeUserInfoFromForm("some-fake-code", login, form)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetEmail() != "" {
+		t.Errorf("email of the user form value should not be used, got %s\n", user.GetEmail())
+	}
+}
+
+func TestAppleLoginWrongNonce(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockAppleProvider("some-other-nonce", "test-user@privaterelay.appleid.com")
+	defer closeFunc()
+
+	if _, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState()); err == nil {
+		t.Error("ID token with a different nonce should be rejected\n")
+	}
+}
+
+func TestAppleAuthCodeURL(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockAppleProvider(login.Nonce, "test-user@privaterelay.appleid.com")
+	defer closeFunc()
+
+	authURL := provider.GetAuthCodeURL(login)
+	if !strings.Contains(authURL, "response_mode=form_post") {
+		t.Errorf("authorization URL should request form_post: %s\n", authURL)
+	}
+}
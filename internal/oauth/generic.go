@@ -0,0 +1,208 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/util"
+
+	"golang.org/x/oauth2"
+)
+
+type genericUser struct {
+	ID    string
+	Email string
+}
+
+func (u genericUser) GetID() string {
+	return u.ID
+}
+
+func (u genericUser) GetEmail() string {
+	return u.Email
+}
+
+// genericProvider logs in with any OAuth2 provider that has a userinfo endpoint returning JSON.
+type genericProvider struct {
+	conf        *oauth2.Config
+	userInfoURL string
+	// Paths of the user ID and email in the userinfo response, e.g. "id" or "user.emails.0"
+	idField    string
+	emailField string
+}
+
+const (
+	defaultGenericIDField    = "id"
+	defaultGenericEmailField = "email"
+)
+
+func NewGenericProviderFromConf(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
+	if conf.AuthURL == "" || conf.TokenURL == "" || conf.UserInfoURL == "" {
+		return nil, fmt.Errorf("generic provider %s needs authURL, tokenURL and userInfoURL", providerName)
+	}
+	clientID := os.Getenv(conf.EnvironmentVariables["clientID"])
+	clientSecret := os.Getenv(conf.EnvironmentVariables["clientSecret"])
+	redirectURL := util.BuildURL(serviceDomain, "callback", providerName)
+
+	idField := conf.IDField
+	if idField == "" {
+		idField = defaultGenericIDField
+	}
+	emailField := conf.EmailField
+	if emailField == "" {
+		emailField = defaultGenericEmailField
+	}
+
+	oauthConf := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       conf.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  conf.AuthURL,
+			TokenURL: conf.TokenURL,
+		},
+	}
+	return NewGenericProvider(oauthConf, conf.UserInfoURL, idField, emailField), nil
+}
+
+func NewGenericProvider(conf *oauth2.Config, userInfoURL, idField, emailField string) Provider {
+	return &genericProvider{
+		conf:        conf,
+		userInfoURL: userInfoURL,
+		idField:     idField,
+		emailField:  emailField,
+	}
+}
+
+func (p *genericProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.CodeVerifier))
+}
+
+func (p *genericProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	token, err := p.conf.Exchange(context.Background(), code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	client := p.conf.Client(context.Background(), token)
+	req, err := http.NewRequest(http.MethodGet, p.userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected userinfo status code: %d", resp.StatusCode)
+	}
+
+	var userInfo any
+	decoder := json.NewDecoder(resp.Body)
+	// Numeric IDs must not lose precision by being decoded as float64
+	decoder.UseNumber()
+	if err = decoder.Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("error decoding userinfo response: %w", err)
+	}
+
+	id, err := lookupJSONPath(userInfo, p.idField)
+	if err != nil {
+		return nil, fmt.Errorf("error reading user ID: %w", err)
+	}
+	if id == "" {
+		return nil, errors.New("empty user ID in userinfo response")
+	}
+	email, err := lookupJSONPath(userInfo, p.emailField)
+	if err != nil {
+		return nil, fmt.Errorf("error reading email: %w", err)
+	}
+
+	return genericUser{ID: id, Email: email}, nil
+}
+
+// lookupJSONPath returns the string or number at a dot separated path of object keys and array indexes.
+func lookupJSONPath(value any, path string) (string, error) {
+	for _, segment := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[segment]
+			if !ok {
+				return "", fmt.Errorf("no %s in %s", segment, path)
+			}
+			value = next
+		case []any:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("invalid index %s in %s", segment, path)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("can't read %s of a non-container in %s", segment, path)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("%s is not a string or number", path)
+	}
+}
+
+// CreateMockGenericProvider runs a mock provider that returns userinfo in a GitLab-like nested structure.
+func CreateMockGenericProvider(idField, emailField string) (Provider, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/oauth/token":
+			if r.FormValue("code_verifier") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_request", "error_description": "code_verifier missing"}`)
+				return
+			}
+			fmt.Fprintln(w, `{"access_token": "mock-token", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/api/user":
+			if r.Header.Get("Authorization") != "Bearer mock-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintln(w, `{
+				"user": {"id": 80351110224678912, "username": "test-user"},
+				"emails": [{"address": "test-user@example.com", "primary": true}]
+			}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	conf := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/callback",
+		Scopes:       []string{"read_user"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  ts.URL + "/oauth/authorize",
+			TokenURL: ts.URL + "/oauth/token",
+		},
+	}
+	provider := NewGenericProvider(conf, ts.URL+"/api/user", idField, emailField)
+
+	return provider, ts.Close
+}
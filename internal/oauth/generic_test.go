@@ -0,0 +1,33 @@
+package oauth_test
+
+import (
+	"testing"
+
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+func TestGenericLogin(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockGenericProvider("user.id", "emails.0.address")
+	defer closeFunc()
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState())
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetID() != "80351110224678912" {
+		t.Errorf("numeric ID should keep its precision, want 80351110224678912 got %s\n", user.GetID())
+	}
+	if user.GetEmail() != "test-user@example.com" {
+		t.Errorf("wrong email, want test-user@example.com got %s\n", user.GetEmail())
+	}
+}
+
+func TestGenericLoginMissingField(t *testing.T) {
+	for _, idField := range []string{"id", "user.missing", "emails.1.address", "user"} {
+		provider, closeFunc := oauth.CreateMockGenericProvider(idField, "emails.0.address")
+		if _, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState()); err == nil {
+			t.Errorf("ID field %s doesn't point to a string or number and should fail\n", idField)
+		}
+		closeFunc()
+	}
+}
@@ -0,0 +1,170 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/util"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+type githubUser struct {
+	ID    string
+	Email string
+}
+
+func (u githubUser) GetID() string {
+	return u.ID
+}
+
+func (u githubUser) GetEmail() string {
+	return u.Email
+}
+
+// Only the verified primary email is used
+func (u githubUser) IsEmailVerified() bool {
+	return true
+}
+
+type githubProvider struct {
+	// For production, apiURL = "https://api.github.com"
+	conf   *oauth2.Config
+	apiURL string
+}
+
+const GitHubAPIURL = "https://api.github.com"
+
+func NewGitHubProvider(conf *oauth2.Config, apiURL string) Provider {
+	return &githubProvider{conf: conf, apiURL: apiURL}
+}
+
+func NewGitHubProviderFromConf(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
+	clientID := os.Getenv(conf.EnvironmentVariables["clientID"])
+	clientSecret := os.Getenv(conf.EnvironmentVariables["clientSecret"])
+	redirectURL := util.BuildURL(serviceDomain, "callback", providerName)
+	oauthConf := NewGitHubProviderConf(clientID, clientSecret, redirectURL, github.Endpoint)
+
+	return NewGitHubProvider(oauthConf, GitHubAPIURL), nil
+}
+
+func NewGitHubProviderConf(clientID, clientSecret, redirectURL string, endpoint oauth2.Endpoint) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		// user:email is needed to read private email addresses
+		Scopes:   []string{"read:user", "user:email"},
+		Endpoint: endpoint, // In production this will be github.Endpoint
+	}
+}
+
+func (p *githubProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.CodeVerifier))
+}
+
+func (p *githubProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	githubToken, err := p.conf.Exchange(context.Background(), code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+	client := p.conf.Client(context.Background(), githubToken)
+
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err = p.getJSON(client, "/user", &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("no user ID in GitHub user response")
+	}
+
+	// Email in the user response is the public profile email, which may be missing or unverified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err = p.getJSON(client, "/user/emails", &emails); err != nil {
+		return nil, err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return githubUser{ID: strconv.FormatInt(user.ID, 10), Email: e.Email}, nil
+		}
+	}
+	return nil, errors.New("GitHub user has no verified primary email")
+}
+
+func (p *githubProvider) getJSON(client *http.Client, path string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, p.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from GitHub %s: %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func CreateMockGitHubProvider() (Provider, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			if r.FormValue("code_verifier") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_request", "error_description": "code_verifier missing"}`)
+				return
+			}
+			fmt.Fprintln(w, `{"access_token": "mock-token", "token_type": "bearer", "scope": "read:user,user:email"}`)
+		case "/user":
+			if r.Header.Get("Authorization") != "Bearer mock-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintln(w, `{"id": 583231, "login": "octocat", "email": "public@example.com"}`)
+		case "/user/emails":
+			if r.Header.Get("Authorization") != "Bearer mock-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintln(w, `[
+				{"email": "unverified@example.com", "primary": false, "verified": false},
+				{"email": "octocat@example.com", "primary": true, "verified": true},
+				{"email": "secondary@example.com", "primary": false, "verified": true}
+			]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	endpoint := oauth2.Endpoint{
+		AuthURL:  ts.URL + "/login/oauth/authorize",
+		TokenURL: ts.URL + "/login/oauth/access_token",
+	}
+	conf := NewGitHubProviderConf("id", "secret", "http://localhost:8080/callback", endpoint)
+
+	provider := NewGitHubProvider(conf, ts.URL)
+
+	return provider, ts.Close
+}
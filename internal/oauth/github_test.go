@@ -0,0 +1,23 @@
+package oauth_test
+
+import (
+	"testing"
+
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+func TestGitHubLogin(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockGitHubProvider()
+	defer closeFunc()
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState())
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetID() != "583231" {
+		t.Errorf("user ID should be the numeric GitHub ID, want 583231 got %s\n", user.GetID())
+	}
+	if user.GetEmail() != "octocat@example.com" {
+		t.Errorf("email should be the primary verified email, want octocat@example.com got %s\n", user.GetEmail())
+	}
+}
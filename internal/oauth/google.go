@@ -17,8 +17,9 @@ import (
 )
 
 type googleUser struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	VerifiedEmail bool   `json:"verified_email"`
 }
 
 func (u googleUser) GetID() string {
@@ -29,6 +30,10 @@ func (u googleUser) GetEmail() string {
 	return u.Email
 }
 
+func (u googleUser) IsEmailVerified() bool {
+	return u.VerifiedEmail
+}
+
 type googleProvider struct {
 	// For production, userInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
 	conf        *oauth2.Config
@@ -61,12 +66,12 @@ func NewGoogleProviderConf(clientID, clientSecret, redirectURL string, endpoint
 	}
 }
 
-func (p *googleProvider) GetAuthCodeURL(state string) string {
-	return p.conf.AuthCodeURL(state)
+func (p *googleProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.CodeVerifier))
 }
 
-func (p *googleProvider) ExchangeUserInfo(code string) (models.User, error) {
-	googleToken, err := p.conf.Exchange(context.Background(), code)
+func (p *googleProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	googleToken, err := p.conf.Exchange(context.Background(), code, oauth2.VerifierOption(login.CodeVerifier))
 	if err != nil {
 		return nil, err
 	}
@@ -92,9 +97,15 @@ func CreateMockGoogleProvider() (Provider, func()) {
 
 		switch r.URL.Path {
 		case "/token":
+			// Provider flows must always use PKCE
+			if r.FormValue("code_verifier") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"error": "invalid_request", "error_description": "code_verifier missing"}`)
+				return
+			}
 			fmt.Fprintln(w, `{"access_token": "mock-token", "token_type": "Bearer", "expires_in": 3600}`)
 		case "/userinfo":
-			fmt.Fprintln(w, `{"id": "12345", "email": "test-user@example.com"}`)
+			fmt.Fprintln(w, `{"id": "12345", "email": "test-user@example.com", "verified_email": true}`)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
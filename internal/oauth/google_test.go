@@ -2,6 +2,7 @@ package oauth_test
 
 import (
 	"fmt"
+	"net/url"
 	"testing"
 
 	"github.com/lattots/salpa/internal/oauth"
@@ -11,10 +12,42 @@ func TestGoogleLogin(t *testing.T) {
 	provider, closeFunc := oauth.CreateMockGoogleProvider()
 	defer closeFunc()
 
-	user, err := provider.ExchangeUserInfo("some-fake-code")
+	user, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState())
 	if err != nil {
 		t.Fatalf("failed to exhange user info with auth provider: %s\n", err)
 	}
 
 	fmt.Printf("Got user: %s - %s\n", user.GetID(), user.GetEmail())
 }
+
+func TestGoogleLoginWithoutVerifier(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockGoogleProvider()
+	defer closeFunc()
+
+	_, err := provider.ExchangeUserInfo("some-fake-code", oauth.LoginState{State: "state"})
+	if err == nil {
+		t.Error("exchange without a code verifier should fail\n")
+	}
+}
+
+func TestAuthCodeURLHasPKCEChallenge(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockGoogleProvider()
+	defer closeFunc()
+
+	login := oauth.NewLoginState()
+	authURL, err := url.Parse(provider.GetAuthCodeURL(login))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := authURL.Query()
+	if query.Get("state") != login.State {
+		t.Errorf("wrong state in auth code URL, want %s got %s\n", login.State, query.Get("state"))
+	}
+	if query.Get("code_challenge_method") != "S256" {
+		t.Errorf("expected S256 code challenge method, got %s\n", query.Get("code_challenge_method"))
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge") == login.CodeVerifier {
+		t.Error("auth code URL should carry the S256 challenge of the verifier\n")
+	}
+}
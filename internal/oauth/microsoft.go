@@ -0,0 +1,206 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+type microsoftUser struct {
+	ID       string
+	Email    string
+	TenantID string
+}
+
+func (u microsoftUser) GetID() string {
+	return u.ID
+}
+
+func (u microsoftUser) GetEmail() string {
+	return u.Email
+}
+
+type microsoftIDTokenClaims struct {
+	TenantID string `json:"tid"`
+	ObjectID string `json:"oid"`
+	idTokenClaims
+}
+
+type microsoftProvider struct {
+	conf     *oauth2.Config
+	verifier *idTokenVerifier
+	// Issuer from the discovery document. Multi-tenant authorities use a {tenantid} placeholder.
+	issuerTemplate string
+	allowedTenants []string
+}
+
+const (
+	MicrosoftAuthorityURL = "https://login.microsoftonline.com"
+
+	// Tenant "common" accepts work, school and personal accounts, "organizations" only work and school accounts.
+	// Any other tenant is a tenant ID or domain of a single tenant.
+	defaultMicrosoftTenant = "common"
+)
+
+var defaultMicrosoftScopes = []string{"openid", "email", "profile"}
+
+func NewMicrosoftProviderFromConf(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
+	clientID := os.Getenv(conf.EnvironmentVariables["clientID"])
+	clientSecret := os.Getenv(conf.EnvironmentVariables["clientSecret"])
+	redirectURL := util.BuildURL(serviceDomain, "callback", providerName)
+
+	tenant := conf.Tenant
+	if tenant == "" {
+		tenant = defaultMicrosoftTenant
+	}
+	scopes := conf.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultMicrosoftScopes
+	}
+
+	oauthConf := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+	return NewMicrosoftProvider(oauthConf, MicrosoftAuthorityURL, tenant, conf.AllowedTenants)
+}
+
+// NewMicrosoftProvider discovers the endpoints of the tenant's authority and fills them in conf.
+// If allowedTenants is empty, users of any tenant the authority accepts can log in.
+func NewMicrosoftProvider(conf *oauth2.Config, authorityURL, tenant string, allowedTenants []string) (Provider, error) {
+	discovery, err := discoverOIDC(fmt.Sprintf("%s/%s/v2.0", authorityURL, tenant))
+	if err != nil {
+		return nil, fmt.Errorf("error discovering Microsoft tenant %s: %w", tenant, err)
+	}
+
+	conf.Endpoint = oauth2.Endpoint{
+		AuthURL:  discovery.AuthorizationEndpoint,
+		TokenURL: discovery.TokenEndpoint,
+	}
+	verifier := &idTokenVerifier{
+		keys:     newRemoteKeySet(discovery.JWKSURI, http.DefaultClient),
+		clientID: conf.ClientID,
+		// Issuer depends on the tenant of the user and is checked after verification
+	}
+
+	return &microsoftProvider{
+		conf:           conf,
+		verifier:       verifier,
+		issuerTemplate: discovery.Issuer,
+		allowedTenants: allowedTenants,
+	}, nil
+}
+
+func (p *microsoftProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State,
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+		oauth2.SetAuthURLParam("nonce", login.Nonce),
+	)
+}
+
+func (p *microsoftProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	token, err := p.conf.Exchange(context.Background(), code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, err := idTokenFromOAuth2Token(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims microsoftIDTokenClaims
+	if err = p.verifier.verify(rawIDToken, login.Nonce, &claims); err != nil {
+		return nil, err
+	}
+
+	if claims.TenantID == "" || claims.ObjectID == "" {
+		return nil, errors.New("ID token is missing tid or oid claim")
+	}
+	// Multi-tenant authorities sign tokens of every tenant with the same keys, so the issuer must match the tenant
+	expectedIssuer := strings.ReplaceAll(p.issuerTemplate, "{tenantid}", claims.TenantID)
+	if claims.Issuer != expectedIssuer {
+		return nil, fmt.Errorf("ID token issuer %s doesn't match tenant %s", claims.Issuer, claims.TenantID)
+	}
+	if len(p.allowedTenants) != 0 && !slices.Contains(p.allowedTenants, claims.TenantID) {
+		return nil, fmt.Errorf("tenant %s is not allowed to log in", claims.TenantID)
+	}
+
+	// preferred_username is not verified and the tenant can change it, so it's never used as the email
+	return microsoftUser{ID: claims.ObjectID, Email: claims.Email, TenantID: claims.TenantID}, nil
+}
+
+// CreateMockMicrosoftProvider runs a mock multi-tenant authority that issues ID tokens for a user in tenantID.
+// The ID token has the email claim only when email is set, but it always has a preferred_username.
+func CreateMockMicrosoftProvider(nonce, tenantID, email string, allowedTenants []string) (Provider, func()) {
+	signingKey := newMockSigningKey()
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/common/v2.0/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcDiscovery{
+				Issuer:                ts.URL + "/{tenantid}/v2.0",
+				AuthorizationEndpoint: ts.URL + "/common/oauth2/v2.0/authorize",
+				TokenEndpoint:         ts.URL + "/common/oauth2/v2.0/token",
+				JWKSURI:               ts.URL + "/common/discovery/v2.0/keys",
+			})
+		case "/common/discovery/v2.0/keys":
+			signingKey.writeJWKS(w)
+		case "/common/oauth2/v2.0/token":
+			type claimsWithUsername struct {
+				microsoftIDTokenClaims
+				PreferredUsername string `json:"preferred_username"`
+			}
+			writeMockTokenResponse(w, r, signingKey.sign(claimsWithUsername{microsoftIDTokenClaims{
+				TenantID: tenantID,
+				ObjectID: "00000000-0000-0000-66f3-3332eca7ea81",
+				idTokenClaims: idTokenClaims{
+					Nonce: nonce,
+					Email: email,
+					RegisteredClaims: jwt.RegisteredClaims{
+						Issuer:    ts.URL + "/" + tenantID + "/v2.0",
+						Subject:   "AAAAAAAAAAAAAAAAAAAAAIkzqFVrSaSaFHy782bbtaQ",
+						Audience:  jwt.ClaimStrings{"id"},
+						IssuedAt:  jwt.NewNumericDate(time.Now()),
+						ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+					},
+				},
+			}, "alias@contoso.com"}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	conf := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/callback",
+		Scopes:       defaultMicrosoftScopes,
+	}
+	provider, err := NewMicrosoftProvider(conf, ts.URL, "common", allowedTenants)
+	if err != nil {
+		ts.Close()
+		panic(err)
+	}
+
+	return provider, ts.Close
+}
@@ -0,0 +1,64 @@
+package oauth_test
+
+import (
+	"testing"
+
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+const (
+	testTenantID  = "72f988bf-86f1-41af-91ab-2d7cd011db47"
+	otherTenantID = "9188040d-6c67-4c5b-b112-36a304b66dad"
+)
+
+func TestMicrosoftLogin(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockMicrosoftProvider(login.Nonce, testTenantID, "test-user@contoso.com", []string{testTenantID})
+	defer closeFunc()
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", login)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetID() != "00000000-0000-0000-66f3-3332eca7ea81" {
+		t.Errorf("user ID should be the oid claim, got %s\n", user.GetID())
+	}
+	if user.GetEmail() != "test-user@contoso.com" {
+		t.Errorf("wrong email, want test-user@contoso.com got %s\n", user.GetEmail())
+	}
+}
+
+func TestMicrosoftLoginWithoutEmail(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockMicrosoftProvider(login.Nonce, testTenantID, "", nil)
+	defer closeFunc()
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", login)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	// preferred_username can be changed by the tenant, so it must not become the email
+	if user.GetEmail() != "" {
+		t.Errorf("email should be empty without the email claim, got %s\n", user.GetEmail())
+	}
+}
+
+func TestMicrosoftLoginTenantNotAllowed(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockMicrosoftProvider(login.Nonce, otherTenantID, "test-user@contoso.com", []string{testTenantID})
+	defer closeFunc()
+
+	if _, err := provider.ExchangeUserInfo("some-fake-code", login); err == nil {
+		t.Error("user of a tenant outside the allowlist should be rejected\n")
+	}
+}
+
+func TestMicrosoftLoginAnyTenant(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockMicrosoftProvider(login.Nonce, otherTenantID, "test-user@contoso.com", nil)
+	defer closeFunc()
+
+	if _, err := provider.ExchangeUserInfo("some-fake-code", login); err != nil {
+		t.Errorf("any tenant should be allowed without an allowlist, got %s\n", err)
+	}
+}
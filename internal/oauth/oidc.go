@@ -0,0 +1,361 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+type oidcUser struct {
+	id            string
+	email         string
+	emailVerified bool
+}
+
+func (u oidcUser) GetID() string {
+	return u.id
+}
+
+func (u oidcUser) GetEmail() string {
+	return u.email
+}
+
+func (u oidcUser) IsEmailVerified() bool {
+	return u.emailVerified
+}
+
+// oidcDiscovery holds the members of the provider's discovery document Salpa needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// discoverOIDC fetches the discovery document of the issuer.
+func discoverOIDC(issuer string) (oidcDiscovery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return oidcDiscovery{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return oidcDiscovery{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return oidcDiscovery{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var discovery oidcDiscovery
+	if err = json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return oidcDiscovery{}, fmt.Errorf("error decoding discovery document: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("discovery document is missing required endpoints")
+	}
+	return discovery, nil
+}
+
+type idTokenClaims struct {
+	Email         string    `json:"email"`
+	EmailVerified claimBool `json:"email_verified"`
+	Nonce         string    `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// claimBool accepts booleans encoded as JSON strings, which some providers (e.g. Apple) send.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean claim: %s", data)
+	}
+	return nil
+}
+
+func (c *idTokenClaims) getNonce() string {
+	return c.Nonce
+}
+
+// verifiableClaims is implemented by the ID token claims of every provider.
+// Provider specific claims embed idTokenClaims.
+type verifiableClaims interface {
+	jwt.Claims
+	getNonce() string
+}
+
+// idTokenVerifier checks the signature, issuer, audience, expiration and nonce of ID tokens.
+type idTokenVerifier struct {
+	keys     *remoteKeySet
+	clientID string
+	// Expected iss claim. Providers with per-tenant issuers leave this empty and check the issuer themselves.
+	issuer string
+}
+
+// Allowed clock difference between Salpa and the provider
+const idTokenLeeway = time.Minute
+
+func (v *idTokenVerifier) verify(rawIDToken, nonce string, claims verifiableClaims) error {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithAudience(v.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(idTokenLeeway),
+	}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+
+	token, err := jwt.ParseWithClaims(rawIDToken, claims, v.keys.keyFunc, opts...)
+	if err != nil {
+		return fmt.Errorf("invalid ID token: %w", err)
+	}
+	if !token.Valid {
+		return errors.New("invalid ID token")
+	}
+
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.getNonce()), []byte(nonce)) != 1 {
+		return errors.New("ID token nonce doesn't match the login")
+	}
+
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return errors.New("ID token has no subject")
+	}
+	return nil
+}
+
+// idTokenFromOAuth2Token returns the raw ID token the token endpoint returned alongside the access token.
+func idTokenFromOAuth2Token(token *oauth2.Token) (string, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return "", errors.New("no ID token in token response")
+	}
+	return rawIDToken, nil
+}
+
+type oidcProvider struct {
+	conf        *oauth2.Config
+	verifier    *idTokenVerifier
+	userInfoURL string
+}
+
+var defaultOIDCScopes = []string{"openid", "email"}
+
+func NewOIDCProviderFromConf(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
+	if conf.Issuer == "" {
+		return nil, fmt.Errorf("no issuer set for OpenID Connect provider %s", providerName)
+	}
+	clientID := os.Getenv(conf.EnvironmentVariables["clientID"])
+	clientSecret := os.Getenv(conf.EnvironmentVariables["clientSecret"])
+	redirectURL := util.BuildURL(serviceDomain, "callback", providerName)
+
+	scopes := conf.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOIDCScopes
+	}
+
+	return DiscoverOIDCProvider(conf.Issuer, clientID, clientSecret, redirectURL, scopes)
+}
+
+// DiscoverOIDCProvider creates a provider from the discovery document of the issuer.
+func DiscoverOIDCProvider(issuer, clientID, clientSecret, redirectURL string, scopes []string) (Provider, error) {
+	discovery, err := discoverOIDC(issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering OpenID Connect provider %s: %w", issuer, err)
+	}
+	// Issuer in the document must match the configured one exactly (OpenID Connect Discovery 4.3)
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %s, provider reports %s", issuer, discovery.Issuer)
+	}
+
+	conf := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}
+	verifier := &idTokenVerifier{
+		keys:     newRemoteKeySet(discovery.JWKSURI, http.DefaultClient),
+		clientID: clientID,
+		issuer:   discovery.Issuer,
+	}
+	return &oidcProvider{conf: conf, verifier: verifier, userInfoURL: discovery.UserInfoEndpoint}, nil
+}
+
+func (p *oidcProvider) GetAuthCodeURL(login LoginState) string {
+	return p.conf.AuthCodeURL(login.State,
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+		oauth2.SetAuthURLParam("nonce", login.Nonce),
+	)
+}
+
+func (p *oidcProvider) ExchangeUserInfo(code string, login LoginState) (models.User, error) {
+	token, err := p.conf.Exchange(context.Background(), code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, err := idTokenFromOAuth2Token(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	if err = p.verifier.verify(rawIDToken, login.Nonce, &claims); err != nil {
+		return nil, err
+	}
+
+	user := oidcUser{id: claims.Subject, email: claims.Email, emailVerified: bool(claims.EmailVerified)}
+	if user.email == "" && p.userInfoURL != "" {
+		// Some providers only return the email from the userinfo endpoint
+		user.email, user.emailVerified, err = p.fetchUserInfoEmail(token, claims.Subject)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (p *oidcProvider) fetchUserInfoEmail(token *oauth2.Token, subject string) (string, bool, error) {
+	client := p.conf.Client(context.Background(), token)
+	resp, err := client.Get(p.userInfoURL)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected userinfo status code: %d", resp.StatusCode)
+	}
+
+	var userInfo struct {
+		Subject       string    `json:"sub"`
+		Email         string    `json:"email"`
+		EmailVerified claimBool `json:"email_verified"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return "", false, err
+	}
+	// Userinfo response must be about the user of the ID token (OpenID Connect Core 5.3.2)
+	if userInfo.Subject != subject {
+		return "", false, errors.New("userinfo subject doesn't match the ID token")
+	}
+	return userInfo.Email, bool(userInfo.EmailVerified), nil
+}
+
+// mockSigningKey signs ID tokens of mock providers and publishes its public key as a JWKS.
+type mockSigningKey struct {
+	key *rsa.PrivateKey
+	id  string
+}
+
+func newMockSigningKey() mockSigningKey {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	return mockSigningKey{key: key, id: "mock-key"}
+}
+
+func (k mockSigningKey) writeJWKS(w http.ResponseWriter) {
+	fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": "%s", "use": "sig", "alg": "RS256", "n": "%s", "e": "%s"}]}`,
+		k.id,
+		base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+	)
+}
+
+func (k mockSigningKey) sign(claims jwt.Claims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.id
+	signed, _ := token.SignedString(k.key)
+	return signed
+}
+
+// writeMockTokenResponse answers a token request of a mock provider. Requests without a PKCE verifier are rejected.
+func writeMockTokenResponse(w http.ResponseWriter, r *http.Request, idToken string) {
+	if r.FormValue("code_verifier") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `{"error": "invalid_request", "error_description": "code_verifier missing"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token": "mock-token", "token_type": "Bearer", "expires_in": 3600, "id_token": "%s"}`, idToken)
+}
+
+// CreateMockOIDCProvider runs a mock OpenID Connect issuer that signs ID tokens with the given nonce.
+func CreateMockOIDCProvider(nonce string) (Provider, func()) {
+	signingKey := newMockSigningKey()
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcDiscovery{
+				Issuer:                ts.URL,
+				AuthorizationEndpoint: ts.URL + "/auth",
+				TokenEndpoint:         ts.URL + "/token",
+				UserInfoEndpoint:      ts.URL + "/userinfo",
+				JWKSURI:               ts.URL + "/jwks",
+			})
+		case "/jwks":
+			signingKey.writeJWKS(w)
+		case "/token":
+			writeMockTokenResponse(w, r, signingKey.sign(idTokenClaims{
+				Email:         "test-user@example.com",
+				EmailVerified: true,
+				Nonce:         nonce,
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    ts.URL,
+					Subject:   "12345",
+					Audience:  jwt.ClaimStrings{"id"},
+					IssuedAt:  jwt.NewNumericDate(time.Now()),
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				},
+			}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	provider, err := DiscoverOIDCProvider(ts.URL, "id", "secret", "http://localhost:8080/callback", defaultOIDCScopes)
+	if err != nil {
+		ts.Close()
+		panic(err)
+	}
+
+	return provider, ts.Close
+}
@@ -0,0 +1,50 @@
+package oauth_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/lattots/salpa/internal/oauth"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	login := oauth.NewLoginState()
+	provider, closeFunc := oauth.CreateMockOIDCProvider(login.Nonce)
+	defer closeFunc()
+
+	authURL, err := url.Parse(provider.GetAuthCodeURL(login))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authURL.Query().Get("nonce") != login.Nonce {
+		t.Errorf("auth code URL should carry the nonce, got %s\n", authURL.Query().Get("nonce"))
+	}
+
+	user, err := provider.ExchangeUserInfo("some-fake-code", login)
+	if err != nil {
+		t.Fatalf("failed to exchange user info with auth provider: %s\n", err)
+	}
+	if user.GetID() != "12345" {
+		t.Errorf("user ID should be the sub claim, want 12345 got %s\n", user.GetID())
+	}
+	if user.GetEmail() != "test-user@example.com" {
+		t.Errorf("wrong email, want test-user@example.com got %s\n", user.GetEmail())
+	}
+}
+
+func TestOIDCLoginWrongNonce(t *testing.T) {
+	provider, closeFunc := oauth.CreateMockOIDCProvider("nonce-of-another-login")
+	defer closeFunc()
+
+	_, err := provider.ExchangeUserInfo("some-fake-code", oauth.NewLoginState())
+	if err == nil {
+		t.Error("ID token with a different nonce should be rejected\n")
+	}
+}
+
+func TestOIDCDiscoveryUnreachable(t *testing.T) {
+	_, err := oauth.DiscoverOIDCProvider("http://127.0.0.1:1", "id", "secret", "http://localhost/callback", nil)
+	if err == nil {
+		t.Error("discovering an unreachable issuer should fail\n")
+	}
+}
@@ -1,16 +1,42 @@
 package oauth
 
 import (
+	"crypto/rand"
 	"fmt"
 	"log"
+	"net/url"
 
 	"github.com/lattots/salpa/internal/config"
 	"github.com/lattots/salpa/internal/models"
+
+	"golang.org/x/oauth2"
 )
 
 type Provider interface {
-	GetAuthCodeURL(state string) string
-	ExchangeUserInfo(code string) (models.User, error)
+	GetAuthCodeURL(login LoginState) string
+	ExchangeUserInfo(code string, login LoginState) (models.User, error)
+}
+
+// FormPostProvider is implemented by providers that post user details to the callback alongside the code.
+type FormPostProvider interface {
+	ExchangeUserInfoFromForm(code string, login LoginState, form url.Values) (models.User, error)
+}
+
+// LoginState holds the values of a single login that must survive the round trip to the provider.
+type LoginState struct {
+	State string
+	// PKCE (RFC 7636) code verifier, its S256 challenge is sent in the authorization request
+	CodeVerifier string
+	// OpenID Connect providers echo the nonce in the ID token, which binds the token to this login
+	Nonce string
+}
+
+func NewLoginState() LoginState {
+	return LoginState{
+		State:        rand.Text(),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        rand.Text(),
+	}
 }
 
 func CreateProviders(serviceDomain string, confs map[string]config.ProviderConfig) map[string]Provider {
@@ -27,9 +53,19 @@ func CreateProviders(serviceDomain string, confs map[string]config.ProviderConfi
 }
 
 func createProvider(serviceDomain, providerName string, conf config.ProviderConfig) (Provider, error) {
-	switch providerName {
+	switch conf.ProviderType(providerName) {
 	case "google":
 		return NewGoogleProviderFromConf(serviceDomain, conf)
+	case "oidc":
+		return NewOIDCProviderFromConf(serviceDomain, providerName, conf)
+	case "github":
+		return NewGitHubProviderFromConf(serviceDomain, providerName, conf)
+	case "microsoft":
+		return NewMicrosoftProviderFromConf(serviceDomain, providerName, conf)
+	case "apple":
+		return NewAppleProviderFromConf(serviceDomain, providerName, conf)
+	case "generic":
+		return NewGenericProviderFromConf(serviceDomain, providerName, conf)
 	default:
 		return nil, fmt.Errorf("unknown provider: %s\n", providerName)
 	}
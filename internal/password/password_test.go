@@ -0,0 +1,385 @@
+package password_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/password"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+// Cheap parameters keep the tests fast
+var testParams = password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := password.Hash("correct horse battery staple", testParams)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s\n", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("hash should be in the PHC string format, got %s\n", hash)
+	}
+
+	ok, err := password.Verify("correct horse battery staple", hash)
+	if err != nil || !ok {
+		t.Errorf("correct password should verify, got %t %v\n", ok, err)
+	}
+	ok, err = password.Verify("wrong password", hash)
+	if err != nil || ok {
+		t.Errorf("wrong password shouldn't verify, got %t %v\n", ok, err)
+	}
+
+	other, _ := password.Hash("correct horse battery staple", testParams)
+	if other == hash {
+		t.Error("hashes of the same password should have different salts\n")
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	for _, hash := range []string{"", "plaintext", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5"} {
+		if _, err := password.Verify("password", hash); !errors.Is(err, password.ErrInvalidHash) {
+			t.Errorf("hash %q should be rejected, got %v\n", hash, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, _ := password.Hash("password", testParams)
+	if password.NeedsRehash(hash, testParams) {
+		t.Error("hash with current parameters shouldn't need rehashing\n")
+	}
+	stronger := testParams
+	stronger.Iterations = 2
+	if !password.NeedsRehash(hash, stronger) {
+		t.Error("hash with old parameters should need rehashing\n")
+	}
+}
+
+// testMailer keeps the sent emails, so tests can read the links in them
+type testMailer struct {
+	sent []mail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// lastToken returns the token query parameter of the link in the last email.
+func (m *testMailer) lastToken(t *testing.T) string {
+	if len(m.sent) == 0 {
+		t.Fatal("no email sent\n")
+	}
+	body := m.sent[len(m.sent)-1].Body
+	start := strings.Index(body, "https://")
+	if start == -1 {
+		t.Fatalf("no link in email: %s\n", body)
+	}
+	link, err := url.Parse(strings.Fields(body[start:])[0])
+	if err != nil {
+		t.Fatalf("invalid link in email: %s\n", err)
+	}
+	return link.Query().Get("token")
+}
+
+func initProvider(t *testing.T, settings password.Settings) (*password.Provider, *testMailer) {
+	provider, mailer, _ := initProviderWithStore(t, settings)
+	return provider, mailer
+}
+
+func initProviderWithStore(t *testing.T, settings password.Settings) (*password.Provider, *testMailer, store.Store) {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	settings.Params = testParams
+	settings.MinLength = 10
+	settings.VerifyURL = "https://auth.example.com/auth/password/verify"
+	settings.ResetURL = "https://app.example.com/reset-password"
+
+	mailer := &testMailer{}
+	provider, err := password.NewProvider(tokenStore, mailer, settings)
+	if err != nil {
+		t.Fatalf("error creating password provider: %s\n", err)
+	}
+	return provider, mailer, tokenStore
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	provider, _ := initProvider(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	registered, err := provider.Register(ctx, " Test-User@Example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+	if registered.GetEmail() != "test-user@example.com" {
+		t.Errorf("email should be normalized, got %s\n", registered.GetEmail())
+	}
+
+	user, err := provider.Login(ctx, "TEST-USER@example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to log in: %s\n", err)
+	}
+	if user.GetID() != registered.GetID() {
+		t.Errorf("logged in user should be the registered one, want %s got %s\n", registered.GetID(), user.GetID())
+	}
+
+	if _, err = provider.Login(ctx, "test-user@example.com", "wrong password"); !errors.Is(err, password.ErrInvalidCredentials) {
+		t.Errorf("wrong password should be rejected, got %v\n", err)
+	}
+	if _, err = provider.Login(ctx, "unknown@example.com", "long enough password"); !errors.Is(err, password.ErrInvalidCredentials) {
+		t.Errorf("unknown email should be rejected like a wrong password, got %v\n", err)
+	}
+
+	if _, err = provider.Register(ctx, "test-user@example.com", "another password"); !errors.Is(err, password.ErrEmailAlreadyInUse) {
+		t.Errorf("email should only be registered once, got %v\n", err)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	provider, _ := initProvider(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	if _, err := provider.Register(ctx, "test-user@example.com", "short"); !errors.Is(err, password.ErrPasswordTooShort) {
+		t.Errorf("short password should be rejected, got %v\n", err)
+	}
+	if _, err := provider.Register(ctx, "Test User <test-user@example.com>", "long enough password"); !errors.Is(err, password.ErrInvalidEmail) {
+		t.Errorf("email with a display name should be rejected, got %v\n", err)
+	}
+
+	closed, _ := initProvider(t, password.Settings{})
+	if _, err := closed.Register(ctx, "test-user@example.com", "long enough password"); !errors.Is(err, password.ErrRegistrationClosed) {
+		t.Errorf("registration should be closed, got %v\n", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	provider, mailer := initProvider(t, password.Settings{AllowRegistration: true, RequireVerifiedEmail: true})
+	ctx := context.Background()
+
+	user, err := provider.Register(ctx, "test-user@example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+	if _, err = provider.Login(ctx, "test-user@example.com", "long enough password"); !errors.Is(err, password.ErrEmailNotVerified) {
+		t.Errorf("unverified user shouldn't be able to log in, got %v\n", err)
+	}
+
+	if err = provider.SendVerificationEmail(ctx, user, "https://app.example.com/welcome"); err != nil {
+		t.Fatalf("failed to send verification email: %s\n", err)
+	}
+	if !strings.Contains(mailer.sent[0].Body, "return_to=https%3A%2F%2Fapp.example.com%2Fwelcome") {
+		t.Errorf("verification link should carry return_to: %s\n", mailer.sent[0].Body)
+	}
+	token := mailer.lastToken(t)
+
+	if err = provider.VerifyEmail(ctx, token); err != nil {
+		t.Fatalf("failed to verify email: %s\n", err)
+	}
+	if err = provider.VerifyEmail(ctx, token); !errors.Is(err, password.ErrInvalidToken) {
+		t.Errorf("verification token should be single use, got %v\n", err)
+	}
+	if _, err = provider.Login(ctx, "test-user@example.com", "long enough password"); err != nil {
+		t.Errorf("verified user should be able to log in, got %v\n", err)
+	}
+}
+
+func TestVerifyEmail_ExistingUser(t *testing.T) {
+	provider, mailer, tokenStore := initProviderWithStore(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	// User who has logged in with a provider that verified the email
+	existing := models.Account{ID: "user-1", Email: "test-user@example.com", EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: "g-1", UserID: existing.ID, Email: existing.Email, CreatedAt: time.Now()}
+	if err := tokenStore.AddUserWithIdentity(ctx, existing, identity); err != nil {
+		t.Fatalf("failed to add user: %s\n", err)
+	}
+
+	registered, err := provider.Register(ctx, "test-user@example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+	// Nobody has proven they own the email yet, so the account can't be the existing user
+	if registered.GetID() == existing.ID {
+		t.Fatal("unverified account should not join the existing user\n")
+	}
+
+	if err = provider.SendVerificationEmail(ctx, registered, "https://app.example.com/welcome"); err != nil {
+		t.Fatalf("failed to send verification email: %s\n", err)
+	}
+	if err = provider.VerifyEmail(ctx, mailer.lastToken(t)); err != nil {
+		t.Fatalf("failed to verify email: %s\n", err)
+	}
+
+	user, err := provider.Login(ctx, "test-user@example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to log in: %s\n", err)
+	}
+	if user.GetID() != existing.ID {
+		t.Errorf("verified account should join the existing user, want %s got %s\n", existing.ID, user.GetID())
+	}
+	if _, err = tokenStore.GetUser(ctx, registered.GetID()); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("user of the unverified account should be removed, got %v\n", err)
+	}
+}
+
+func TestResetPassword_ExistingUser(t *testing.T) {
+	provider, mailer, tokenStore := initProviderWithStore(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	existing := models.Account{ID: "user-1", Email: "test-user@example.com", EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: "g-1", UserID: existing.ID, Email: existing.Email, CreatedAt: time.Now()}
+	if err := tokenStore.AddUserWithIdentity(ctx, existing, identity); err != nil {
+		t.Fatalf("failed to add user: %s\n", err)
+	}
+	if _, err := provider.Register(ctx, "test-user@example.com", "long enough password"); err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+
+	// Reset link verifies the email as well
+	if err := provider.RequestPasswordReset(ctx, "test-user@example.com"); err != nil {
+		t.Fatalf("failed to request password reset: %s\n", err)
+	}
+	user, err := provider.ResetPassword(ctx, mailer.lastToken(t), "a new long password")
+	if err != nil {
+		t.Fatalf("failed to reset password: %s\n", err)
+	}
+	if user.GetID() != existing.ID {
+		t.Errorf("reset should return the existing user, want %s got %s\n", existing.ID, user.GetID())
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	provider, mailer := initProvider(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	registered, err := provider.Register(ctx, "test-user@example.com", "long enough password")
+	if err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+
+	if err = provider.RequestPasswordReset(ctx, "unknown@example.com"); err != nil || len(mailer.sent) != 0 {
+		t.Errorf("unknown email should silently be ignored, got %v and %d emails\n", err, len(mailer.sent))
+	}
+
+	if err = provider.RequestPasswordReset(ctx, "test-user@example.com"); err != nil {
+		t.Fatalf("failed to request password reset: %s\n", err)
+	}
+	oldToken := mailer.lastToken(t)
+	if err = provider.RequestPasswordReset(ctx, "test-user@example.com"); err != nil {
+		t.Fatalf("failed to request password reset: %s\n", err)
+	}
+	token := mailer.lastToken(t)
+
+	if _, err = provider.ResetPassword(ctx, oldToken, "a new long password"); !errors.Is(err, password.ErrInvalidToken) {
+		t.Errorf("earlier reset links should stop working, got %v\n", err)
+	}
+	if _, err = provider.ResetPassword(ctx, token, "short"); !errors.Is(err, password.ErrPasswordTooShort) {
+		t.Errorf("short password should be rejected, got %v\n", err)
+	}
+
+	// Rejected password must not use up the token
+	user, err := provider.ResetPassword(ctx, token, "a new long password")
+	if err != nil {
+		t.Fatalf("failed to reset password: %s\n", err)
+	}
+	if user.GetID() != registered.GetID() {
+		t.Errorf("reset should return the user of the token, want %s got %s\n", registered.GetID(), user.GetID())
+	}
+	if _, err = provider.ResetPassword(ctx, token, "yet another password"); !errors.Is(err, password.ErrInvalidToken) {
+		t.Errorf("reset token should be single use, got %v\n", err)
+	}
+
+	if _, err = provider.Login(ctx, "test-user@example.com", "long enough password"); !errors.Is(err, password.ErrInvalidCredentials) {
+		t.Errorf("old password should stop working, got %v\n", err)
+	}
+	if _, err = provider.Login(ctx, "test-user@example.com", "a new long password"); err != nil {
+		t.Errorf("new password should work, got %v\n", err)
+	}
+}
+
+func TestEmailRateLimit(t *testing.T) {
+	provider, mailer := initProvider(t, password.Settings{AllowRegistration: true, MaxEmailsPerHour: 2})
+	ctx := context.Background()
+
+	if _, err := provider.Register(ctx, "test-user@example.com", "long enough password"); err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+	for range 2 {
+		if err := provider.RequestPasswordReset(ctx, "test-user@example.com"); err != nil {
+			t.Fatalf("failed to request password reset: %s\n", err)
+		}
+	}
+	// Earlier links are invalidated, but they still count towards the limit
+	if err := provider.RequestPasswordReset(ctx, "test-user@example.com"); !errors.Is(err, password.ErrRateLimited) {
+		t.Errorf("expected %s, got %v\n", password.ErrRateLimited, err)
+	}
+	if len(mailer.sent) != 2 {
+		t.Errorf("expected 2 emails, got %d\n", len(mailer.sent))
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	provider, _ := initProvider(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	if _, err := provider.Register(ctx, "test@example.com", "long enough password"); err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := provider.Login(ctx, "test@example.com", "wrong password"); !errors.Is(err, password.ErrInvalidCredentials) {
+			t.Fatalf("wrong password should be rejected, got %v\n", err)
+		}
+	}
+	// Even the right password is rejected until the lockout ends
+	if _, err := provider.Login(ctx, "Test@Example.com", "long enough password"); !errors.Is(err, password.ErrTooManyAttempts) {
+		t.Errorf("expected %s, got %v\n", password.ErrTooManyAttempts, err)
+	}
+
+	// Unknown emails are locked out the same way, so the lockout doesn't reveal accounts
+	for i := 0; i < 10; i++ {
+		provider.Login(ctx, "unknown@example.com", "wrong password")
+	}
+	if _, err := provider.Login(ctx, "unknown@example.com", "wrong password"); !errors.Is(err, password.ErrTooManyAttempts) {
+		t.Errorf("expected %s for an unknown email, got %v\n", password.ErrTooManyAttempts, err)
+	}
+}
+
+func TestLoginFailuresResetOnSuccess(t *testing.T) {
+	provider, _ := initProvider(t, password.Settings{AllowRegistration: true})
+	ctx := context.Background()
+
+	if _, err := provider.Register(ctx, "test@example.com", "long enough password"); err != nil {
+		t.Fatalf("failed to register user: %s\n", err)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 9; i++ {
+			provider.Login(ctx, "test@example.com", "wrong password")
+		}
+		if _, err := provider.Login(ctx, "test@example.com", "long enough password"); err != nil {
+			t.Fatalf("successful login should reset the failures, got %v\n", err)
+		}
+	}
+}
+
+func TestLoginHashingCancelled(t *testing.T) {
+	provider, _ := initProvider(t, password.Settings{AllowRegistration: true, MaxConcurrentHashes: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// A request that is gone doesn't wait for a hashing slot
+	if _, err := provider.Register(ctx, "test@example.com", "long enough password"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %s, got %v\n", context.Canceled, err)
+	}
+}
@@ -0,0 +1,436 @@
+package password
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/lattots/salpa/internal/account"
+	"github.com/lattots/salpa/internal/config"
+	mailer "github.com/lattots/salpa/internal/mail"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/ratelimit"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/google/uuid"
+)
+
+// Purposes of one-time tokens, a token of one purpose can't be used for another
+const (
+	purposeResetPassword = "reset_password"
+	purposeVerifyEmail   = "verify_email"
+)
+
+const (
+	resetTokenTTL  = time.Hour
+	verifyTokenTTL = 24 * time.Hour
+)
+
+// Store is the part of the token store the password provider uses.
+type Store interface {
+	store.LocalUserStore
+	store.OneTimeTokenStore
+}
+
+// Settings of the password provider.
+type Settings struct {
+	Params               Params
+	MinLength            int
+	AllowRegistration    bool
+	RequireVerifiedEmail bool
+	// Hashes computed at the same time, defaults to 4
+	MaxConcurrentHashes int
+	// Verification and reset emails sent to a single address in an hour, defaults to 5
+	MaxEmailsPerHour int
+
+	// Salpa endpoint the verification link points to
+	VerifyURL string
+	// Client application page with the new password form
+	ResetURL string
+}
+
+// Provider registers and logs in users with an email and password.
+type Provider struct {
+	users    Store
+	mailer   mailer.Mailer
+	settings Settings
+
+	// Hash of a random password, verified against when the email is unknown so timing doesn't reveal accounts
+	dummyHash string
+
+	// Argon2id takes a lot of memory, so a burst of logins waits for a free slot instead of hashing all at once
+	hashSlots chan struct{}
+	// Failed logins by email, which stop online password guessing
+	failedLogins *ratelimit.Limiter
+
+	// Called before a new account is created, nil allows every sign-up
+	signUp account.SignUpFunc
+}
+
+const (
+	defaultMinLength = 10
+	// Passwords are hashed as is, so their length is capped to keep hashing cheap for the server
+	maxLength = 1024
+
+	defaultMaxConcurrentHashes = 4
+	defaultMaxEmailsPerHour    = 5
+	// An email with this many failed logins can't log in with a password until the window ends
+	maxFailedLogins   = 10
+	failedLoginWindow = 15 * time.Minute
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrTooManyAttempts    = errors.New("too many failed logins, try again later")
+	ErrRegistrationClosed = errors.New("registration is not allowed")
+	ErrInvalidEmail       = util.ErrInvalidEmail
+	ErrPasswordTooShort   = errors.New("password is too short")
+	ErrPasswordTooLong    = errors.New("password is too long")
+	ErrEmailAlreadyInUse  = errors.New("email is already registered")
+	ErrEmailNotVerified   = errors.New("email address is not verified")
+	ErrInvalidToken       = errors.New("link is invalid or has expired")
+	ErrRateLimited        = errors.New("too many emails requested, try again later")
+)
+
+func NewProviderFromConf(conf config.SystemConfiguration, users Store, m mailer.Mailer) (*Provider, error) {
+	params := DefaultParams
+	if conf.Password.Argon2.Memory != 0 {
+		params.Memory = conf.Password.Argon2.Memory
+	}
+	if conf.Password.Argon2.Iterations != 0 {
+		params.Iterations = conf.Password.Argon2.Iterations
+	}
+	if conf.Password.Argon2.Parallelism != 0 {
+		params.Parallelism = conf.Password.Argon2.Parallelism
+	}
+
+	minLength := conf.Password.MinLength
+	if minLength == 0 {
+		minLength = defaultMinLength
+	}
+
+	resetURL := conf.Password.ResetURL
+	if resetURL == "" {
+		resetURL = conf.Service.AppDomain + "/reset-password"
+	}
+
+	return NewProvider(users, m, Settings{
+		Params:               params,
+		MinLength:            minLength,
+		AllowRegistration:    conf.Password.AllowRegistration,
+		RequireVerifiedEmail: conf.Password.RequireVerifiedEmail,
+		MaxConcurrentHashes:  conf.Password.MaxConcurrentHashes,
+		MaxEmailsPerHour:     conf.Password.MaxEmailsPerHour,
+		VerifyURL:            util.BuildURL(conf.Service.ServiceDomain, "password", "verify"),
+		ResetURL:             resetURL,
+	})
+}
+
+func NewProvider(users Store, m mailer.Mailer, settings Settings) (*Provider, error) {
+	dummyHash, err := Hash(uuid.NewString(), settings.Params)
+	if err != nil {
+		return nil, err
+	}
+	if settings.MaxConcurrentHashes <= 0 {
+		settings.MaxConcurrentHashes = defaultMaxConcurrentHashes
+	}
+	if settings.MaxEmailsPerHour <= 0 {
+		settings.MaxEmailsPerHour = defaultMaxEmailsPerHour
+	}
+	return &Provider{
+		users:        users,
+		mailer:       m,
+		settings:     settings,
+		dummyHash:    dummyHash,
+		hashSlots:    make(chan struct{}, settings.MaxConcurrentHashes),
+		failedLogins: ratelimit.New(maxFailedLogins, failedLoginWindow),
+	}, nil
+}
+
+// SetSignUpCheck sets the function that decides whether a registration may create a new account.
+func (p *Provider) SetSignUpCheck(signUp account.SignUpFunc) {
+	p.signUp = signUp
+}
+
+// RequireVerifiedEmail reports whether users must verify their email before they can log in.
+func (p *Provider) RequireVerifiedEmail() bool {
+	return p.settings.RequireVerifiedEmail
+}
+
+// Register creates a new account. Emails are compared case-insensitively.
+func (p *Provider) Register(ctx context.Context, email, password string) (models.User, error) {
+	if !p.settings.AllowRegistration {
+		return nil, ErrRegistrationClosed
+	}
+	email, err := util.NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.checkPassword(password); err != nil {
+		return nil, err
+	}
+	// Nobody has verified the email yet, so invite only sign-ups can't use an invitation this way
+	if p.signUp != nil {
+		if err = p.signUp(ctx, email, false); err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := p.hash(ctx, password)
+	if err != nil {
+		return nil, err
+	}
+	user := models.LocalUser{
+		ID:           uuid.NewString(),
+		Email:        email,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+	err = p.users.AddLocalUser(ctx, user)
+	if errors.Is(err, store.ErrUserExists) {
+		return nil, ErrEmailAlreadyInUse
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Login returns the user if the password matches. Unknown emails and wrong passwords return the same error.
+// After too many failed logins, the email is locked out for a while and ErrTooManyAttempts is returned.
+func (p *Provider) Login(ctx context.Context, email, password string) (models.User, error) {
+	email, err := util.NormalizeEmail(email)
+	if err != nil || len(password) > maxLength {
+		return nil, ErrInvalidCredentials
+	}
+	// Unknown emails are counted too, so the lockout doesn't reveal which emails are registered
+	if p.failedLogins.Limited(email) {
+		return nil, ErrTooManyAttempts
+	}
+
+	user, err := p.users.GetLocalUserByEmail(ctx, email)
+	if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		return nil, err
+	}
+	// Accounts created by magic link login have no password until one is set with a reset link
+	hasPassword := err == nil && user.PasswordHash != ""
+	hash := user.PasswordHash
+	if !hasPassword {
+		hash = p.dummyHash
+	}
+
+	ok, err := p.verify(ctx, password, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !hasPassword {
+		p.failedLogins.Add(email)
+		return nil, ErrInvalidCredentials
+	}
+	p.failedLogins.Reset(email)
+
+	// Hashes created with old parameters are upgraded while the password is at hand
+	if NeedsRehash(user.PasswordHash, p.settings.Params) {
+		if hash, err := p.hash(ctx, password); err == nil {
+			if err = p.users.UpdateLocalUserPassword(ctx, user.ID, hash); err != nil {
+				log.Printf("failed to rehash password of user %s: %s\n", user.ID, err)
+			}
+		}
+	}
+
+	// Checked only after the password, so the error doesn't reveal which emails are registered
+	if p.settings.RequireVerifiedEmail && !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	return user, nil
+}
+
+// SendVerificationEmail emails the user a link that verifies their address and sends them to returnTo.
+// Earlier verification links of the user stop working.
+func (p *Provider) SendVerificationEmail(ctx context.Context, user models.User, returnTo string) error {
+	token, err := p.newOneTimeToken(ctx, user, purposeVerifyEmail, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := util.AddQuery(p.settings.VerifyURL, url.Values{"token": {token}, "return_to": {returnTo}})
+	if err != nil {
+		return err
+	}
+	return p.mailer.Send(ctx, mailer.Message{
+		To:      user.GetEmail(),
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Open the link below to verify your email address. The link expires in %s.\n\n%s\n",
+			verifyTokenTTL, link),
+	})
+}
+
+// ResendVerificationEmail sends a new verification link if the email belongs to an unverified account.
+// Nothing tells the caller whether an email was sent, so the endpoint can't be used to find accounts.
+func (p *Provider) ResendVerificationEmail(ctx context.Context, email, returnTo string) error {
+	user, err := p.lookupUser(ctx, email)
+	if err != nil || user.ID == "" || user.EmailVerified {
+		return err
+	}
+	return p.SendVerificationEmail(ctx, user, returnTo)
+}
+
+// VerifyEmail marks the email of the token's user as verified. If a provider login has verified the email before,
+// the account joins that user.
+func (p *Provider) VerifyEmail(ctx context.Context, token string) error {
+	t, err := p.consumeOneTimeToken(ctx, token, purposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	_, err = p.users.SetLocalUserEmailVerified(ctx, t.UserID)
+	return err
+}
+
+// RequestPasswordReset emails a password reset link if the email is registered.
+// Like ResendVerificationEmail, the result doesn't reveal whether the account exists.
+func (p *Provider) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := p.lookupUser(ctx, email)
+	if err != nil || user.ID == "" {
+		return err
+	}
+
+	token, err := p.newOneTimeToken(ctx, user, purposeResetPassword, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	link, err := util.AddQuery(p.settings.ResetURL, url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	return p.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Open the link below to choose a new password. The link expires in %s.\n"+
+			"If you didn't ask to reset your password, you can ignore this email.\n\n%s\n",
+			resetTokenTTL, link),
+	})
+}
+
+// ResetPassword sets a new password for the user of the reset token.
+// The token proves the user controls the email, so the email is marked verified as well.
+func (p *Provider) ResetPassword(ctx context.Context, token, password string) (models.User, error) {
+	// Password is checked first, so a rejected password doesn't use up the token
+	if err := p.checkPassword(password); err != nil {
+		return nil, err
+	}
+
+	t, err := p.consumeOneTimeToken(ctx, token, purposeResetPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := p.hash(ctx, password)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.users.UpdateLocalUserPassword(ctx, t.UserID, hash); err != nil {
+		return nil, err
+	}
+	// Returned with the ID of the user who already had the verified email, if there is one
+	user, err := p.users.SetLocalUserEmailVerified(ctx, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// lookupUser returns an empty user without an error if the email is not registered.
+func (p *Provider) lookupUser(ctx context.Context, email string) (models.LocalUser, error) {
+	email, err := util.NormalizeEmail(email)
+	if err != nil {
+		return models.LocalUser{}, err
+	}
+	user, err := p.users.GetLocalUserByEmail(ctx, email)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return models.LocalUser{}, nil
+	}
+	return user, err
+}
+
+// newOneTimeToken creates a token to be emailed to the user. Tokens sent to the address are counted, which stops
+// flooding anyone's inbox, the same way magic links are limited.
+func (p *Provider) newOneTimeToken(ctx context.Context, user models.User, purpose string, ttl time.Duration) (string, error) {
+	sent, err := p.users.CountOneTimeTokens(ctx, user.GetEmail(), purpose, time.Now().Add(-time.Hour))
+	if err != nil {
+		return "", err
+	}
+	if sent >= p.settings.MaxEmailsPerHour {
+		return "", ErrRateLimited
+	}
+
+	if err = p.users.ExpireOneTimeTokens(ctx, user.GetID(), purpose); err != nil {
+		return "", err
+	}
+
+	token, hash := util.NewOneTimeToken()
+	err = p.users.AddOneTimeToken(ctx, models.OneTimeToken{
+		Hash:      hash,
+		Purpose:   purpose,
+		UserID:    user.GetID(),
+		Email:     user.GetEmail(),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	return token, err
+}
+
+func (p *Provider) consumeOneTimeToken(ctx context.Context, token, purpose string) (models.OneTimeToken, error) {
+	if token == "" {
+		return models.OneTimeToken{}, ErrInvalidToken
+	}
+	t, err := p.users.ConsumeOneTimeToken(ctx, util.HashOneTimeToken(token), purpose)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return models.OneTimeToken{}, ErrInvalidToken
+	}
+	return t, err
+}
+
+func (p *Provider) hash(ctx context.Context, password string) (string, error) {
+	release, err := p.acquireHashSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return Hash(password, p.settings.Params)
+}
+
+func (p *Provider) verify(ctx context.Context, password, hash string) (bool, error) {
+	release, err := p.acquireHashSlot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	return Verify(password, hash)
+}
+
+// acquireHashSlot waits until fewer than MaxConcurrentHashes hashes are being computed, or ctx is done.
+func (p *Provider) acquireHashSlot(ctx context.Context) (func(), error) {
+	select {
+	case p.hashSlots <- struct{}{}:
+		return func() { <-p.hashSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Provider) checkPassword(password string) error {
+	// Length is counted in characters, not bytes
+	if len([]rune(password)) < p.settings.MinLength {
+		return ErrPasswordTooShort
+	}
+	if len(password) > maxLength {
+		return ErrPasswordTooLong
+	}
+	return nil
+}
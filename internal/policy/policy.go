@@ -0,0 +1,142 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+
+	"github.com/google/uuid"
+)
+
+// Policy decides who can log in with a provider and who can sign up.
+type Policy struct {
+	store Store
+
+	allowedDomains       []string
+	allowedEmails        []string
+	blockedDomains       []string
+	requireVerifiedEmail bool
+	inviteOnly           bool
+}
+
+// Store is the part of the token store the policy uses.
+type Store interface {
+	store.InvitationStore
+}
+
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+var (
+	ErrEmailNotAllowed      = errors.New("this email address is not allowed to log in")
+	ErrEmailNotVerified     = errors.New("your provider has not verified your email address")
+	ErrNotInvited           = errors.New("signing up requires an invitation")
+	ErrInvitationNotFound   = errors.New("invitation not found")
+	ErrInvalidInvitationTTL = errors.New("invitation must expire in the future")
+)
+
+func NewPolicyFromConf(conf config.SystemConfiguration, s Store) (*Policy, error) {
+	return NewPolicy(conf.Policy, s)
+}
+
+func NewPolicy(conf config.PolicyConfig, s Store) (*Policy, error) {
+	p := &Policy{
+		store:                s,
+		allowedDomains:       normalizeDomains(conf.AllowedDomains),
+		blockedDomains:       normalizeDomains(conf.BlockedDomains),
+		requireVerifiedEmail: conf.RequireVerifiedEmail,
+		inviteOnly:           conf.InviteOnly,
+	}
+	for _, email := range conf.AllowedEmails {
+		normalized, err := util.NormalizeEmail(email)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed email %q", email)
+		}
+		p.allowedEmails = append(p.allowedEmails, normalized)
+	}
+	return p, nil
+}
+
+// CheckLogin tells whether the provider user may log in. It's checked on every provider login, so changes to
+// the policy also apply to users who have signed up before.
+func (p *Policy) CheckLogin(providerUser models.User) error {
+	email, verified := util.ProviderEmail(providerUser)
+	_, domain, _ := strings.Cut(email, "@")
+
+	if slices.Contains(p.blockedDomains, domain) {
+		return ErrEmailNotAllowed
+	}
+	if p.requireVerifiedEmail && !verified {
+		return ErrEmailNotVerified
+	}
+	if len(p.allowedDomains) == 0 && len(p.allowedEmails) == 0 {
+		return nil
+	}
+	// Anyone can claim an address their provider hasn't verified
+	if verified && (slices.Contains(p.allowedDomains, domain) || slices.Contains(p.allowedEmails, email)) {
+		return nil
+	}
+	return ErrEmailNotAllowed
+}
+
+// SignUp is called before a provider login creates a new user. When sign-ups are invite only,
+// it uses up an invitation of the verified email.
+func (p *Policy) SignUp(ctx context.Context, email string, emailVerified bool) error {
+	if !p.inviteOnly {
+		return nil
+	}
+	if !emailVerified {
+		return ErrNotInvited
+	}
+	_, err := p.store.ConsumeInvitation(ctx, email)
+	if errors.Is(err, store.ErrInvitationNotFound) {
+		return ErrNotInvited
+	}
+	return err
+}
+
+// Invite creates an invitation for the email that expires after ttl.
+func (p *Policy) Invite(ctx context.Context, email string, ttl time.Duration) (models.Invitation, error) {
+	email, err := util.NormalizeEmail(email)
+	if err != nil {
+		return models.Invitation{}, err
+	}
+	if ttl <= 0 {
+		return models.Invitation{}, ErrInvalidInvitationTTL
+	}
+
+	invitation := models.Invitation{
+		ID:        uuid.NewString(),
+		Email:     email,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	return invitation, p.store.AddInvitation(ctx, invitation)
+}
+
+func (p *Policy) ListInvitations(ctx context.Context) ([]models.Invitation, error) {
+	return p.store.ListInvitations(ctx)
+}
+
+func (p *Policy) RevokeInvitation(ctx context.Context, id string) error {
+	err := p.store.RemoveInvitation(ctx, id)
+	if errors.Is(err, store.ErrInvitationNotFound) {
+		return ErrInvitationNotFound
+	}
+	return err
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@")))
+	}
+	return normalized
+}
@@ -0,0 +1,135 @@
+package policy_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/policy"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+type providerUser struct {
+	email    string
+	verified bool
+}
+
+func (u providerUser) GetID() string         { return "provider-id" }
+func (u providerUser) GetEmail() string      { return u.email }
+func (u providerUser) IsEmailVerified() bool { return u.verified }
+
+func initPolicy(t *testing.T, conf config.PolicyConfig) (*policy.Policy, store.Store) {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	p, err := policy.NewPolicy(conf, tokenStore)
+	if err != nil {
+		t.Fatalf("error creating policy: %s\n", err)
+	}
+	return p, tokenStore
+}
+
+func TestCheckLogin(t *testing.T) {
+	p, _ := initPolicy(t, config.PolicyConfig{
+		AllowedDomains: []string{"@Example.com"},
+		AllowedEmails:  []string{"contractor@partner.com"},
+		BlockedDomains: []string{"blocked.example.com"},
+	})
+
+	tests := []struct {
+		user models.User
+		want error
+	}{
+		{providerUser{"alice@example.com", true}, nil},
+		{providerUser{"Contractor@Partner.com", true}, nil},
+		{providerUser{"bob@partner.com", true}, policy.ErrEmailNotAllowed},
+		// Anyone could claim an unverified address of the allowed domain
+		{providerUser{"alice@example.com", false}, policy.ErrEmailNotAllowed},
+		{providerUser{"eve@blocked.example.com", true}, policy.ErrEmailNotAllowed},
+		// Provider without email verification
+		{models.LocalUser{ID: "1", Email: "alice@example.com"}, policy.ErrEmailNotAllowed},
+	}
+	for _, test := range tests {
+		if err := p.CheckLogin(test.user); !errors.Is(err, test.want) {
+			t.Errorf("%s: want %v got %v\n", test.user.GetEmail(), test.want, err)
+		}
+	}
+}
+
+func TestCheckLogin_RequireVerifiedEmail(t *testing.T) {
+	p, _ := initPolicy(t, config.PolicyConfig{RequireVerifiedEmail: true, BlockedDomains: []string{"spam.com"}})
+
+	if err := p.CheckLogin(providerUser{"alice@example.com", true}); err != nil {
+		t.Errorf("verified email should be allowed, got %v\n", err)
+	}
+	if err := p.CheckLogin(providerUser{"alice@example.com", false}); !errors.Is(err, policy.ErrEmailNotVerified) {
+		t.Errorf("expected %s, got %v\n", policy.ErrEmailNotVerified, err)
+	}
+	if err := p.CheckLogin(providerUser{"eve@spam.com", true}); !errors.Is(err, policy.ErrEmailNotAllowed) {
+		t.Errorf("expected %s, got %v\n", policy.ErrEmailNotAllowed, err)
+	}
+}
+
+func TestInviteOnly(t *testing.T) {
+	p, tokenStore := initPolicy(t, config.PolicyConfig{InviteOnly: true})
+	ctx := context.Background()
+
+	if err := p.SignUp(ctx, "alice@example.com", true); !errors.Is(err, policy.ErrNotInvited) {
+		t.Errorf("sign-up without an invitation should fail, got %v\n", err)
+	}
+
+	if _, err := p.Invite(ctx, "Alice@Example.com", time.Hour); err != nil {
+		t.Fatalf("failed to invite: %s\n", err)
+	}
+	if err := p.SignUp(ctx, "alice@example.com", false); !errors.Is(err, policy.ErrNotInvited) {
+		t.Errorf("unverified email should not use the invitation, got %v\n", err)
+	}
+	if err := p.SignUp(ctx, "alice@example.com", true); err != nil {
+		t.Fatalf("invited email should sign up, got %s\n", err)
+	}
+	if err := p.SignUp(ctx, "alice@example.com", true); !errors.Is(err, policy.ErrNotInvited) {
+		t.Errorf("invitation should only be used once, got %v\n", err)
+	}
+
+	err := tokenStore.AddInvitation(ctx, models.Invitation{
+		ID:        "expired",
+		Email:     "bob@example.com",
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("failed to add invitation: %s\n", err)
+	}
+	if err = p.SignUp(ctx, "bob@example.com", true); !errors.Is(err, policy.ErrNotInvited) {
+		t.Errorf("expired invitation should not be used, got %v\n", err)
+	}
+
+	invitations, err := p.ListInvitations(ctx)
+	if err != nil {
+		t.Fatalf("failed to list invitations: %s\n", err)
+	}
+	if len(invitations) != 2 || invitations[0].UsedAt.IsZero() || invitations[0].Email != "alice@example.com" {
+		t.Errorf("unexpected invitations: %+v\n", invitations)
+	}
+	if err = p.RevokeInvitation(ctx, "expired"); err != nil {
+		t.Errorf("failed to revoke invitation: %s\n", err)
+	}
+	if err = p.RevokeInvitation(ctx, "expired"); !errors.Is(err, policy.ErrInvitationNotFound) {
+		t.Errorf("expected %s, got %v\n", policy.ErrInvitationNotFound, err)
+	}
+}
+
+func TestSignUpOpen(t *testing.T) {
+	p, _ := initPolicy(t, config.PolicyConfig{})
+
+	if err := p.SignUp(context.Background(), "alice@example.com", false); err != nil {
+		t.Errorf("sign-up should be open without invite only mode, got %v\n", err)
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter counts events by key in fixed time windows, e.g. failed logins by email.
+// Counts are kept in memory, so every Salpa instance has limits of its own and a restart resets them.
+type Limiter struct {
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*window
+	swept   time.Time
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// New creates a limiter that allows max events by a key in each period of length per.
+func New(max int, per time.Duration) *Limiter {
+	return &Limiter{max: max, window: per, windows: make(map[string]*window), swept: time.Now()}
+}
+
+// Allow counts an event of the key and reports whether it's within the limit.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := l.current(key)
+	w.count++
+	return w.count <= l.max
+}
+
+// Limited reports whether the key has used up its events, without counting one.
+func (l *Limiter) Limited(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current(key).count >= l.max
+}
+
+// Add counts an event of the key.
+func (l *Limiter) Add(key string) {
+	l.Allow(key)
+}
+
+// Reset forgets the events of the key.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.windows, key)
+}
+
+// current returns the window of the key, starting a new one if the last has ended. Caller must hold mu.
+func (l *Limiter) current(key string) *window {
+	now := time.Now()
+	// Ended windows are dropped once in a while, so keys seen only once don't pile up
+	if now.Sub(l.swept) > l.window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.swept = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	return w
+}
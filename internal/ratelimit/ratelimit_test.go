@@ -0,0 +1,43 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/ratelimit"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := ratelimit.New(2, time.Hour)
+
+	if !limiter.Allow("a") || !limiter.Allow("a") {
+		t.Fatal("events within the limit should be allowed\n")
+	}
+	if limiter.Allow("a") {
+		t.Error("event over the limit should not be allowed\n")
+	}
+	if !limiter.Limited("a") {
+		t.Error("key over the limit should be limited\n")
+	}
+	if limiter.Limited("b") || !limiter.Allow("b") {
+		t.Error("keys should be limited separately\n")
+	}
+
+	limiter.Reset("a")
+	if limiter.Limited("a") {
+		t.Error("reset key should not be limited\n")
+	}
+}
+
+func TestLimiterWindow(t *testing.T) {
+	limiter := ratelimit.New(1, 20*time.Millisecond)
+
+	limiter.Add("a")
+	if !limiter.Limited("a") {
+		t.Fatal("key should be limited after its only event\n")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if limiter.Limited("a") {
+		t.Error("limit should be lifted when the window ends\n")
+	}
+}
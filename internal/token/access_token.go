@@ -15,8 +15,19 @@ func (m *Manager) NewAccessToken(refreshToken string) (string, time.Time, error)
 	}
 
 	newClaims := models.NewUserClaims(user.GetID(), user.GetEmail(), m.accessTokenTTL)
+	newClaims.Issuer = m.issuer
+	newClaims.Audience = m.audience
+	if sessionUser, ok := user.(models.SessionUser); ok {
+		newClaims.AMR = sessionUser.GetAMR()
+		sessionClaims := sessionUser.GetClaims()
+		newClaims.Roles = sessionClaims.Roles
+		newClaims.Groups = sessionClaims.Groups
+		newClaims.Extra = sessionClaims.Extra
+	}
+	key := m.keys.signingKey()
 	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, newClaims)
-	signed, err := token.SignedString(m.accessTokenPrivate)
+	token.Header["kid"] = key.id
+	signed, err := token.SignedString(key.private)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("error signing token: %w", err)
 	}
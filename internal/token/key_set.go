@@ -0,0 +1,222 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+type signingKey struct {
+	id        string
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	createdAt time.Time
+	retiredAt time.Time // Zero for the current key
+}
+
+func newSigningKey(priv ed25519.PrivateKey, createdAt time.Time) signingKey {
+	pub := priv.Public().(ed25519.PublicKey)
+	return signingKey{
+		id:        models.Ed25519KeyID(pub),
+		private:   priv,
+		public:    pub,
+		createdAt: createdAt,
+	}
+}
+
+// KeySet holds the current access token signing key and the previous keys,
+// which are kept for verification until every token signed with them has expired.
+type KeySet struct {
+	mu       sync.RWMutex
+	current  signingKey
+	previous []signingKey
+
+	// Previous keys are dropped when they have been retired for longer than this
+	retention time.Duration
+
+	// Key set is persisted only when filename is set.
+	// Retired keys are saved next to the current key with the retiredKeySuffix and key ID appended.
+	filename string
+}
+
+const retiredKeySuffix = ".retired."
+
+// NewKeySet creates an in-memory key set. Rotated keys are not persisted.
+func NewKeySet(priv ed25519.PrivateKey, retention time.Duration) *KeySet {
+	return &KeySet{
+		current:   newSigningKey(priv, time.Now()),
+		retention: retention,
+	}
+}
+
+// LoadKeySet loads the current key from filename and the retired keys saved next to it.
+// If the key file doesn't exist, a new key is created.
+func LoadKeySet(filename string, retention time.Duration) (*KeySet, error) {
+	priv, err := loadPrivateKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{
+		current:   newSigningKey(priv, info.ModTime()),
+		retention: retention,
+		filename:  filename,
+	}
+
+	retiredFilenames, err := filepath.Glob(filename + retiredKeySuffix + "*")
+	if err != nil {
+		return nil, err
+	}
+	for _, retiredFilename := range retiredFilenames {
+		info, err := os.Stat(retiredFilename)
+		if err != nil {
+			return nil, err
+		}
+		// Retirement time is stored as the modification time of the file
+		if time.Since(info.ModTime()) > retention {
+			if err = os.Remove(retiredFilename); err != nil {
+				log.Printf("failed to remove expired signing key %s: %s\n", retiredFilename, err)
+			}
+			continue
+		}
+
+		priv, err := loadPrivateKey(retiredFilename)
+		if err != nil {
+			return nil, fmt.Errorf("error loading retired key %s: %w", retiredFilename, err)
+		}
+		key := newSigningKey(priv, info.ModTime())
+		key.retiredAt = info.ModTime()
+		ks.previous = append(ks.previous, key)
+	}
+
+	return ks, nil
+}
+
+// Rotate makes a new key the current signing key and retires the old one.
+func (ks *KeySet) Rotate() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	var next signingKey
+	if ks.filename == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		next = newSigningKey(priv, now)
+	} else {
+		var err error
+		next, err = ks.rotateFiles(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	retired := ks.current
+	retired.retiredAt = now
+	ks.previous = append(ks.activePrevious(now), retired)
+	ks.current = next
+
+	log.Printf("rotated access token signing key, new key ID: %s\n", next.id)
+	return nil
+}
+
+// rotateFiles moves the current key file aside and writes a new key in its place.
+// The new key is written to a temporary file first, so a failure never leaves the key set without a current key.
+func (ks *KeySet) rotateFiles(now time.Time) (signingKey, error) {
+	tmpFilename := ks.filename + ".next"
+	if err := generateED25519Key(tmpFilename); err != nil {
+		return signingKey{}, err
+	}
+	priv, err := loadPrivateKey(tmpFilename)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	retiredFilename := ks.filename + retiredKeySuffix + ks.current.id
+	if err = os.Rename(ks.filename, retiredFilename); err != nil {
+		return signingKey{}, fmt.Errorf("error retiring current key: %w", err)
+	}
+	if err = os.Chtimes(retiredFilename, now, now); err != nil {
+		return signingKey{}, err
+	}
+	if err = os.Rename(tmpFilename, ks.filename); err != nil {
+		return signingKey{}, fmt.Errorf("error saving new key: %w", err)
+	}
+
+	for _, key := range ks.previous {
+		if now.Sub(key.retiredAt) > ks.retention {
+			_ = os.Remove(ks.filename + retiredKeySuffix + key.id)
+		}
+	}
+
+	return newSigningKey(priv, now), nil
+}
+
+// activePrevious returns the previous keys that can still have valid tokens.
+// Caller must hold the lock.
+func (ks *KeySet) activePrevious(now time.Time) []signingKey {
+	var active []signingKey
+	for _, key := range ks.previous {
+		if now.Sub(key.retiredAt) <= ks.retention {
+			active = append(active, key)
+		}
+	}
+	return active
+}
+
+// signingKey returns the key new tokens are signed with.
+func (ks *KeySet) signingKey() signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.current
+}
+
+// verificationKey returns the public key with the given ID.
+// Tokens without a key ID are verified with the current key.
+func (ks *KeySet) verificationKey(kid string) (ed25519.PublicKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if kid == "" || kid == ks.current.id {
+		return ks.current.public, nil
+	}
+	for _, key := range ks.activePrevious(time.Now()) {
+		if key.id == kid {
+			return key.public, nil
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+// PublicKeys returns the public keys of the set, current key first.
+func (ks *KeySet) PublicKeys() []ed25519.PublicKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := []ed25519.PublicKey{ks.current.public}
+	for _, key := range ks.activePrevious(time.Now()) {
+		keys = append(keys, key.public)
+	}
+	return keys
+}
+
+// currentAge tells how long the current key has been in use.
+func (ks *KeySet) currentAge() time.Duration {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return time.Since(ks.current.createdAt)
+}
@@ -1,11 +1,13 @@
 package token
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -18,8 +20,11 @@ import (
 )
 
 type Manager struct {
-	accessTokenPrivate ed25519.PrivateKey
-	AccessTokenPublic  ed25519.PublicKey
+	keys *KeySet
+
+	// Registered claims of access tokens, left out when empty. Verified tokens must have them too
+	issuer   string
+	audience []string
 
 	accessTokenTTL  time.Duration
 	refreshTokenTTL time.Duration
@@ -30,13 +35,20 @@ type Manager struct {
 const (
 	defaultAccessTokenTTL  = time.Minute * 10
 	defaultRefreshTokenTTL = time.Hour * 24 * 30 // Refresh tokens are valid for a month
+
+	// Retired signing keys are kept until the last access token signed with them expires.
+	// The extra minute covers clock differences between Salpa and the verifying services.
+	defaultKeyRetention = defaultAccessTokenTTL + time.Minute
 )
 
 func NewManager(store store.Store, acPriv ed25519.PrivateKey) *Manager {
+	return NewManagerWithKeySet(store, NewKeySet(acPriv, defaultKeyRetention))
+}
+
+func NewManagerWithKeySet(store store.Store, keys *KeySet) *Manager {
 	return &Manager{
-		accessTokenPrivate: acPriv,
-		AccessTokenPublic:  acPriv.Public().(ed25519.PublicKey),
-		accessTokenTTL:     defaultAccessTokenTTL,
+		keys:           keys,
+		accessTokenTTL: defaultAccessTokenTTL,
 
 		refreshTokenTTL: defaultRefreshTokenTTL,
 
@@ -45,22 +57,74 @@ func NewManager(store store.Store, acPriv ed25519.PrivateKey) *Manager {
 }
 
 func NewManagerFromConf(conf config.SystemConfiguration, store store.Store) (*Manager, error) {
-	privateKey, err := loadPrivateKey(conf.Service.PrivateKeyFilename)
+	keys, err := LoadKeySet(conf.Service.PrivateKeyFilename, defaultKeyRetention)
 	if err != nil {
 		return nil, err
 	}
 
-	manager := NewManager(store, privateKey)
+	manager := NewManagerWithKeySet(store, keys)
+	manager.issuer = conf.Service.TokenIssuer()
+	manager.audience = conf.Service.TokenAudience()
 	return manager, nil
 }
 
+// PublicKeys returns the access token verification keys, current key first.
+// Keys retired by rotation are included until the tokens signed with them have expired.
+func (m *Manager) PublicKeys() []ed25519.PublicKey {
+	return m.keys.PublicKeys()
+}
+
+// JWKS returns the access token verification keys as a JSON Web Key Set.
+func (m *Manager) JWKS() models.JWKSet {
+	var jwks models.JWKSet
+	for _, pub := range m.PublicKeys() {
+		jwks.Keys = append(jwks.Keys, models.NewEd25519JWK(pub))
+	}
+	return jwks
+}
+
+// RotateSigningKey replaces the access token signing key.
+// Tokens signed with the previous key stay valid until they expire.
+func (m *Manager) RotateSigningKey() error {
+	return m.keys.Rotate()
+}
+
+// RunKeyRotation rotates the signing key whenever it gets older than interval.
+// It blocks until ctx is done.
+func (m *Manager) RunKeyRotation(ctx context.Context, interval time.Duration) {
+	for {
+		wait := max(interval-m.keys.currentAge(), 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+			if err := m.RotateSigningKey(); err != nil {
+				log.Printf("failed to rotate signing key: %s\n", err)
+				// Don't retry in a tight loop if the key directory is not writable
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Minute):
+				}
+			}
+		}
+	}
+}
+
 func (m *Manager) Close() error {
 	return m.refreshTokenStore.Close()
 }
 
 func (m *Manager) verifyToken(tokenStr string, keyFunc func(token *jwt.Token) (any, error)) (*models.UserClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &models.UserClaims{}, keyFunc)
-	if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+	opts := []jwt.ParserOption{jwt.WithIssuedAt()}
+	if m.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(m.issuer))
+	}
+	if len(m.audience) != 0 {
+		opts = append(opts, jwt.WithAudience(m.audience...))
+	}
+	token, err := jwt.ParseWithClaims(tokenStr, &models.UserClaims{}, keyFunc, opts...)
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, jwt.ErrTokenInvalidIssuer) || errors.Is(err, jwt.ErrTokenInvalidAudience) {
 		return nil, ErrTokenInvalid
 	}
 	if errors.Is(err, jwt.ErrTokenMalformed) {
@@ -80,7 +144,8 @@ func (m *Manager) getAccessPublic(token *jwt.Token) (any, error) {
 	if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
 		return nil, errors.New("unexpected signing method")
 	}
-	return m.AccessTokenPublic, nil
+	kid, _ := token.Header["kid"].(string)
+	return m.keys.verificationKey(kid)
 }
 
 func loadPrivateKey(filename string) (ed25519.PrivateKey, error) {
@@ -2,19 +2,32 @@ package token
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
 
 	"github.com/google/uuid"
 )
 
-func (m *Manager) NewRefreshToken(userID, email string) (models.RefreshToken, error) {
+// NewRefreshToken starts a new session. amr lists the methods the user logged in with, they end up in the access tokens.
+func (m *Manager) NewRefreshToken(userID, email string, amr ...string) (models.RefreshToken, error) {
+	return m.NewRefreshTokenWithClaims(userID, email, models.SessionClaims{}, amr...)
+}
+
+// NewRefreshTokenWithClaims starts a new session whose access tokens carry the roles, groups and custom claims.
+func (m *Manager) NewRefreshTokenWithClaims(userID, email string, claims models.SessionClaims, amr ...string) (models.RefreshToken, error) {
+	tokenID := uuid.New().String()
 	token := models.RefreshToken{
-		TokenID:   uuid.New().String(),
+		TokenID:   tokenID,
 		UserID:    userID,
 		ExpiresAt: time.Now().Add(m.refreshTokenTTL),
+		FamilyID:  tokenID,
+		SessionID: uuid.New().String(),
+		AMR:       amr,
+		Claims:    claims,
 	}
 	err := m.refreshTokenStore.Add(context.TODO(), token, email)
 	if err != nil {
@@ -34,3 +47,65 @@ func (m *Manager) VerifyRefreshToken(tokenID string) (models.User, error) {
 
 	return user, nil
 }
+
+// RotateRefreshToken invalidates the refresh token and issues its successor.
+// If the token has already been rotated, the whole token family is revoked and ErrTokenReused is returned.
+// If a concurrent request rotates it first, ErrTokenRotated is returned and nothing is revoked.
+func (m *Manager) RotateRefreshToken(tokenID string) (models.RefreshToken, error) {
+	next := models.RefreshToken{
+		TokenID:   uuid.New().String(),
+		ExpiresAt: time.Now().Add(m.refreshTokenTTL),
+		ParentID:  tokenID,
+	}
+	user, err := m.refreshTokenStore.Rotate(context.TODO(), tokenID, next)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return models.RefreshToken{}, ErrTokenInvalid
+	}
+	if errors.Is(err, store.ErrTokenReused) {
+		return models.RefreshToken{}, ErrTokenReused
+	}
+	if errors.Is(err, store.ErrTokenRotated) {
+		return models.RefreshToken{}, ErrTokenRotated
+	}
+	if err != nil {
+		return models.RefreshToken{}, fmt.Errorf("error rotating refresh token: %w", err)
+	}
+
+	next.UserID = user.GetID()
+	if sessionUser, ok := user.(models.SessionUser); ok {
+		next.AMR = sessionUser.GetAMR()
+		next.Claims = sessionUser.GetClaims()
+	}
+	return next, nil
+}
+
+// RevokeRefreshToken removes the session of the given refresh token.
+// Revoking a token that doesn't exist is not an error.
+func (m *Manager) RevokeRefreshToken(tokenID string) error {
+	if err := m.refreshTokenStore.Remove(context.TODO(), tokenID); err != nil {
+		return fmt.Errorf("error removing refresh token: %w", err)
+	}
+	return nil
+}
+
+// RevokeAllRefreshTokens removes every session of the user who owns the given refresh token.
+// The refresh token has to be valid, so only a signed in user can end their own sessions.
+func (m *Manager) RevokeAllRefreshTokens(tokenID string) (models.User, error) {
+	user, err := m.VerifyRefreshToken(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = m.RevokeUserRefreshTokens(user.GetID()); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RevokeUserRefreshTokens removes every session of the user.
+func (m *Manager) RevokeUserRefreshTokens(userID string) error {
+	if err := m.refreshTokenStore.RemoveAllForUser(context.TODO(), userID); err != nil {
+		return fmt.Errorf("error removing refresh tokens: %w", err)
+	}
+	return nil
+}
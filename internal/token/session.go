@@ -0,0 +1,46 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+)
+
+// ListSessions returns a page of the sessions that match the filter and the number of all matching sessions.
+func (m *Manager) ListSessions(ctx context.Context, filter store.SessionFilter) ([]models.Session, int, error) {
+	sessions, err := m.refreshTokenStore.ListSessions(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing sessions: %w", err)
+	}
+	total, err := m.refreshTokenStore.CountSessions(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting sessions: %w", err)
+	}
+	return sessions, total, nil
+}
+
+func (m *Manager) GetSession(ctx context.Context, sessionID string) (models.Session, error) {
+	session, err := m.refreshTokenStore.GetSession(ctx, sessionID)
+	if errors.Is(err, store.ErrSessionNotFound) {
+		return models.Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return models.Session{}, fmt.Errorf("error getting session: %w", err)
+	}
+	return session, nil
+}
+
+// RevokeSession removes every refresh token of the session. Access tokens already issued stay valid until they expire.
+func (m *Manager) RevokeSession(ctx context.Context, sessionID string) error {
+	err := m.refreshTokenStore.RemoveSession(ctx, sessionID)
+	if errors.Is(err, store.ErrSessionNotFound) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error removing session: %w", err)
+	}
+	return nil
+}
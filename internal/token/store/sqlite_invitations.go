@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+func (s *sqLiteStore) AddInvitation(ctx context.Context, invitation models.Invitation) error {
+	query := `INSERT INTO invitations (id, email, createdAt, expiresAt) VALUES (?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, query,
+		invitation.ID, invitation.Email, invitation.CreatedAt.Unix(), invitation.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+// ConsumeInvitation marks the oldest valid invitation of the email used in the same statement that finds it,
+// so one invitation can't be used by two concurrent sign-ups.
+func (s *sqLiteStore) ConsumeInvitation(ctx context.Context, email string) (models.Invitation, error) {
+	now := time.Now().Unix()
+	query := `UPDATE invitations SET usedAt = ? WHERE id = (
+			SELECT id FROM invitations WHERE email = ? AND usedAt IS NULL AND expiresAt > ? ORDER BY createdAt, id LIMIT 1
+		) AND usedAt IS NULL
+		RETURNING ` + invitationColumns
+	invitation, err := scanInvitation(s.db.QueryRowContext(ctx, query, now, email, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Invitation{}, ErrInvitationNotFound
+	}
+	return invitation, err
+}
+
+// ListInvitations returns every invitation, the newest first.
+func (s *sqLiteStore) ListInvitations(ctx context.Context) ([]models.Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations ORDER BY createdAt DESC, id`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []models.Invitation
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+func (s *sqLiteStore) RemoveInvitation(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM invitations WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrInvitationNotFound
+	}
+	return err
+}
+
+const invitationColumns = `id, email, createdAt, expiresAt, usedAt`
+
+func scanInvitation(row rowScanner) (models.Invitation, error) {
+	var invitation models.Invitation
+	var createdAt, expiresAt int64
+	var usedAt sql.NullInt64
+	err := row.Scan(&invitation.ID, &invitation.Email, &createdAt, &expiresAt, &usedAt)
+	if err != nil {
+		return models.Invitation{}, err
+	}
+	invitation.CreatedAt = time.Unix(createdAt, 0)
+	invitation.ExpiresAt = time.Unix(expiresAt, 0)
+	if usedAt.Valid {
+		invitation.UsedAt = time.Unix(usedAt.Int64, 0)
+	}
+	return invitation, nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// AddLocalUser inserts a new password account. Emails are unique, so the same email can't register twice.
+// Local accounts are users too, the user is created unless the account is added to an existing one.
+func (s *sqLiteStore) AddLocalUser(ctx context.Context, user models.LocalUser) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO local_users (id, email, passwordHash, emailVerified, createdAt) VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query, user.ID, user.Email, user.PasswordHash, user.EmailVerified, user.CreatedAt.Unix())
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO users (id, email, emailVerified, createdAt) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`
+	_, err = tx.ExecContext(ctx, query, user.ID, user.Email, user.EmailVerified, user.CreatedAt.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const localUserColumns = `id, email, passwordHash, emailVerified, createdAt`
+
+func (s *sqLiteStore) GetLocalUserByEmail(ctx context.Context, email string) (models.LocalUser, error) {
+	query := `SELECT ` + localUserColumns + ` FROM local_users WHERE email = ?`
+	return scanLocalUser(s.db.QueryRowContext(ctx, query, email))
+}
+
+func scanLocalUser(row rowScanner) (models.LocalUser, error) {
+	var user models.LocalUser
+	var createdAt int64
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerified, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.LocalUser{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.LocalUser{}, err
+	}
+	user.CreatedAt = time.Unix(createdAt, 0)
+	return user, nil
+}
+
+// UpdateLocalUserPassword replaces the password hash, e.g. when hashing parameters are upgraded.
+func (s *sqLiteStore) UpdateLocalUserPassword(ctx context.Context, userID, passwordHash string) error {
+	query := `UPDATE local_users SET passwordHash = ? WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, query, passwordHash, userID)
+	return checkUserUpdated(res, err)
+}
+
+// SetLocalUserEmailVerified marks the email of the account verified and returns the account.
+// An account registered with a password gets a user of its own. If a provider login has already verified the email,
+// the account is moved to that user once its email is verified, so every login method of the email resolves to the
+// same user. Sessions, passkeys, second factors and identities added to the account's own user before the email was
+// verified could belong to anyone, so they are removed with it.
+func (s *sqLiteStore) SetLocalUserEmailVerified(ctx context.Context, userID string) (models.LocalUser, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.LocalUser{}, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + localUserColumns + ` FROM local_users WHERE id = ?`
+	user, err := scanLocalUser(tx.QueryRowContext(ctx, query, userID))
+	if err != nil {
+		return models.LocalUser{}, err
+	}
+	if user.EmailVerified {
+		return user, nil
+	}
+	user.EmailVerified = true
+
+	var existingID string
+	query = `SELECT id FROM users WHERE email = ? AND emailVerified = 1 AND id != ? ORDER BY createdAt, id LIMIT 1`
+	err = tx.QueryRowContext(ctx, query, user.Email, user.ID).Scan(&existingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		query = `UPDATE local_users SET emailVerified = 1 WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, query, user.ID); err != nil {
+			return models.LocalUser{}, err
+		}
+		// The user's email is verified too if it's the same address
+		query = `UPDATE users SET emailVerified = 1 WHERE id = ? AND email = ?`
+		if _, err = tx.ExecContext(ctx, query, user.ID, user.Email); err != nil {
+			return models.LocalUser{}, err
+		}
+		return user, tx.Commit()
+	}
+	if err != nil {
+		return models.LocalUser{}, err
+	}
+
+	for _, table := range []string{"sessions", "webauthn_credentials", "mfa_totp", "mfa_backup_codes", "identities"} {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE userID = ?`, user.ID); err != nil {
+			return models.LocalUser{}, err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, user.ID); err != nil {
+		return models.LocalUser{}, err
+	}
+	query = `UPDATE local_users SET id = ?, emailVerified = 1 WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, query, existingID, user.ID); err != nil {
+		return models.LocalUser{}, err
+	}
+	user.ID = existingID
+	return user, tx.Commit()
+}
+
+func checkUserUpdated(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return err
+}
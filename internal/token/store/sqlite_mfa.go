@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+// SetTOTPEnrollment replaces an unconfirmed enrollment. A confirmed one has to be removed first.
+func (s *sqLiteStore) SetTOTPEnrollment(ctx context.Context, enrollment models.TOTPEnrollment) error {
+	query := `INSERT INTO mfa_totp (userID, secret, confirmed, lastUsedStep, createdAt) VALUES (?, ?, ?, 0, ?)
+		ON CONFLICT (userID) DO UPDATE SET secret = excluded.secret, confirmed = excluded.confirmed,
+			lastUsedStep = 0, createdAt = excluded.createdAt
+		WHERE mfa_totp.confirmed = 0`
+	res, err := s.db.ExecContext(ctx, query,
+		enrollment.UserID, enrollment.Secret, enrollment.Confirmed, enrollment.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrCredentialExists
+	}
+	return err
+}
+
+func (s *sqLiteStore) GetTOTPEnrollment(ctx context.Context, userID string) (models.TOTPEnrollment, error) {
+	query := `SELECT userID, secret, confirmed, lastUsedStep, failedAttempts, lockedUntil, createdAt FROM mfa_totp WHERE userID = ?`
+
+	var enrollment models.TOTPEnrollment
+	var lockedUntil, createdAt int64
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(
+		&enrollment.UserID, &enrollment.Secret, &enrollment.Confirmed, &enrollment.LastUsedStep,
+		&enrollment.FailedAttempts, &lockedUntil, &createdAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.TOTPEnrollment{}, ErrCredentialNotFound
+	}
+	if err != nil {
+		return models.TOTPEnrollment{}, err
+	}
+	enrollment.LockedUntil = time.Unix(lockedUntil, 0)
+	enrollment.CreatedAt = time.Unix(createdAt, 0)
+
+	return enrollment, nil
+}
+
+func (s *sqLiteStore) ConfirmTOTPEnrollment(ctx context.Context, userID string) error {
+	query := `UPDATE mfa_totp SET confirmed = 1 WHERE userID = ?`
+	res, err := s.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrCredentialNotFound
+	}
+	return err
+}
+
+// UseTOTPStep records the time step of an accepted code. The check and the update are one statement,
+// so two concurrent logins can't use the same code.
+func (s *sqLiteStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	query := `UPDATE mfa_totp SET lastUsedStep = ? WHERE userID = ? AND lastUsedStep < ?`
+	res, err := s.db.ExecContext(ctx, query, step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenReused
+	}
+	return err
+}
+
+// AddTOTPFailure counts a wrong code. The update is one statement, so concurrent logins can't lose a failure.
+// SET expressions see the old row, so the count that reaches maxFailures sets the lock and starts over.
+func (s *sqLiteStore) AddTOTPFailure(ctx context.Context, userID string, maxFailures int, lockUntil time.Time) error {
+	query := `UPDATE mfa_totp SET
+			lockedUntil = CASE WHEN failedAttempts + 1 >= ? THEN ? ELSE lockedUntil END,
+			failedAttempts = CASE WHEN failedAttempts + 1 >= ? THEN 0 ELSE failedAttempts + 1 END
+		WHERE userID = ?`
+	_, err := s.db.ExecContext(ctx, query, maxFailures, lockUntil.Unix(), maxFailures, userID)
+	return err
+}
+
+func (s *sqLiteStore) ResetTOTPFailures(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE mfa_totp SET failedAttempts = 0 WHERE userID = ?`, userID)
+	return err
+}
+
+// RemoveTOTPEnrollment removes the enrollment and the backup codes that came with it.
+func (s *sqLiteStore) RemoveTOTPEnrollment(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM mfa_totp WHERE userID = ?;
+		DELETE FROM mfa_backup_codes WHERE userID = ?;
+	`, userID, userID)
+	return err
+}
+
+func (s *sqLiteStore) ReplaceBackupCodes(ctx context.Context, userID string, hashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM mfa_backup_codes WHERE userID = ?`, userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO mfa_backup_codes (hash, userID) VALUES (?, ?)`, hash, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqLiteStore) ConsumeBackupCode(ctx context.Context, userID, hash string) error {
+	query := `DELETE FROM mfa_backup_codes WHERE hash = ? AND userID = ?`
+	res, err := s.db.ExecContext(ctx, query, hash, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
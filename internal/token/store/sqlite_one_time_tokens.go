@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Expired tokens are kept this long, so rate limits can count them
+const oneTimeTokenRetention = 24 * time.Hour
+
+// AddOneTimeToken also removes the tokens that expired long ago. Anyone can request magic links and passkey challenges,
+// so every insert cleans up after itself and the table can't grow without bound.
+func (s *sqLiteStore) AddOneTimeToken(ctx context.Context, token models.OneTimeToken) error {
+	createdAt := token.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM one_time_tokens WHERE expiresAt <= ?`
+	if _, err = tx.ExecContext(ctx, query, time.Now().Add(-oneTimeTokenRetention).Unix()); err != nil {
+		return err
+	}
+	query = `INSERT INTO one_time_tokens (hash, purpose, userID, email, data, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query,
+		token.Hash, token.Purpose, token.UserID, token.Email, token.Data, createdAt.Unix(), token.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeOneTimeToken deletes the token in the same statement that reads it, so concurrent requests can't both use it.
+func (s *sqLiteStore) ConsumeOneTimeToken(ctx context.Context, hash, purpose string) (models.OneTimeToken, error) {
+	query := `DELETE FROM one_time_tokens WHERE hash = ? AND purpose = ? RETURNING userID, email, data, createdAt, expiresAt`
+
+	token := models.OneTimeToken{Hash: hash, Purpose: purpose}
+	var createdAt, expiresAt int64
+	err := s.db.QueryRowContext(ctx, query, hash, purpose).Scan(&token.UserID, &token.Email, &token.Data, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.OneTimeToken{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return models.OneTimeToken{}, err
+	}
+	token.CreatedAt = time.Unix(createdAt, 0)
+	token.ExpiresAt = time.Unix(expiresAt, 0)
+
+	// Expired tokens are removed all the same, they are of no use anymore
+	if !time.Now().Before(token.ExpiresAt) {
+		return models.OneTimeToken{}, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+// ExpireOneTimeTokens invalidates the user's earlier tokens, e.g. when a new reset link is requested.
+// The rows are kept so CountOneTimeTokens still counts them.
+func (s *sqLiteStore) ExpireOneTimeTokens(ctx context.Context, userID, purpose string) error {
+	now := time.Now().Unix()
+	query := `UPDATE one_time_tokens SET expiresAt = ? WHERE userID = ? AND purpose = ? AND expiresAt > ?`
+	_, err := s.db.ExecContext(ctx, query, now, userID, purpose, now)
+	return err
+}
+
+func (s *sqLiteStore) CountOneTimeTokens(ctx context.Context, email, purpose string, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM one_time_tokens WHERE email = ? AND purpose = ? AND createdAt >= ?`
+	var count int
+	err := s.db.QueryRowContext(ctx, query, email, purpose, since.Unix()).Scan(&count)
+	return count, err
+}
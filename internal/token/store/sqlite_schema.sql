@@ -3,4 +3,102 @@ CREATE TABLE IF NOT EXISTS sessions (
 	userID TEXT NOT NULL,
 	email text NOT NULL,
 	expiresAt INTEGER NOT NULL,
+	parentID TEXT,
+	familyID TEXT NOT NULL,
+	usedAt INTEGER,
+	amr TEXT NOT NULL DEFAULT '',
+	claims TEXT NOT NULL DEFAULT '',
+	roles TEXT NOT NULL DEFAULT '',
+	groups TEXT NOT NULL DEFAULT '',
+	sessionID TEXT NOT NULL DEFAULT '',
+	createdAt INTEGER NOT NULL DEFAULT 0,
+	startedAt INTEGER NOT NULL DEFAULT 0
 );
+
+CREATE INDEX IF NOT EXISTS sessions_familyID ON sessions (familyID);
+CREATE INDEX IF NOT EXISTS sessions_sessionID ON sessions (sessionID);
+CREATE INDEX IF NOT EXISTS sessions_userID ON sessions (userID);
+
+CREATE TABLE IF NOT EXISTS local_users (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	passwordHash TEXT NOT NULL,
+	createdAt INTEGER NOT NULL,
+	emailVerified INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS one_time_tokens (
+	hash TEXT PRIMARY KEY,
+	purpose TEXT NOT NULL,
+	userID TEXT NOT NULL,
+	email TEXT NOT NULL,
+	expiresAt INTEGER NOT NULL,
+	data TEXT NOT NULL DEFAULT '',
+	createdAt INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS one_time_tokens_userID ON one_time_tokens (userID, purpose);
+CREATE INDEX IF NOT EXISTS one_time_tokens_email ON one_time_tokens (email, purpose, createdAt);
+CREATE INDEX IF NOT EXISTS one_time_tokens_expiresAt ON one_time_tokens (expiresAt);
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id TEXT PRIMARY KEY,
+	userID TEXT NOT NULL,
+	email TEXT NOT NULL,
+	publicKey BLOB NOT NULL,
+	algorithm INTEGER NOT NULL,
+	signCount INTEGER NOT NULL,
+	transports TEXT NOT NULL,
+	createdAt INTEGER NOT NULL,
+	lastUsedAt INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_userID ON webauthn_credentials (userID);
+
+CREATE TABLE IF NOT EXISTS mfa_totp (
+	userID TEXT PRIMARY KEY,
+	secret TEXT NOT NULL,
+	confirmed INTEGER NOT NULL DEFAULT 0,
+	lastUsedStep INTEGER NOT NULL DEFAULT 0,
+	failedAttempts INTEGER NOT NULL DEFAULT 0,
+	lockedUntil INTEGER NOT NULL DEFAULT 0,
+	createdAt INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS mfa_backup_codes (
+	hash TEXT PRIMARY KEY,
+	userID TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS mfa_backup_codes_userID ON mfa_backup_codes (userID);
+
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	emailVerified INTEGER NOT NULL DEFAULT 0,
+	createdAt INTEGER NOT NULL,
+	name TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	userID TEXT NOT NULL,
+	email TEXT NOT NULL,
+	createdAt INTEGER NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS identities_userID ON identities (userID);
+
+CREATE TABLE IF NOT EXISTS invitations (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	createdAt INTEGER NOT NULL,
+	expiresAt INTEGER NOT NULL,
+	usedAt INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS invitations_email ON invitations (email);
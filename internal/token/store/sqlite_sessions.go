@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+// Only the current token of a family is unused, so there is one row per session
+const sessionColumns = `sessionID, userID, email, amr, claims, roles, groups, startedAt, createdAt, expiresAt`
+
+// ListSessions returns the sessions that match the filter, the most recently refreshed first.
+func (s *sqLiteStore) ListSessions(ctx context.Context, filter SessionFilter) ([]models.Session, error) {
+	where, args := sessionWhere(filter)
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	query := `SELECT ` + sessionColumns + ` FROM sessions ` + where + ` ORDER BY createdAt DESC, sessionID LIMIT ? OFFSET ?`
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, max(filter.Offset, 0))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// CountSessions counts every session that matches the filter, ignoring its limit and offset.
+func (s *sqLiteStore) CountSessions(ctx context.Context, filter SessionFilter) (int, error) {
+	where, args := sessionWhere(filter)
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions `+where, args...).Scan(&count)
+	return count, err
+}
+
+func (s *sqLiteStore) GetSession(ctx context.Context, sessionID string) (models.Session, error) {
+	where, args := sessionWhere(SessionFilter{})
+	query := `SELECT ` + sessionColumns + ` FROM sessions ` + where + ` AND sessionID = ?`
+	session, err := scanSession(s.db.QueryRowContext(ctx, query, append(args, sessionID)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Session{}, ErrSessionNotFound
+	}
+	return session, err
+}
+
+// RemoveSession deletes the whole token family of the session, so none of its refresh tokens can be used.
+func (s *sqLiteStore) RemoveSession(ctx context.Context, sessionID string) error {
+	query := `DELETE FROM sessions WHERE familyID IN (SELECT familyID FROM sessions WHERE sessionID = ?)`
+	res, err := s.db.ExecContext(ctx, query, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// sessionWhere selects the valid current tokens that match the filter
+func sessionWhere(filter SessionFilter) (string, []any) {
+	where := `WHERE usedAt IS NULL AND expiresAt > ?`
+	args := []any{time.Now().Unix()}
+	if filter.UserID != "" {
+		where += ` AND userID = ?`
+		args = append(args, filter.UserID)
+	}
+	if filter.Email != "" {
+		where += ` AND email = ?`
+		args = append(args, filter.Email)
+	}
+	return where, args
+}
+
+func scanSession(row rowScanner) (models.Session, error) {
+	var session models.Session
+	var amr, extra, roles, groups string
+	var startedAt, createdAt, expiresAt int64
+	err := row.Scan(
+		&session.ID, &session.UserID, &session.Email, &amr, &extra, &roles, &groups, &startedAt, &createdAt, &expiresAt,
+	)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	user := storeUser{}
+	if err = user.setSession(amr, extra, roles, groups); err != nil {
+		return models.Session{}, err
+	}
+	session.AMR = user.amr
+	session.Claims = user.claims
+	session.CreatedAt = unixOrZero(startedAt)
+	session.RefreshedAt = unixOrZero(createdAt)
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	return session, nil
+}
+
+func unixOrZero(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
@@ -3,11 +3,15 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lattots/salpa/internal/models"
 
+	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -44,32 +48,308 @@ func InitSQLiteStore(filename string) (Store, error) {
 		return nil, err
 	}
 
+	if err = migrateSQLiteStore(db); err != nil {
+		return nil, fmt.Errorf("error migrating store: %w", err)
+	}
+
 	return NewSQLiteStore(db)
 }
 
+// migrateSQLiteStore adds the columns and tables introduced after the first version of the schema.
+// Every statement must be safe to run against an already migrated database.
+func migrateSQLiteStore(db *sql.DB) error {
+	err := addColumns(db, "sessions", []column{
+		{"parentID", "TEXT"},
+		{"familyID", "TEXT NOT NULL DEFAULT ''"},
+		{"usedAt", "INTEGER"},
+		{"amr", "TEXT NOT NULL DEFAULT ''"},
+		{"claims", "TEXT NOT NULL DEFAULT ''"},
+		{"roles", "TEXT NOT NULL DEFAULT ''"},
+		{"groups", "TEXT NOT NULL DEFAULT ''"},
+		{"sessionID", "TEXT NOT NULL DEFAULT ''"},
+		{"createdAt", "INTEGER NOT NULL DEFAULT 0"},
+		{"startedAt", "INTEGER NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sessions created before rotation start their own token family
+	_, err = db.Exec(`
+		UPDATE sessions SET familyID = id WHERE familyID = '';
+		CREATE INDEX IF NOT EXISTS sessions_familyID ON sessions (familyID);
+
+		-- Sessions created before session IDs get a random one, the family ID is the first refresh token
+		UPDATE sessions SET sessionID = lower(hex(randomblob(16))) WHERE sessionID = '';
+		CREATE INDEX IF NOT EXISTS sessions_sessionID ON sessions (sessionID);
+		CREATE INDEX IF NOT EXISTS sessions_userID ON sessions (userID);
+
+		CREATE TABLE IF NOT EXISTS local_users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			passwordHash TEXT NOT NULL,
+			createdAt INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS one_time_tokens (
+			hash TEXT PRIMARY KEY,
+			purpose TEXT NOT NULL,
+			userID TEXT NOT NULL,
+			email TEXT NOT NULL,
+			expiresAt INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS one_time_tokens_userID ON one_time_tokens (userID, purpose);
+	`)
+	if err != nil {
+		return err
+	}
+
+	err = addColumns(db, "local_users", []column{
+		{"emailVerified", "INTEGER NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = addColumns(db, "one_time_tokens", []column{
+		{"data", "TEXT NOT NULL DEFAULT ''"},
+		{"createdAt", "INTEGER NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS one_time_tokens_email ON one_time_tokens (email, purpose, createdAt);
+		CREATE INDEX IF NOT EXISTS one_time_tokens_expiresAt ON one_time_tokens (expiresAt);
+
+		CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id TEXT PRIMARY KEY,
+			userID TEXT NOT NULL,
+			email TEXT NOT NULL,
+			publicKey BLOB NOT NULL,
+			algorithm INTEGER NOT NULL,
+			signCount INTEGER NOT NULL,
+			transports TEXT NOT NULL,
+			createdAt INTEGER NOT NULL,
+			lastUsedAt INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS webauthn_credentials_userID ON webauthn_credentials (userID);
+
+		CREATE TABLE IF NOT EXISTS mfa_totp (
+			userID TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			confirmed INTEGER NOT NULL DEFAULT 0,
+			lastUsedStep INTEGER NOT NULL DEFAULT 0,
+			failedAttempts INTEGER NOT NULL DEFAULT 0,
+			lockedUntil INTEGER NOT NULL DEFAULT 0,
+			createdAt INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS mfa_backup_codes (
+			hash TEXT PRIMARY KEY,
+			userID TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS mfa_backup_codes_userID ON mfa_backup_codes (userID);
+
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			emailVerified INTEGER NOT NULL DEFAULT 0,
+			createdAt INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS users_email ON users (email);
+
+		CREATE TABLE IF NOT EXISTS identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			userID TEXT NOT NULL,
+			email TEXT NOT NULL,
+			createdAt INTEGER NOT NULL,
+			PRIMARY KEY (provider, subject)
+		);
+		CREATE INDEX IF NOT EXISTS identities_userID ON identities (userID);
+
+		-- Local accounts created before the users table
+		INSERT INTO users (id, email, emailVerified, createdAt)
+			SELECT id, email, emailVerified, createdAt FROM local_users WHERE true
+			ON CONFLICT (id) DO NOTHING;
+
+		CREATE TABLE IF NOT EXISTS invitations (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			createdAt INTEGER NOT NULL,
+			expiresAt INTEGER NOT NULL,
+			usedAt INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS invitations_email ON invitations (email);
+	`)
+	if err != nil {
+		return err
+	}
+
+	err = addColumns(db, "mfa_totp", []column{
+		{"failedAttempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"lockedUntil", "INTEGER NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return addColumns(db, "users", []column{
+		{"name", "TEXT NOT NULL DEFAULT ''"},
+	})
+}
+
+type column struct{ name, definition string }
+
+// addColumns adds the columns missing from the table.
+func addColumns(db *sql.DB, table string, columns []column) error {
+	existing, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
 // Add inserts a new session record.
+// A token without a family starts a new family of its own.
 func (s *sqLiteStore) Add(ctx context.Context, token models.RefreshToken, email string) error {
-	query := `INSERT INTO sessions (id, userID, email, expiresAt) VALUES (?, ?, ?, ?)`
-	_, err := s.db.ExecContext(ctx, query, token.TokenID, token.UserID, email, token.ExpiresAt.Unix())
+	familyID := token.FamilyID
+	if familyID == "" {
+		familyID = token.TokenID
+	}
+	sessionID := token.SessionID
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	extra, err := encodeClaims(token.Claims.Extra)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	query := `INSERT INTO sessions (id, userID, email, expiresAt, parentID, familyID, amr, claims, roles, groups, sessionID, createdAt, startedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = s.db.ExecContext(ctx, query,
+		token.TokenID, token.UserID, email, token.ExpiresAt.Unix(), nullString(token.ParentID), familyID,
+		strings.Join(token.AMR, ","), extra, strings.Join(token.Claims.Roles, ","), strings.Join(token.Claims.Groups, ","),
+		sessionID, now, now,
+	)
 	return err
 }
 
-// Check returns true if the token exists AND is not expired.
+// Check returns true if the token exists AND is not expired AND hasn't been rotated.
 func (s *sqLiteStore) Check(ctx context.Context, tokenID string) (bool, models.User, error) {
-	query := `SELECT userID, email FROM sessions WHERE id = ? AND expiresAt > ?`
+	query := `SELECT userID, email, amr, claims, roles, groups FROM sessions WHERE id = ? AND expiresAt > ? AND usedAt IS NULL`
 
 	user := storeUser{}
-	err := s.db.QueryRowContext(ctx, query, tokenID, time.Now().Unix()).Scan(&user.id, &user.email)
+	var amr, extra, roles, groups string
+	err := s.db.QueryRowContext(ctx, query, tokenID, time.Now().Unix()).Scan(&user.id, &user.email, &amr, &extra, &roles, &groups)
 	if errors.Is(err, sql.ErrNoRows) {
 		return false, nil, nil
 	}
 	if err != nil {
 		return false, nil, err
 	}
+	if err = user.setSession(amr, extra, roles, groups); err != nil {
+		return false, nil, err
+	}
 
 	return true, user, nil
 }
 
+// Rotate marks the token as used and adds next as its successor in the same token family.
+// Rotating an already used token revokes the whole family, because either the legitimate user
+// or an attacker is replaying an old token and there is no way to tell them apart.
+func (s *sqLiteStore) Rotate(ctx context.Context, tokenID string, next models.RefreshToken) (models.User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user := storeUser{}
+	var familyID, sessionID string
+	var usedAt sql.NullInt64
+	var startedAt int64
+	var amr, extra, roles, groups string
+	query := `SELECT userID, email, familyID, usedAt, amr, claims, roles, groups, sessionID, startedAt
+		FROM sessions WHERE id = ? AND expiresAt > ?`
+	err = tx.QueryRowContext(ctx, query, tokenID, time.Now().Unix()).Scan(
+		&user.id, &user.email, &familyID, &usedAt, &amr, &extra, &roles, &groups, &sessionID, &startedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE familyID = ?`, familyID); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE sessions SET usedAt = ? WHERE id = ? AND usedAt IS NULL`, time.Now().Unix(), tokenID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	// A concurrent rotation got here first. It's the same client refreshing twice, not a replay
+	if n != 1 {
+		return nil, ErrTokenRotated
+	}
+
+	// The successor keeps the authentication methods, claims and ID of the session
+	query = `INSERT INTO sessions (id, userID, email, expiresAt, parentID, familyID, amr, claims, roles, groups, sessionID, createdAt, startedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query,
+		next.TokenID, user.id, user.email, next.ExpiresAt.Unix(), tokenID, familyID, amr, extra, roles, groups,
+		sessionID, time.Now().Unix(), startedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = user.setSession(amr, extra, roles, groups); err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
 // Remove deletes a specific session (used for logout).
 func (s *sqLiteStore) Remove(ctx context.Context, tokenID string) error {
 	query := `DELETE FROM sessions WHERE id = ?`
@@ -87,3 +367,45 @@ func (s *sqLiteStore) RemoveAllForUser(ctx context.Context, userID string) error
 func (s *sqLiteStore) Close() error {
 	return s.db.Close()
 }
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// splitList reads a comma separated column. An empty column is an empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// setSession sets how the user logged in and the claims of the session from their columns
+func (u *storeUser) setSession(amr, extra, roles, groups string) error {
+	u.amr = splitList(amr)
+	u.claims.Roles = splitList(roles)
+	u.claims.Groups = splitList(groups)
+	var err error
+	u.claims.Extra, err = decodeClaims(extra)
+	return err
+}
+
+// encodeClaims stores the extra claims of a session as JSON, no claims is an empty string
+func encodeClaims(claims map[string]any) (string, error) {
+	if len(claims) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(claims)
+	return string(encoded), err
+}
+
+func decodeClaims(s string) (map[string]any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var claims map[string]any
+	if err := json.Unmarshal([]byte(s), &claims); err != nil {
+		return nil, fmt.Errorf("error decoding session claims: %w", err)
+	}
+	return claims, nil
+}
@@ -2,6 +2,8 @@ package store_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -138,3 +140,488 @@ func TestSQLiteStore_RemoveAllForUser(t *testing.T) {
 		t.Error("t3 (User B) should NOT have been deleted")
 	}
 }
+
+func TestSQLiteStore_Rotate(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	store, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	ctx := context.Background()
+
+	first := models.RefreshToken{TokenID: "first", UserID: "user_1", ExpiresAt: time.Now().Add(time.Hour)}
+	if err = store.Add(ctx, first, "email@test.com"); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+
+	second := models.RefreshToken{TokenID: "second", ExpiresAt: time.Now().Add(time.Hour)}
+	user, err := store.Rotate(ctx, first.TokenID, second)
+	if err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+	if user.GetID() != first.UserID {
+		t.Errorf("wrong user ID, want %s got %s", first.UserID, user.GetID())
+	}
+
+	if exists, _, _ := store.Check(ctx, first.TokenID); exists {
+		t.Error("rotated token should no longer be valid")
+	}
+	exists, user, _ := store.Check(ctx, second.TokenID)
+	if !exists {
+		t.Fatal("successor token should be valid")
+	}
+	if user.GetEmail() != "email@test.com" {
+		t.Errorf("successor token should keep the email, got %s", user.GetEmail())
+	}
+}
+
+func TestSQLiteStore_Rotate_Reuse(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	ctx := context.Background()
+
+	first := models.RefreshToken{TokenID: "first", UserID: "user_1", ExpiresAt: time.Now().Add(time.Hour)}
+	s.Add(ctx, first, "email@test.com")
+	other := models.RefreshToken{TokenID: "other", UserID: "user_1", ExpiresAt: time.Now().Add(time.Hour)}
+	s.Add(ctx, other, "email@test.com")
+
+	second := models.RefreshToken{TokenID: "second", ExpiresAt: time.Now().Add(time.Hour)}
+	if _, err = s.Rotate(ctx, first.TokenID, second); err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+
+	// Replaying the rotated token must revoke the whole family
+	third := models.RefreshToken{TokenID: "third", ExpiresAt: time.Now().Add(time.Hour)}
+	_, err = s.Rotate(ctx, first.TokenID, third)
+	if !errors.Is(err, store.ErrTokenReused) {
+		t.Fatalf("expected %s got %v", store.ErrTokenReused, err)
+	}
+
+	if exists, _, _ := s.Check(ctx, second.TokenID); exists {
+		t.Error("successor token should have been revoked with its family")
+	}
+	if exists, _, _ := s.Check(ctx, third.TokenID); exists {
+		t.Error("token from rejected rotation should not exist")
+	}
+	// Sessions in other families are not affected
+	if exists, _, _ := s.Check(ctx, other.TokenID); !exists {
+		t.Error("token in another family should NOT have been revoked")
+	}
+}
+
+func TestSQLiteStore_Rotate_Unknown(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+
+	next := models.RefreshToken{TokenID: "next", ExpiresAt: time.Now().Add(time.Hour)}
+	_, err = s.Rotate(context.Background(), "does_not_exist", next)
+	if !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("expected %s got %v", store.ErrTokenNotFound, err)
+	}
+}
+
+func TestSQLiteStore_Migrate(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	// Create a database with the schema used before token rotation
+	db, err := sql.Open("sqlite3", testDBFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			userID TEXT NOT NULL,
+			email text NOT NULL,
+			expiresAt INTEGER NOT NULL
+		);
+		INSERT INTO sessions (id, userID, email, expiresAt) VALUES ('legacy', 'user_1', 'email@test.com', ?);
+	`, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error migrating store: %s\n", err)
+	}
+
+	next := models.RefreshToken{TokenID: "next", ExpiresAt: time.Now().Add(time.Hour)}
+	if _, err = s.Rotate(context.Background(), "legacy", next); err != nil {
+		t.Fatalf("Rotate() failed for legacy session: %v", err)
+	}
+
+	// Legacy sessions get an ID of their own instead of exposing the refresh token
+	sessions, err := s.ListSessions(context.Background(), store.SessionFilter{})
+	if err != nil {
+		t.Fatalf("ListSessions() failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID == "" || sessions[0].ID == "legacy" || !sessions[0].CreatedAt.IsZero() {
+		t.Errorf("unexpected legacy session: %+v", sessions)
+	}
+}
+
+func TestSQLiteStore_LocalUsers(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	user := models.LocalUser{ID: "user_abc", Email: "test@example.com", PasswordHash: "hash", CreatedAt: time.Now()}
+	if err = s.AddLocalUser(ctx, user); err != nil {
+		t.Fatalf("AddLocalUser() failed: %v", err)
+	}
+	duplicate := models.LocalUser{ID: "user_def", Email: user.Email, PasswordHash: "hash", CreatedAt: time.Now()}
+	if err = s.AddLocalUser(ctx, duplicate); !errors.Is(err, store.ErrUserExists) {
+		t.Errorf("expected ErrUserExists for a duplicate email, got %v", err)
+	}
+
+	if err = s.UpdateLocalUserPassword(ctx, user.ID, "new-hash"); err != nil {
+		t.Fatalf("UpdateLocalUserPassword() failed: %v", err)
+	}
+	got, err := s.GetLocalUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetLocalUserByEmail() failed: %v", err)
+	}
+	if got.ID != user.ID || got.PasswordHash != "new-hash" {
+		t.Errorf("unexpected user: %+v", got)
+	}
+
+	if _, err = s.GetLocalUserByEmail(ctx, "unknown@example.com"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteStore_OneTimeTokens(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	token := models.OneTimeToken{Hash: "hash_1", Purpose: "reset_password", UserID: "user_abc", Email: "test@example.com", ExpiresAt: time.Now().Add(time.Hour)}
+	expired := models.OneTimeToken{Hash: "hash_2", Purpose: "reset_password", UserID: "user_abc", Email: "test@example.com", ExpiresAt: time.Now().Add(-time.Minute)}
+	for _, tok := range []models.OneTimeToken{token, expired} {
+		if err = s.AddOneTimeToken(ctx, tok); err != nil {
+			t.Fatalf("AddOneTimeToken() failed: %v", err)
+		}
+	}
+
+	if _, err = s.ConsumeOneTimeToken(ctx, token.Hash, "verify_email"); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("token of another purpose should not be found, got %v", err)
+	}
+	got, err := s.ConsumeOneTimeToken(ctx, token.Hash, token.Purpose)
+	if err != nil {
+		t.Fatalf("ConsumeOneTimeToken() failed: %v", err)
+	}
+	if got.UserID != token.UserID || got.Email != token.Email {
+		t.Errorf("unexpected token: %+v", got)
+	}
+	if _, err = s.ConsumeOneTimeToken(ctx, token.Hash, token.Purpose); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("token should only be consumed once, got %v", err)
+	}
+	if _, err = s.ConsumeOneTimeToken(ctx, expired.Hash, expired.Purpose); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("expired token should not be found, got %v", err)
+	}
+
+	earlier := models.OneTimeToken{Hash: "hash_3", Purpose: "reset_password", UserID: "user_abc", Email: "test@example.com", ExpiresAt: time.Now().Add(time.Hour)}
+	if err = s.AddOneTimeToken(ctx, earlier); err != nil {
+		t.Fatalf("AddOneTimeToken() failed: %v", err)
+	}
+	if err = s.ExpireOneTimeTokens(ctx, earlier.UserID, earlier.Purpose); err != nil {
+		t.Fatalf("ExpireOneTimeTokens() failed: %v", err)
+	}
+	// Expired tokens still count towards rate limits
+	count, err := s.CountOneTimeTokens(ctx, earlier.Email, earlier.Purpose, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("CountOneTimeTokens() failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 token to be counted, got %d", count)
+	}
+	if _, err = s.ConsumeOneTimeToken(ctx, earlier.Hash, earlier.Purpose); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("expired token should not be found, got %v", err)
+	}
+
+	// Tokens that expired long ago are removed when a new one is added
+	old := models.OneTimeToken{Hash: "hash_4", Purpose: "magic_link", Email: "old@example.com",
+		CreatedAt: time.Now().Add(-72 * time.Hour), ExpiresAt: time.Now().Add(-48 * time.Hour)}
+	if err = s.AddOneTimeToken(ctx, old); err != nil {
+		t.Fatalf("AddOneTimeToken() failed: %v", err)
+	}
+	next := models.OneTimeToken{Hash: "hash_5", Purpose: "magic_link", Email: "new@example.com", ExpiresAt: time.Now().Add(time.Hour)}
+	if err = s.AddOneTimeToken(ctx, next); err != nil {
+		t.Fatalf("AddOneTimeToken() failed: %v", err)
+	}
+	if count, err = s.CountOneTimeTokens(ctx, old.Email, old.Purpose, time.Now().Add(-96*time.Hour)); err != nil || count != 0 {
+		t.Errorf("old token should be removed, got %d %v", count, err)
+	}
+}
+
+func TestSQLiteStore_WebAuthnCredentials(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	credential := models.WebAuthnCredential{
+		ID:         "cred_abc",
+		UserID:     "user_abc",
+		Email:      "test@example.com",
+		PublicKey:  []byte("key"),
+		Algorithm:  -7,
+		SignCount:  1,
+		Transports: []string{"internal", "hybrid"},
+		CreatedAt:  time.Now(),
+	}
+	if err = s.AddWebAuthnCredential(ctx, credential); err != nil {
+		t.Fatalf("AddWebAuthnCredential() failed: %v", err)
+	}
+	if err = s.AddWebAuthnCredential(ctx, credential); !errors.Is(err, store.ErrCredentialExists) {
+		t.Errorf("expected ErrCredentialExists for a duplicate ID, got %v", err)
+	}
+
+	if err = s.UpdateWebAuthnSignCount(ctx, credential.ID, 5); err != nil {
+		t.Fatalf("UpdateWebAuthnSignCount() failed: %v", err)
+	}
+	got, err := s.GetWebAuthnCredential(ctx, credential.ID)
+	if err != nil {
+		t.Fatalf("GetWebAuthnCredential() failed: %v", err)
+	}
+	if got.UserID != credential.UserID || got.SignCount != 5 || len(got.Transports) != 2 || got.LastUsedAt.IsZero() {
+		t.Errorf("unexpected credential: %+v", got)
+	}
+
+	list, err := s.ListWebAuthnCredentials(ctx, credential.UserID)
+	if err != nil {
+		t.Fatalf("ListWebAuthnCredentials() failed: %v", err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expected 1 credential, got %d", len(list))
+	}
+
+	if _, err = s.GetWebAuthnCredential(ctx, "unknown"); !errors.Is(err, store.ErrCredentialNotFound) {
+		t.Errorf("expected ErrCredentialNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteStore_Identities(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	user := models.Account{ID: "user_abc", Email: "test@example.com", EmailVerified: true, CreatedAt: time.Now()}
+	identity := models.Identity{Provider: "google", Subject: "123", UserID: user.ID, Email: user.Email, CreatedAt: time.Now()}
+	if err = s.AddUserWithIdentity(ctx, user, identity); err != nil {
+		t.Fatalf("AddUserWithIdentity() failed: %v", err)
+	}
+	other := models.Account{ID: "user_def", Email: "other@example.com", CreatedAt: time.Now()}
+	if err = s.AddUserWithIdentity(ctx, other, identity); !errors.Is(err, store.ErrIdentityExists) {
+		t.Errorf("expected ErrIdentityExists for a duplicate identity, got %v", err)
+	}
+	if _, err = s.GetUser(ctx, other.ID); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("failed identity should leave no user behind, got %v", err)
+	}
+
+	for _, name := range []string{"Test User", "Another Name"} {
+		if err = s.SetUserName(ctx, user.ID, name); err != nil {
+			t.Fatalf("SetUserName() failed: %v", err)
+		}
+	}
+	// Only a user without a name gets one
+	if named, err := s.GetUser(ctx, user.ID); err != nil || named.Name != "Test User" {
+		t.Errorf("unexpected user: %+v %v", named, err)
+	}
+
+	github := models.Identity{Provider: "github", Subject: "456", UserID: user.ID, Email: user.Email, CreatedAt: time.Now()}
+	if err = s.AddIdentity(ctx, github); err != nil {
+		t.Fatalf("AddIdentity() failed: %v", err)
+	}
+	got, err := s.GetIdentity(ctx, "github", "456")
+	if err != nil {
+		t.Fatalf("GetIdentity() failed: %v", err)
+	}
+	if got.UserID != user.ID {
+		t.Errorf("unexpected identity: %+v", got)
+	}
+	found, err := s.GetUserByVerifiedEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByVerifiedEmail() failed: %v", err)
+	}
+	if found.ID != user.ID {
+		t.Errorf("unexpected user: %+v", found)
+	}
+
+	if err = s.RemoveIdentity(ctx, user.ID, "google", "123"); err != nil {
+		t.Fatalf("RemoveIdentity() failed: %v", err)
+	}
+	if err = s.RemoveIdentity(ctx, user.ID, "google", "123"); !errors.Is(err, store.ErrIdentityNotFound) {
+		t.Errorf("expected ErrIdentityNotFound, got %v", err)
+	}
+	list, err := s.ListIdentities(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListIdentities() failed: %v", err)
+	}
+	if len(list) != 1 || list[0].Provider != "github" {
+		t.Errorf("unexpected identities: %+v", list)
+	}
+}
+
+func TestSQLiteStore_Invitations(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	first := models.Invitation{ID: "inv_1", Email: "test@example.com", CreatedAt: time.Now().Add(-time.Minute), ExpiresAt: time.Now().Add(time.Hour)}
+	second := models.Invitation{ID: "inv_2", Email: "test@example.com", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	for _, invitation := range []models.Invitation{first, second} {
+		if err = s.AddInvitation(ctx, invitation); err != nil {
+			t.Fatalf("AddInvitation() failed: %v", err)
+		}
+	}
+
+	used, err := s.ConsumeInvitation(ctx, "test@example.com")
+	if err != nil {
+		t.Fatalf("ConsumeInvitation() failed: %v", err)
+	}
+	if used.ID != first.ID || used.UsedAt.IsZero() {
+		t.Errorf("oldest invitation should be used first, got %+v", used)
+	}
+	if _, err = s.ConsumeInvitation(ctx, "other@example.com"); !errors.Is(err, store.ErrInvitationNotFound) {
+		t.Errorf("expected ErrInvitationNotFound, got %v", err)
+	}
+
+	list, err := s.ListInvitations(ctx)
+	if err != nil {
+		t.Fatalf("ListInvitations() failed: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != second.ID || !list[0].UsedAt.IsZero() || list[1].UsedAt.IsZero() {
+		t.Errorf("unexpected invitations: %+v", list)
+	}
+
+	if err = s.RemoveInvitation(ctx, second.ID); err != nil {
+		t.Fatalf("RemoveInvitation() failed: %v", err)
+	}
+	if err = s.RemoveInvitation(ctx, second.ID); !errors.Is(err, store.ErrInvitationNotFound) {
+		t.Errorf("expected ErrInvitationNotFound, got %v", err)
+	}
+	if _, err = s.ConsumeInvitation(ctx, "test@example.com"); !errors.Is(err, store.ErrInvitationNotFound) {
+		t.Errorf("revoked invitation should not be used, got %v", err)
+	}
+}
+
+func TestSQLiteStore_Sessions(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	tokens := []models.RefreshToken{
+		{TokenID: "a", UserID: "user_1", SessionID: "session_a", ExpiresAt: time.Now().Add(time.Hour), AMR: []string{"pwd"}},
+		{TokenID: "b", UserID: "user_1", SessionID: "session_b", ExpiresAt: time.Now().Add(time.Hour)},
+		{TokenID: "c", UserID: "user_2", SessionID: "session_c", ExpiresAt: time.Now().Add(time.Hour)},
+		{TokenID: "expired", UserID: "user_1", SessionID: "session_expired", ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	for _, token := range tokens {
+		email := "one@example.com"
+		if token.UserID == "user_2" {
+			email = "two@example.com"
+		}
+		if err = s.Add(ctx, token, email); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+	// Rotation doesn't add a session
+	next := models.RefreshToken{TokenID: "a2", ExpiresAt: time.Now().Add(time.Hour)}
+	if _, err = s.Rotate(ctx, "a", next); err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+
+	count, err := s.CountSessions(ctx, store.SessionFilter{UserID: "user_1"})
+	if err != nil {
+		t.Fatalf("CountSessions() failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 sessions for user_1, got %d", count)
+	}
+	list, err := s.ListSessions(ctx, store.SessionFilter{Email: "two@example.com"})
+	if err != nil {
+		t.Fatalf("ListSessions() failed: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != "session_c" || list[0].UserID != "user_2" {
+		t.Errorf("unexpected sessions: %+v", list)
+	}
+
+	var pages []string
+	for offset := 0; offset < 4; offset += 2 {
+		page, err := s.ListSessions(ctx, store.SessionFilter{Limit: 2, Offset: offset})
+		if err != nil {
+			t.Fatalf("ListSessions() failed: %v", err)
+		}
+		for _, session := range page {
+			pages = append(pages, session.ID)
+		}
+	}
+	if len(pages) != 3 {
+		t.Errorf("pages should list every session once, got %v", pages)
+	}
+
+	session, err := s.GetSession(ctx, "session_a")
+	if err != nil {
+		t.Fatalf("GetSession() failed: %v", err)
+	}
+	if session.Email != "one@example.com" || len(session.AMR) != 1 || session.CreatedAt.IsZero() || session.RefreshedAt.IsZero() {
+		t.Errorf("unexpected session: %+v", session)
+	}
+	if _, err = s.GetSession(ctx, "session_expired"); !errors.Is(err, store.ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for an expired session, got %v", err)
+	}
+
+	if err = s.RemoveSession(ctx, "session_a"); err != nil {
+		t.Fatalf("RemoveSession() failed: %v", err)
+	}
+	if exists, _, _ := s.Check(ctx, "a2"); exists {
+		t.Error("refresh token of a removed session should not be valid")
+	}
+	if err = s.RemoveSession(ctx, "session_a"); !errors.Is(err, store.ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+	if exists, _, _ := s.Check(ctx, "b"); !exists {
+		t.Error("other sessions should NOT have been removed")
+	}
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func (s *sqLiteStore) GetUser(ctx context.Context, userID string) (models.Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM users WHERE id = ?`
+	return scanAccount(s.db.QueryRowContext(ctx, query, userID))
+}
+
+// GetUserByVerifiedEmail returns the oldest user who has verified the email.
+func (s *sqLiteStore) GetUserByVerifiedEmail(ctx context.Context, email string) (models.Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM users
+		WHERE email = ? AND emailVerified = 1 ORDER BY createdAt, id LIMIT 1`
+	return scanAccount(s.db.QueryRowContext(ctx, query, email))
+}
+
+// AddUserWithIdentity creates a user together with its first identity, so a failed login leaves no user behind.
+func (s *sqLiteStore) AddUserWithIdentity(ctx context.Context, user models.Account, identity models.Identity) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO users (id, email, emailVerified, name, createdAt) VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query, user.ID, user.Email, user.EmailVerified, user.Name, user.CreatedAt.Unix())
+	if err != nil {
+		return err
+	}
+	if err = addIdentity(ctx, tx, identity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetUserName sets the name of a user who has none. A name the user already has is kept.
+func (s *sqLiteStore) SetUserName(ctx context.Context, userID, name string) error {
+	query := `UPDATE users SET name = ? WHERE id = ? AND name = ''`
+	_, err := s.db.ExecContext(ctx, query, name, userID)
+	return err
+}
+
+func (s *sqLiteStore) AddIdentity(ctx context.Context, identity models.Identity) error {
+	return addIdentity(ctx, s.db, identity)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func addIdentity(ctx context.Context, db execer, identity models.Identity) error {
+	query := `INSERT INTO identities (provider, subject, userID, email, createdAt) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.ExecContext(ctx, query,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email, identity.CreatedAt.Unix(),
+	)
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrIdentityExists
+	}
+	return err
+}
+
+func (s *sqLiteStore) GetIdentity(ctx context.Context, provider, subject string) (models.Identity, error) {
+	query := `SELECT ` + identityColumns + ` FROM identities WHERE provider = ? AND subject = ?`
+	identity, err := scanIdentity(s.db.QueryRowContext(ctx, query, provider, subject))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Identity{}, ErrIdentityNotFound
+	}
+	return identity, err
+}
+
+func (s *sqLiteStore) ListIdentities(ctx context.Context, userID string) ([]models.Identity, error) {
+	query := `SELECT ` + identityColumns + ` FROM identities WHERE userID = ? ORDER BY createdAt, provider`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.Identity
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (s *sqLiteStore) RemoveIdentity(ctx context.Context, userID, provider, subject string) error {
+	query := `DELETE FROM identities WHERE userID = ? AND provider = ? AND subject = ?`
+	res, err := s.db.ExecContext(ctx, query, userID, provider, subject)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrIdentityNotFound
+	}
+	return err
+}
+
+const identityColumns = `provider, subject, userID, email, createdAt`
+
+func scanIdentity(row rowScanner) (models.Identity, error) {
+	var identity models.Identity
+	var createdAt int64
+	err := row.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &createdAt)
+	if err != nil {
+		return models.Identity{}, err
+	}
+	identity.CreatedAt = time.Unix(createdAt, 0)
+	return identity, nil
+}
+
+const accountColumns = `id, email, emailVerified, name, createdAt`
+
+func scanAccount(row rowScanner) (models.Account, error) {
+	var user models.Account
+	var createdAt int64
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Name, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Account{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.Account{}, err
+	}
+	user.CreatedAt = time.Unix(createdAt, 0)
+	return user, nil
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func (s *sqLiteStore) AddWebAuthnCredential(ctx context.Context, credential models.WebAuthnCredential) error {
+	query := `INSERT INTO webauthn_credentials (id, userID, email, publicKey, algorithm, signCount, transports, createdAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, query,
+		credential.ID, credential.UserID, credential.Email, credential.PublicKey, credential.Algorithm,
+		credential.SignCount, strings.Join(credential.Transports, ","), credential.CreatedAt.Unix(),
+	)
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrCredentialExists
+	}
+	return err
+}
+
+const webAuthnCredentialColumns = `id, userID, email, publicKey, algorithm, signCount, transports, createdAt, lastUsedAt`
+
+func (s *sqLiteStore) GetWebAuthnCredential(ctx context.Context, credentialID string) (models.WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE id = ?`
+	credential, err := scanWebAuthnCredential(s.db.QueryRowContext(ctx, query, credentialID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.WebAuthnCredential{}, ErrCredentialNotFound
+	}
+	return credential, err
+}
+
+func (s *sqLiteStore) ListWebAuthnCredentials(ctx context.Context, userID string) ([]models.WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE userID = ? ORDER BY createdAt`
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []models.WebAuthnCredential
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *sqLiteStore) UpdateWebAuthnSignCount(ctx context.Context, credentialID string, signCount uint32) error {
+	query := `UPDATE webauthn_credentials SET signCount = ?, lastUsedAt = ? WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, query, signCount, time.Now().Unix(), credentialID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrCredentialNotFound
+	}
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebAuthnCredential(row rowScanner) (models.WebAuthnCredential, error) {
+	var credential models.WebAuthnCredential
+	var transports string
+	var createdAt int64
+	var lastUsedAt sql.NullInt64
+	err := row.Scan(
+		&credential.ID, &credential.UserID, &credential.Email, &credential.PublicKey, &credential.Algorithm,
+		&credential.SignCount, &transports, &createdAt, &lastUsedAt,
+	)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	credential.Transports = splitList(transports)
+	credential.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = time.Unix(lastUsedAt.Int64, 0)
+	}
+	return credential, nil
+}
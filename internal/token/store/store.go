@@ -2,8 +2,9 @@ package store
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lattots/salpa/internal/config"
 	"github.com/lattots/salpa/internal/models"
@@ -15,21 +16,131 @@ type Store interface {
 	Check(ctx context.Context, tokenID string) (bool, models.User, error)
 	Remove(ctx context.Context, tokenID string) error
 
+	Rotate(ctx context.Context, tokenID string, next models.RefreshToken) (models.User, error)
+
 	RemoveAllForUser(ctx context.Context, userID string) error
 
+	// Sessions are the token families with a valid refresh token, one per login
+	ListSessions(ctx context.Context, filter SessionFilter) ([]models.Session, error)
+	CountSessions(ctx context.Context, filter SessionFilter) (int, error)
+	GetSession(ctx context.Context, sessionID string) (models.Session, error)
+	RemoveSession(ctx context.Context, sessionID string) error
+
+	UserStore
+	LocalUserStore
+	OneTimeTokenStore
+	WebAuthnStore
+	MFAStore
+	InvitationStore
+
 	Close() error
 }
 
+// SessionFilter selects the sessions to list. Empty fields match every session.
+type SessionFilter struct {
+	UserID string
+	Email  string
+
+	// Limit <= 0 lists every session after Offset
+	Limit  int
+	Offset int
+}
+
+// UserStore holds the Salpa users and the provider identities linked to them.
+type UserStore interface {
+	GetUser(ctx context.Context, userID string) (models.Account, error)
+	GetUserByVerifiedEmail(ctx context.Context, email string) (models.Account, error)
+	AddUserWithIdentity(ctx context.Context, user models.Account, identity models.Identity) error
+	// SetUserName keeps the name the user already has
+	SetUserName(ctx context.Context, userID, name string) error
+
+	AddIdentity(ctx context.Context, identity models.Identity) error
+	GetIdentity(ctx context.Context, provider, subject string) (models.Identity, error)
+	ListIdentities(ctx context.Context, userID string) ([]models.Identity, error)
+	RemoveIdentity(ctx context.Context, userID, provider, subject string) error
+}
+
+// LocalUserStore holds the accounts of the password provider in the same database as the sessions.
+type LocalUserStore interface {
+	AddLocalUser(ctx context.Context, user models.LocalUser) error
+	GetLocalUserByEmail(ctx context.Context, email string) (models.LocalUser, error)
+	UpdateLocalUserPassword(ctx context.Context, userID, passwordHash string) error
+	// SetLocalUserEmailVerified returns the account, which moves to the user who already has the verified email
+	SetLocalUserEmailVerified(ctx context.Context, userID string) (models.LocalUser, error)
+}
+
+// OneTimeTokenStore holds single use tokens, e.g. password reset and email verification tokens.
+type OneTimeTokenStore interface {
+	AddOneTimeToken(ctx context.Context, token models.OneTimeToken) error
+	// ConsumeOneTimeToken removes and returns a valid token, so it can only be used once
+	ConsumeOneTimeToken(ctx context.Context, hash, purpose string) (models.OneTimeToken, error)
+	// ExpireOneTimeTokens invalidates the user's tokens but keeps them for CountOneTimeTokens
+	ExpireOneTimeTokens(ctx context.Context, userID, purpose string) error
+	// CountOneTimeTokens counts the tokens sent to the email since the given time, used or not
+	CountOneTimeTokens(ctx context.Context, email, purpose string, since time.Time) (int, error)
+}
+
+// WebAuthnStore holds the passkeys of users.
+type WebAuthnStore interface {
+	AddWebAuthnCredential(ctx context.Context, credential models.WebAuthnCredential) error
+	GetWebAuthnCredential(ctx context.Context, credentialID string) (models.WebAuthnCredential, error)
+	ListWebAuthnCredentials(ctx context.Context, userID string) ([]models.WebAuthnCredential, error)
+	// UpdateWebAuthnSignCount stores the counter of a successful assertion and marks the credential used
+	UpdateWebAuthnSignCount(ctx context.Context, credentialID string, signCount uint32) error
+}
+
+// MFAStore holds the second factors of users: TOTP enrollments and their backup codes.
+type MFAStore interface {
+	SetTOTPEnrollment(ctx context.Context, enrollment models.TOTPEnrollment) error
+	GetTOTPEnrollment(ctx context.Context, userID string) (models.TOTPEnrollment, error)
+	ConfirmTOTPEnrollment(ctx context.Context, userID string) error
+	// UseTOTPStep returns ErrTokenReused if a code of the same or a later time step has been accepted
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	// AddTOTPFailure counts a wrong code, the failure that reaches maxFailures locks the codes until lockUntil
+	AddTOTPFailure(ctx context.Context, userID string, maxFailures int, lockUntil time.Time) error
+	ResetTOTPFailures(ctx context.Context, userID string) error
+	RemoveTOTPEnrollment(ctx context.Context, userID string) error
+
+	// Backup codes are stored hashed and each can be used once
+	ReplaceBackupCodes(ctx context.Context, userID string, hashes []string) error
+	ConsumeBackupCode(ctx context.Context, userID, hash string) error
+}
+
+// InvitationStore holds the invitations of invite only sign-ups.
+type InvitationStore interface {
+	AddInvitation(ctx context.Context, invitation models.Invitation) error
+	// ConsumeInvitation marks a valid invitation of the email used and returns it
+	ConsumeInvitation(ctx context.Context, email string) (models.Invitation, error)
+	ListInvitations(ctx context.Context) ([]models.Invitation, error)
+	RemoveInvitation(ctx context.Context, id string) error
+}
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenReused   = errors.New("token has already been used")
+	ErrTokenRotated  = errors.New("token was rotated by a concurrent request")
+
+	ErrSessionNotFound = errors.New("session not found")
+
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityExists   = errors.New("identity is already linked")
+
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrCredentialExists   = errors.New("credential already exists")
+
+	ErrInvitationNotFound = errors.New("invitation not found")
+)
+
 func CreateStore(conf config.StoreConfig) (Store, error) {
 	var store Store
 	var err error
 	switch conf.Driver {
 	case "sqlite":
-		db, err := sql.Open("sqlite3", conf.ConnectionString)
-		if err != nil {
-			return nil, err
-		}
-		store, err = NewSQLiteStore(db)
+		// Initializing creates and migrates the schema if needed
+		store, err = InitSQLiteStore(conf.ConnectionString)
 		if err != nil {
 			return nil, err
 		}
@@ -41,8 +152,10 @@ func CreateStore(conf config.StoreConfig) (Store, error) {
 }
 
 type storeUser struct {
-	id    string
-	email string
+	id     string
+	email  string
+	amr    []string
+	claims models.SessionClaims
 }
 
 func (u storeUser) GetID() string {
@@ -52,3 +165,11 @@ func (u storeUser) GetID() string {
 func (u storeUser) GetEmail() string {
 	return u.email
 }
+
+func (u storeUser) GetAMR() []string {
+	return u.amr
+}
+
+func (u storeUser) GetClaims() models.SessionClaims {
+	return u.claims
+}
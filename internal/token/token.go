@@ -2,6 +2,7 @@ package token
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -9,4 +10,11 @@ import (
 var (
 	ErrTokenInvalid   = errors.New("Token invalid")
 	ErrTokenMalformed = jwt.ErrTokenMalformed
+
+	// ErrTokenReused wraps ErrTokenInvalid, so callers that only care about validity don't need to check for it
+	ErrTokenReused = fmt.Errorf("%w: refresh token has already been used", ErrTokenInvalid)
+	// ErrTokenRotated means another request rotated the token at the same time. The session is left as it is
+	ErrTokenRotated = errors.New("refresh token was rotated by a concurrent request")
+
+	ErrSessionNotFound = errors.New("session not found")
 )
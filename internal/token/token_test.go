@@ -1,13 +1,21 @@
 package token_test
 
 import (
+	"context"
 	"crypto/ed25519"
 	"errors"
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
 	"github.com/lattots/salpa/internal/token"
 	"github.com/lattots/salpa/internal/token/store"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 const testDBFilename = "./testStore.db"
@@ -62,6 +70,102 @@ func TestInvalidRefreshToken(t *testing.T) {
 	}
 }
 
+func TestRevokeRefreshToken(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	refreshToken, err := manager.NewRefreshToken("ijkl", "revoked@test.com")
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+
+	if err = manager.RevokeRefreshToken(refreshToken.TokenID); err != nil {
+		t.Fatalf("failed to revoke refresh token: %s\n", err)
+	}
+
+	_, err = manager.VerifyRefreshToken(refreshToken.TokenID)
+	if !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("expected %s got %s\n", token.ErrTokenInvalid, err)
+	}
+}
+
+func TestRevokeAllRefreshTokens(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	first, _ := manager.NewRefreshToken("mnop", "user@test.com")
+	second, _ := manager.NewRefreshToken("mnop", "user@test.com")
+	other, _ := manager.NewRefreshToken("qrst", "other@test.com")
+
+	user, err := manager.RevokeAllRefreshTokens(first.TokenID)
+	if err != nil {
+		t.Fatalf("failed to revoke refresh tokens: %s\n", err)
+	}
+	if user.GetID() != "mnop" {
+		t.Errorf("wrong user ID, want %s got %s\n", "mnop", user.GetID())
+	}
+
+	if _, err = manager.VerifyRefreshToken(second.TokenID); !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("expected %s got %s\n", token.ErrTokenInvalid, err)
+	}
+	if _, err = manager.VerifyRefreshToken(other.TokenID); err != nil {
+		t.Errorf("other user's refresh token should still be valid, got %s\n", err)
+	}
+
+	_, err = manager.RevokeAllRefreshTokens(first.TokenID)
+	if !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("expected %s got %s\n", token.ErrTokenInvalid, err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	first, err := manager.NewRefreshToken("uvwx", "rotate@test.com")
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+
+	second, err := manager.RotateRefreshToken(first.TokenID)
+	if err != nil {
+		t.Fatalf("failed to rotate refresh token: %s\n", err)
+	}
+	if second.TokenID == first.TokenID {
+		t.Error("rotation should issue a new token ID")
+	}
+	if second.UserID != "uvwx" {
+		t.Errorf("wrong user ID in rotated token, want %s got %s\n", "uvwx", second.UserID)
+	}
+
+	_, err = manager.RotateRefreshToken(first.TokenID)
+	if !errors.Is(err, token.ErrTokenReused) {
+		t.Errorf("expected %s got %s\n", token.ErrTokenReused, err)
+	}
+	if !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("reused token error should also be %s\n", token.ErrTokenInvalid)
+	}
+
+	if _, err = manager.VerifyRefreshToken(second.TokenID); !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("reuse should revoke the whole family, got %v\n", err)
+	}
+}
+
 func TestAccessToken(t *testing.T) {
 	t.Cleanup(cleanup)
 
@@ -95,6 +199,93 @@ func TestAccessToken(t *testing.T) {
 	}
 }
 
+func TestAccessTokenKeyID(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	refreshToken, err := manager.NewRefreshToken("yzab", "kid@test.com")
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+	accessToken, _, err := manager.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(accessToken, &models.UserClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := manager.JWKS()
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("expected 1 key in JWKS, got %d\n", len(jwks.Keys))
+	}
+	if kid := parsed.Header["kid"]; kid != jwks.Keys[0].KeyID {
+		t.Errorf("wrong kid in token header, want %s got %v\n", jwks.Keys[0].KeyID, kid)
+	}
+
+	pub, err := jwks.Keys[0].Ed25519PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(manager.PublicKeys()[0]) {
+		t.Error("JWKS key doesn't match the access token public key")
+	}
+}
+
+func TestAccessTokenRegisteredClaims(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.SystemConfiguration{
+		Service: config.ServiceConfiguration{
+			PrivateKeyFilename: filepath.Join(t.TempDir(), "private_key"),
+			ServiceDomain:      "https://auth.test.com",
+			AppDomain:          "https://app.test.com",
+		},
+	}
+	manager, err := token.NewManagerFromConf(conf, s)
+	if err != nil {
+		t.Fatalf("failed to create token manager: %s\n", err)
+	}
+	defer manager.Close()
+
+	refreshToken, _ := manager.NewRefreshToken("ghij", "claims@test.com")
+	accessToken, _, err := manager.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := manager.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "https://auth.test.com" {
+		t.Errorf("issuer should default to service domain, got %s\n", claims.Issuer)
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != "https://app.test.com" {
+		t.Errorf("audience should default to app domain, got %v\n", claims.Audience)
+	}
+	if claims.IssuedAt == nil || claims.NotBefore == nil || claims.ID == "" {
+		t.Error("access token is missing iat, nbf or jti\n")
+	}
+
+	other, _, _ := manager.NewAccessToken(refreshToken.TokenID)
+	otherClaims, _ := manager.VerifyAccessToken(other)
+	if otherClaims.ID == claims.ID {
+		t.Error("every access token should have a unique jti\n")
+	}
+}
+
 func TestInvalidAccessToken(t *testing.T) {
 	t.Cleanup(cleanup)
 
@@ -138,3 +329,263 @@ func initManager() *token.Manager {
 
 	return token.NewManager(s, privKey)
 }
+
+func TestSigningKeyRotation(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	refreshToken, err := manager.NewRefreshToken("cdef", "rotation@test.com")
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+	oldAccessToken, _, err := manager.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = manager.RotateSigningKey(); err != nil {
+		t.Fatalf("failed to rotate signing key: %s\n", err)
+	}
+
+	newAccessToken, _, err := manager.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed before the rotation must stay valid until they expire
+	if _, err = manager.VerifyAccessToken(oldAccessToken); err != nil {
+		t.Errorf("token signed with previous key should be valid, got %s\n", err)
+	}
+	if _, err = manager.VerifyAccessToken(newAccessToken); err != nil {
+		t.Errorf("token signed with current key should be valid, got %s\n", err)
+	}
+
+	if n := len(manager.JWKS().Keys); n != 2 {
+		t.Errorf("expected current and previous key in JWKS, got %d keys\n", n)
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	keyFilename := filepath.Join(t.TempDir(), "private_key")
+
+	keys, err := token.LoadKeySet(keyFilename, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create key set: %s\n", err)
+	}
+	oldKey := keys.PublicKeys()[0]
+
+	if err = keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate key set: %s\n", err)
+	}
+
+	// Reloading must restore the new current key and keep the retired key for verification
+	reloaded, err := token.LoadKeySet(keyFilename, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reload key set: %s\n", err)
+	}
+	publicKeys := reloaded.PublicKeys()
+	if len(publicKeys) != 2 {
+		t.Fatalf("expected 2 keys after reload, got %d\n", len(publicKeys))
+	}
+	if !publicKeys[0].Equal(keys.PublicKeys()[0]) {
+		t.Error("reloaded current key doesn't match the rotated key")
+	}
+	if !publicKeys[1].Equal(oldKey) {
+		t.Error("reloaded previous key doesn't match the retired key")
+	}
+
+	// Retired keys past the retention period are dropped
+	expired, err := token.LoadKeySet(keyFilename, 0)
+	if err != nil {
+		t.Fatalf("failed to reload key set: %s\n", err)
+	}
+	if n := len(expired.PublicKeys()); n != 1 {
+		t.Errorf("expected only the current key, got %d keys\n", n)
+	}
+}
+
+func TestAccessTokenAMR(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	first, err := manager.NewRefreshToken("amr1", "amr@test.com", models.AMRPassword, models.AMROTP, models.AMRMFA)
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+	// Authentication methods of the login stay with the session when it's refreshed
+	second, err := manager.RotateRefreshToken(first.TokenID)
+	if err != nil {
+		t.Fatalf("failed to rotate refresh token: %s\n", err)
+	}
+
+	accessToken, _, err := manager.NewAccessToken(second.TokenID)
+	if err != nil {
+		t.Fatalf("failed to create access token: %s\n", err)
+	}
+	claims, err := manager.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %s\n", err)
+	}
+	want := []string{models.AMRPassword, models.AMROTP, models.AMRMFA}
+	if len(claims.AMR) != len(want) {
+		t.Fatalf("wrong amr claim, want %v got %v\n", want, claims.AMR)
+	}
+	for i := range want {
+		if claims.AMR[i] != want[i] {
+			t.Errorf("wrong amr claim, want %v got %v\n", want, claims.AMR)
+		}
+	}
+}
+
+func TestAccessTokenExtraClaims(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+
+	sessionClaims := models.SessionClaims{
+		Roles:  []string{"admin", "user"},
+		Groups: []string{"staff"},
+		Extra:  map[string]any{"tenantID": "tenant-1", "email": "spoofed@test.com"},
+	}
+	first, err := manager.NewRefreshTokenWithClaims("claims1", "claims@test.com", sessionClaims, models.AMRFederated)
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+	// Claims of the login stay with the session when it's refreshed
+	second, err := manager.RotateRefreshToken(first.TokenID)
+	if err != nil {
+		t.Fatalf("failed to rotate refresh token: %s\n", err)
+	}
+
+	accessToken, _, err := manager.NewAccessToken(second.TokenID)
+	if err != nil {
+		t.Fatalf("failed to create access token: %s\n", err)
+	}
+	claims, err := manager.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %s\n", err)
+	}
+	if !slices.Equal(claims.Roles, sessionClaims.Roles) || !slices.Equal(claims.Groups, sessionClaims.Groups) {
+		t.Errorf("wrong roles or groups: %v %v\n", claims.Roles, claims.Groups)
+	}
+	if !claims.HasRole("admin") || claims.HasRole("auditor") {
+		t.Errorf("wrong HasRole result for roles %v\n", claims.Roles)
+	}
+	if claims.Extra["tenantID"] != "tenant-1" {
+		t.Errorf("wrong tenantID claim: %v\n", claims.Extra)
+	}
+	// Extra claims can't replace the ones Salpa sets
+	if claims.Email != "claims@test.com" || claims.UserID != "claims1" {
+		t.Errorf("extra claims replaced user claims: %+v\n", claims)
+	}
+	if _, ok := claims.Extra["email"]; ok {
+		t.Errorf("reserved claim in extra claims: %v\n", claims.Extra)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	manager := initManager()
+	if manager == nil {
+		t.Fatal("failed to initialize token manager\n")
+	}
+	defer manager.Close()
+	ctx := context.Background()
+
+	refreshToken, err := manager.NewRefreshToken("abcd", "user@test.com", "pwd")
+	if err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+	if _, err = manager.NewRefreshToken("efgh", "other@test.com"); err != nil {
+		t.Fatalf("failed to create refresh token: %s\n", err)
+	}
+
+	sessions, total, err := manager.ListSessions(ctx, store.SessionFilter{UserID: "abcd"})
+	if err != nil {
+		t.Fatalf("failed to list sessions: %s\n", err)
+	}
+	if total != 1 || len(sessions) != 1 || sessions[0].ID != refreshToken.SessionID {
+		t.Fatalf("unexpected sessions: %+v\n", sessions)
+	}
+	// Refresh tokens are secrets, admins only see session IDs
+	if sessions[0].ID == refreshToken.TokenID {
+		t.Error("session ID should not be the refresh token\n")
+	}
+
+	rotated, err := manager.RotateRefreshToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatalf("failed to rotate refresh token: %s\n", err)
+	}
+	session, err := manager.GetSession(ctx, refreshToken.SessionID)
+	if err != nil {
+		t.Fatalf("session should survive rotation: %s\n", err)
+	}
+	if session.UserID != "abcd" || !slices.Equal(session.AMR, []string{"pwd"}) {
+		t.Errorf("unexpected session: %+v\n", session)
+	}
+
+	if err = manager.RevokeSession(ctx, refreshToken.SessionID); err != nil {
+		t.Fatalf("failed to revoke session: %s\n", err)
+	}
+	if _, err = manager.VerifyRefreshToken(rotated.TokenID); !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("refresh token of a revoked session should be invalid, got %v\n", err)
+	}
+	if _, err = manager.GetSession(ctx, refreshToken.SessionID); !errors.Is(err, token.ErrSessionNotFound) {
+		t.Errorf("expected %s, got %v\n", token.ErrSessionNotFound, err)
+	}
+}
+
+func TestAccessTokenAudience(t *testing.T) {
+	t.Cleanup(cleanup)
+
+	s, err := store.InitSQLiteStore(testDBFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFilename := filepath.Join(t.TempDir(), "private_key")
+	newManager := func(appDomain string) *token.Manager {
+		conf := config.SystemConfiguration{
+			Service: config.ServiceConfiguration{
+				PrivateKeyFilename: keyFilename,
+				ServiceDomain:      "https://auth.test.com",
+				AppDomain:          appDomain,
+			},
+		}
+		manager, err := token.NewManagerFromConf(conf, s)
+		if err != nil {
+			t.Fatalf("failed to create token manager: %s\n", err)
+		}
+		return manager
+	}
+	manager := newManager("https://app.test.com")
+	defer manager.Close()
+	// Same signing key and issuer, but tokens for another application
+	other := newManager("https://other.test.com")
+
+	refreshToken, _ := other.NewRefreshToken("ghij", "claims@test.com")
+	accessToken, _, err := other.NewAccessToken(refreshToken.TokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.VerifyAccessToken(accessToken); err != nil {
+		t.Fatalf("token should be valid for its own audience: %s\n", err)
+	}
+	if _, err = manager.VerifyAccessToken(accessToken); !errors.Is(err, token.ErrTokenInvalid) {
+		t.Errorf("token for another audience should be invalid, got %v\n", err)
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"errors"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/lattots/salpa/internal/models"
+)
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail lowercases the address, so emails are compared case-insensitively.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	// Display names and comments are not part of an email address
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// ProviderEmail returns the normalized email of the provider user and whether the provider has verified it.
+func ProviderEmail(providerUser models.User) (string, bool) {
+	email, err := NormalizeEmail(providerUser.GetEmail())
+	if err != nil {
+		// Some providers return no email or a username instead, it's kept as is but never trusted
+		return providerUser.GetEmail(), false
+	}
+	verifiedUser, ok := providerUser.(models.VerifiedEmailUser)
+	return email, ok && verifiedUser.IsEmailVerified()
+}
+
+// AddQuery adds values to the query of rawURL, keeping the query parameters it already has.
+// Empty values are left out.
+func AddQuery(rawURL string, values url.Values) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, vs := range values {
+		for _, v := range vs {
+			if v != "" {
+				query.Add(key, v)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// NewOneTimeToken returns a random token to send to the user and the hash to store.
+func NewOneTimeToken() (string, string) {
+	token := rand.Text()
+	return token, HashOneTimeToken(token)
+}
+
+// Tokens have 128 bits of entropy, so a fast unsalted hash is enough
+func HashOneTimeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
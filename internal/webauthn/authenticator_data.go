@@ -0,0 +1,70 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Authenticator data flags (WebAuthn Level 2, 6.1)
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Only present in registration responses
+	credentialID []byte
+	publicKey    crypto.PublicKey
+	algorithm    int64
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	// rpIdHash (32), flags (1) and signCount (4)
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data is too short")
+	}
+	authData := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return authData, nil
+	}
+
+	// aaguid (16), credentialIdLength (2), credentialId and credentialPublicKey
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength > 1023 || len(rest) < idLength {
+		return authenticatorData{}, errors.New("invalid credential ID length")
+	}
+	authData.credentialID = bytes.Clone(rest[:idLength])
+
+	// Extensions may follow the key, which is why the decoder returns the rest of the data
+	coseKey, _, err := decodeCBOR(rest[idLength:])
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("error decoding credential public key: %w", err)
+	}
+	keyMap, ok := coseKey.(map[any]any)
+	if !ok {
+		return authenticatorData{}, errors.New("credential public key is not a map")
+	}
+	authData.publicKey, authData.algorithm, err = parseCOSEKey(keyMap)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	return authData, nil
+}
@@ -0,0 +1,101 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) Salpa accepts for credentials
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+// Algorithms offered to authenticators in order of preference
+var supportedAlgorithms = []int64{algES256, algEdDSA, algRS256}
+
+// COSE key parameters (RFC 9052)
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// parseCOSEKey returns the public key and algorithm of a COSE_Key.
+func parseCOSEKey(key map[any]any) (crypto.PublicKey, int64, error) {
+	kty, _ := key[int64(coseKeyType)].(int64)
+	alg, _ := key[int64(coseAlgorithm)].(int64)
+
+	switch {
+	case alg == algES256 && kty == coseKeyTypeEC2:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		// crypto/ecdh checks the point is on the curve
+		uncompressed := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(uncompressed); err != nil {
+			return nil, 0, fmt.Errorf("invalid P-256 key: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, alg, nil
+	case alg == algEdDSA && kty == coseKeyTypeOKP:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case alg == algRS256 && kty == coseKeyTypeRSA:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+}
+
+// verifySignature checks an assertion signature made with the credential's algorithm.
+func verifySignature(alg int64, publicKey crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch alg {
+	case algES256:
+		pub, ok := publicKey.(*ecdsa.PublicKey)
+		if ok && ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return nil
+		}
+	case algEdDSA:
+		pub, ok := publicKey.(ed25519.PublicKey)
+		if ok && ed25519.Verify(pub, data, signature) {
+			return nil
+		}
+	case algRS256:
+		pub, ok := publicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+	return errors.New("invalid signature")
+}
@@ -0,0 +1,486 @@
+package webauthn
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lattots/salpa/internal/config"
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/util"
+)
+
+// Store is the part of the token store the passkey provider uses.
+type Store interface {
+	store.WebAuthnStore
+	store.OneTimeTokenStore
+	store.UserStore
+}
+
+// Settings of the relying party.
+type Settings struct {
+	// Domain the passkeys are bound to. It must be the host of the origins or a parent domain of it.
+	RPID   string
+	RPName string
+	// Origins of the pages that run the ceremonies, e.g. https://app.example.com
+	Origins []string
+	// required, preferred or discouraged
+	UserVerification string
+	Timeout          time.Duration
+}
+
+// Provider runs the registration and authentication ceremonies of passkeys (Web Authentication Level 2).
+type Provider struct {
+	store    Store
+	settings Settings
+}
+
+// Purposes of the one-time tokens that hold the ceremony challenges
+const (
+	purposeRegistration   = "webauthn_registration"
+	purposeAuthentication = "webauthn_authentication"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+var ErrVerificationFailed = errors.New("passkey verification failed")
+
+func NewProviderFromConf(conf config.SystemConfiguration, s Store) (*Provider, error) {
+	settings := Settings{
+		RPID:             conf.WebAuthn.RPID,
+		RPName:           conf.WebAuthn.RPName,
+		Origins:          conf.WebAuthn.Origins,
+		UserVerification: conf.WebAuthn.UserVerification,
+		Timeout:          conf.WebAuthn.Timeout,
+	}
+
+	// The ceremonies run on the pages of the client application by default
+	if settings.RPID == "" {
+		appURL, err := url.Parse(conf.Service.AppDomain)
+		if err != nil || appURL.Hostname() == "" {
+			return nil, errors.New("no rpID set and it can't be derived from the app domain")
+		}
+		settings.RPID = appURL.Hostname()
+	}
+	if settings.RPName == "" {
+		settings.RPName = settings.RPID
+	}
+	if len(settings.Origins) == 0 {
+		settings.Origins = []string{conf.Service.AppDomain}
+	}
+
+	return NewProvider(s, settings)
+}
+
+func NewProvider(s Store, settings Settings) (*Provider, error) {
+	switch settings.UserVerification {
+	case "":
+		settings.UserVerification = "preferred"
+	case "required", "preferred", "discouraged":
+	default:
+		return nil, fmt.Errorf("invalid userVerification: %s", settings.UserVerification)
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = defaultTimeout
+	}
+	return &Provider{store: s, settings: settings}, nil
+}
+
+// Options are serialized the way PublicKeyCredential.parseCreationOptionsFromJSON and
+// parseRequestOptionsFromJSON expect them, binary values are base64url encoded.
+
+type CreationOptions struct {
+	PublicKey PublicKeyCredentialCreationOptions `json:"publicKey"`
+}
+
+type PublicKeyCredentialCreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+type RequestOptions struct {
+	PublicKey PublicKeyCredentialRequestOptions `json:"publicKey"`
+}
+
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int64  `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+// BeginRegistration returns the options for navigator.credentials.create for a logged in user.
+func (p *Provider) BeginRegistration(ctx context.Context, user models.User) (CreationOptions, error) {
+	// User handles are at most 64 bytes (WebAuthn Level 2, 5.4.3)
+	if len(user.GetID()) > 64 {
+		return CreationOptions{}, errors.New("user ID is too long for a passkey user handle")
+	}
+
+	challenge, err := p.newChallenge(ctx, purposeRegistration, user)
+	if err != nil {
+		return CreationOptions{}, err
+	}
+
+	// The same authenticator can't register twice for a user
+	credentials, err := p.store.ListWebAuthnCredentials(ctx, user.GetID())
+	if err != nil {
+		return CreationOptions{}, err
+	}
+	exclude := make([]CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		exclude = append(exclude, CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+
+	params := make([]CredentialParameter, 0, len(supportedAlgorithms))
+	for _, alg := range supportedAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return CreationOptions{PublicKey: PublicKeyCredentialCreationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: p.settings.RPID, Name: p.settings.RPName},
+		User: UserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString([]byte(user.GetID())),
+			Name:        user.GetEmail(),
+			DisplayName: user.GetEmail(),
+		},
+		PubKeyCredParams:   params,
+		Timeout:            p.settings.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			// Discoverable credentials let users log in without typing their email first
+			ResidentKey:      "required",
+			UserVerification: p.settings.UserVerification,
+		},
+		// Salpa doesn't restrict which authenticators can be used, so attestation statements are not needed
+		Attestation: "none",
+	}}, nil
+}
+
+type registrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// FinishRegistration verifies the response of navigator.credentials.create (PublicKeyCredential.toJSON)
+// and stores the new passkey of the user.
+func (p *Provider) FinishRegistration(ctx context.Context, user models.User, body []byte) (models.WebAuthnCredential, error) {
+	var resp registrationResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+	if resp.Type != "public-key" {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: unexpected credential type %s", ErrVerificationFailed, resp.Type)
+	}
+
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: invalid clientDataJSON", ErrVerificationFailed)
+	}
+	challengeToken, err := p.verifyClientData(ctx, clientDataJSON, "webauthn.create", purposeRegistration)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	if challengeToken.UserID != user.GetID() {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: challenge was issued to another user", ErrVerificationFailed)
+	}
+
+	attestationObject, err := decodeBase64URL(resp.Response.AttestationObject)
+	if err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: invalid attestationObject", ErrVerificationFailed)
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: attestation object is not a map", ErrVerificationFailed)
+	}
+	// Attestation statement is not verified, since attestation "none" was requested
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: no authenticator data", ErrVerificationFailed)
+	}
+
+	authData, err := p.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	if authData.credentialID == nil {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: no attested credential data", ErrVerificationFailed)
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.credentialID)
+	if rawID, err := decodeBase64URL(resp.RawID); err != nil || base64.RawURLEncoding.EncodeToString(rawID) != credentialID {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: credential ID doesn't match the authenticator data", ErrVerificationFailed)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(authData.publicKey)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	credential := models.WebAuthnCredential{
+		ID:         credentialID,
+		UserID:     user.GetID(),
+		Email:      user.GetEmail(),
+		PublicKey:  publicKey,
+		Algorithm:  authData.algorithm,
+		SignCount:  authData.signCount,
+		Transports: filterTransports(resp.Response.Transports),
+		CreatedAt:  time.Now(),
+	}
+	err = p.store.AddWebAuthnCredential(ctx, credential)
+	if errors.Is(err, store.ErrCredentialExists) {
+		return models.WebAuthnCredential{}, fmt.Errorf("%w: credential is already registered", ErrVerificationFailed)
+	}
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get. No credentials are listed,
+// so the browser offers every passkey the user has for the relying party.
+func (p *Provider) BeginLogin(ctx context.Context) (RequestOptions, error) {
+	challenge, err := p.newChallenge(ctx, purposeAuthentication, nil)
+	if err != nil {
+		return RequestOptions{}, err
+	}
+	return RequestOptions{PublicKey: PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		RPID:             p.settings.RPID,
+		Timeout:          p.settings.Timeout.Milliseconds(),
+		UserVerification: p.settings.UserVerification,
+	}}, nil
+}
+
+type assertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// FinishLogin verifies the response of navigator.credentials.get and returns the owner of the passkey.
+// The owner is the stored user, so the sign-up policy can check their email.
+// userVerified tells whether the authenticator verified the user, e.g. with a PIN or biometrics. Without it the
+// passkey only proves possession of the authenticator.
+func (p *Provider) FinishLogin(ctx context.Context, body []byte) (user models.User, userVerified bool, err error) {
+	var resp assertionResponse
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+	if resp.Type != "public-key" {
+		return nil, false, fmt.Errorf("%w: unexpected credential type %s", ErrVerificationFailed, resp.Type)
+	}
+
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: invalid clientDataJSON", ErrVerificationFailed)
+	}
+	if _, err = p.verifyClientData(ctx, clientDataJSON, "webauthn.get", purposeAuthentication); err != nil {
+		return nil, false, err
+	}
+
+	rawID, err := decodeBase64URL(resp.RawID)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: invalid credential ID", ErrVerificationFailed)
+	}
+	credential, err := p.store.GetWebAuthnCredential(ctx, base64.RawURLEncoding.EncodeToString(rawID))
+	if errors.Is(err, store.ErrCredentialNotFound) {
+		return nil, false, fmt.Errorf("%w: unknown credential", ErrVerificationFailed)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resp.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(resp.Response.UserHandle)
+		if err != nil || string(userHandle) != credential.UserID {
+			return nil, false, fmt.Errorf("%w: user handle doesn't match the credential", ErrVerificationFailed)
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: invalid authenticatorData", ErrVerificationFailed)
+	}
+	authData, err := p.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, false, err
+	}
+
+	signature, err := decodeBase64URL(resp.Response.Signature)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: invalid signature", ErrVerificationFailed)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return nil, false, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err = verifySignature(credential.Algorithm, publicKey, append(rawAuthData, clientDataHash[:]...), signature); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	// Authenticators that count signatures must count up, otherwise the credential has been cloned
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return nil, false, fmt.Errorf("%w: signature counter didn't increase", ErrVerificationFailed)
+	}
+	if err = p.store.UpdateWebAuthnSignCount(ctx, credential.ID, authData.signCount); err != nil {
+		return nil, false, err
+	}
+
+	account, err := p.store.GetUser(ctx, credential.UserID)
+	if errors.Is(err, store.ErrUserNotFound) {
+		return nil, false, fmt.Errorf("%w: user of the credential doesn't exist", ErrVerificationFailed)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return account, authData.flags&flagUserVerified != 0, nil
+}
+
+// newChallenge stores a random challenge for one ceremony. The challenge expires with the ceremony timeout.
+func (p *Provider) newChallenge(ctx context.Context, purpose string, user models.User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+
+	token := models.OneTimeToken{
+		Hash:      util.HashOneTimeToken(challenge),
+		Purpose:   purpose,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(p.settings.Timeout),
+	}
+	if user != nil {
+		token.UserID = user.GetID()
+		token.Email = user.GetEmail()
+	}
+	if err := p.store.AddOneTimeToken(ctx, token); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the ceremony type and origin, and uses up the challenge the client signed.
+func (p *Provider) verifyClientData(ctx context.Context, clientDataJSON []byte, ceremony, purpose string) (models.OneTimeToken, error) {
+	var clientData collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return models.OneTimeToken{}, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+	if clientData.Type != ceremony {
+		return models.OneTimeToken{}, fmt.Errorf("%w: unexpected client data type %s", ErrVerificationFailed, clientData.Type)
+	}
+	if !slices.Contains(p.settings.Origins, clientData.Origin) {
+		return models.OneTimeToken{}, fmt.Errorf("%w: origin %s is not allowed", ErrVerificationFailed, clientData.Origin)
+	}
+
+	token, err := p.store.ConsumeOneTimeToken(ctx, util.HashOneTimeToken(clientData.Challenge), purpose)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		return models.OneTimeToken{}, fmt.Errorf("%w: unknown or expired challenge", ErrVerificationFailed)
+	}
+	return token, err
+}
+
+// verifyAuthenticatorData checks the data was made for this relying party with the user present.
+func (p *Provider) verifyAuthenticatorData(rawAuthData []byte) (authenticatorData, error) {
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(p.settings.RPID))
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rpIDHash[:]) != 1 {
+		return authenticatorData{}, fmt.Errorf("%w: credential belongs to another relying party", ErrVerificationFailed)
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user was not present", ErrVerificationFailed)
+	}
+	if p.settings.UserVerification == "required" && authData.flags&flagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user was not verified", ErrVerificationFailed)
+	}
+	return authData, nil
+}
+
+// Transports are only hints for the browser, unknown values are dropped
+var knownTransports = []string{"ble", "hybrid", "internal", "nfc", "smart-card", "usb"}
+
+func filterTransports(transports []string) []string {
+	var filtered []string
+	for _, t := range transports {
+		if slices.Contains(knownTransports, t) && !slices.Contains(filtered, t) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// decodeBase64URL accepts base64url with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
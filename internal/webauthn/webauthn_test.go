@@ -0,0 +1,331 @@
+package webauthn_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/internal/token/store"
+	"github.com/lattots/salpa/internal/webauthn"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+func initProvider(t *testing.T) *webauthn.Provider {
+	tokenStore, err := store.InitSQLiteStore(filepath.Join(t.TempDir(), "testStore.db"))
+	if err != nil {
+		t.Fatalf("error initializing store: %s\n", err)
+	}
+	t.Cleanup(func() { tokenStore.Close() })
+
+	// Passkeys are added to existing users
+	for _, user := range []models.Account{
+		{ID: "user-1", Email: "alice@example.com", EmailVerified: true, CreatedAt: time.Now()},
+		{ID: "user-2", Email: "bob@example.com", EmailVerified: true, CreatedAt: time.Now()},
+	} {
+		identity := models.Identity{Provider: "google", Subject: user.ID, UserID: user.ID, Email: user.Email, CreatedAt: time.Now()}
+		if err = tokenStore.AddUserWithIdentity(context.Background(), user, identity); err != nil {
+			t.Fatalf("error adding user: %s\n", err)
+		}
+	}
+
+	provider, err := webauthn.NewProvider(tokenStore, webauthn.Settings{
+		RPID:    testRPID,
+		RPName:  "Example",
+		Origins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("error creating provider: %s\n", err)
+	}
+	return provider
+}
+
+// cborPair keeps map entries in order, so the encoding is deterministic
+type cborPair struct {
+	key, value any
+}
+
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := head(5, uint64(len(v)))
+		for _, p := range v {
+			out = append(out, encodeCBOR(p.key)...)
+			out = append(out, encodeCBOR(p.value)...)
+		}
+		return out
+	}
+	panic("unsupported CBOR value")
+}
+
+// authenticator is a software ES256 authenticator holding a single passkey.
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	origin       string
+	// Authenticator without a PIN or biometrics, it only checks the user is present
+	noVerification bool
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &authenticator{key: key, credentialID: credentialID, origin: testOrigin}
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], 0x01|0x04)
+	if a.noVerification {
+		data[32] = 0x01
+	}
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+
+	data[32] |= 0x40
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, encodeCBOR([]cborPair{
+		{1, 2},  // kty: EC2
+		{3, -7}, // alg: ES256
+		{-1, 1}, // crv: P-256
+		{-2, a.key.PublicKey.X.FillBytes(make([]byte, 32))},
+		{-3, a.key.PublicKey.Y.FillBytes(make([]byte, 32))},
+	})...)
+}
+
+func (a *authenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+func (a *authenticator) create(options webauthn.CreationOptions) []byte {
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	attestationObject := encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(true)},
+	})
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.PublicKey.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+			"transports":        []string{"internal", "unknown"},
+		},
+	})
+	return body
+}
+
+func (a *authenticator) get(t *testing.T, options webauthn.RequestOptions) []byte {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", options.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("error signing assertion: %s\n", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+func register(t *testing.T, provider *webauthn.Provider, a *authenticator, user models.User) models.WebAuthnCredential {
+	ctx := context.Background()
+	options, err := provider.BeginRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("error beginning registration: %s\n", err)
+	}
+	credential, err := provider.FinishRegistration(ctx, user, a.create(options))
+	if err != nil {
+		t.Fatalf("error finishing registration: %s\n", err)
+	}
+	return credential
+}
+
+func login(t *testing.T, provider *webauthn.Provider, a *authenticator) (models.User, error) {
+	user, _, err := loginVerified(t, provider, a)
+	return user, err
+}
+
+func loginVerified(t *testing.T, provider *webauthn.Provider, a *authenticator) (models.User, bool, error) {
+	options, err := provider.BeginLogin(context.Background())
+	if err != nil {
+		t.Fatalf("error beginning login: %s\n", err)
+	}
+	return provider.FinishLogin(context.Background(), a.get(t, options))
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	user := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+
+	credential := register(t, provider, a, user)
+	if credential.UserID != user.ID || credential.Email != user.Email {
+		t.Errorf("credential belongs to %s (%s), expected %s\n", credential.UserID, credential.Email, user.ID)
+	}
+	if len(credential.Transports) != 1 || credential.Transports[0] != "internal" {
+		t.Errorf("unexpected transports: %v\n", credential.Transports)
+	}
+
+	loggedIn, err := login(t, provider, a)
+	if err != nil {
+		t.Fatalf("error logging in: %s\n", err)
+	}
+	if loggedIn.GetID() != user.ID || loggedIn.GetEmail() != user.Email {
+		t.Errorf("logged in as %s, expected %s\n", loggedIn.GetID(), user.ID)
+	}
+
+	// Registered credentials are excluded from new registrations
+	options, err := provider.BeginRegistration(context.Background(), user)
+	if err != nil {
+		t.Fatalf("error beginning registration: %s\n", err)
+	}
+	if len(options.PublicKey.ExcludeCredentials) != 1 || options.PublicKey.ExcludeCredentials[0].ID != credential.ID {
+		t.Errorf("unexpected excluded credentials: %v\n", options.PublicKey.ExcludeCredentials)
+	}
+}
+
+func TestPasskeyChallengeIsSingleUse(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	register(t, provider, a, models.LocalUser{ID: "user-1", Email: "alice@example.com"})
+
+	options, err := provider.BeginLogin(context.Background())
+	if err != nil {
+		t.Fatalf("error beginning login: %s\n", err)
+	}
+	body := a.get(t, options)
+	if _, _, err = provider.FinishLogin(context.Background(), body); err != nil {
+		t.Fatalf("error logging in: %s\n", err)
+	}
+	if _, _, err = provider.FinishLogin(context.Background(), body); !errors.Is(err, webauthn.ErrVerificationFailed) {
+		t.Errorf("expected replayed assertion to fail, got: %v\n", err)
+	}
+}
+
+func TestPasskeyRejectsWrongOrigin(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	register(t, provider, a, models.LocalUser{ID: "user-1", Email: "alice@example.com"})
+
+	a.origin = "https://evil.example.net"
+	if _, err := login(t, provider, a); !errors.Is(err, webauthn.ErrVerificationFailed) {
+		t.Errorf("expected login from another origin to fail, got: %v\n", err)
+	}
+}
+
+func TestPasskeyRejectsSignCountRegression(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	register(t, provider, a, models.LocalUser{ID: "user-1", Email: "alice@example.com"})
+
+	a.signCount = 10
+	if _, err := login(t, provider, a); err != nil {
+		t.Fatalf("error logging in: %s\n", err)
+	}
+
+	// A clone of the authenticator has an older counter
+	a.signCount = 5
+	if _, err := login(t, provider, a); !errors.Is(err, webauthn.ErrVerificationFailed) {
+		t.Errorf("expected login with a lower sign count to fail, got: %v\n", err)
+	}
+}
+
+func TestPasskeyRegistrationChallengeIsBoundToUser(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	alice := models.LocalUser{ID: "user-1", Email: "alice@example.com"}
+	bob := models.LocalUser{ID: "user-2", Email: "bob@example.com"}
+
+	options, err := provider.BeginRegistration(context.Background(), alice)
+	if err != nil {
+		t.Fatalf("error beginning registration: %s\n", err)
+	}
+	_, err = provider.FinishRegistration(context.Background(), bob, a.create(options))
+	if !errors.Is(err, webauthn.ErrVerificationFailed) {
+		t.Errorf("expected registration with another user's challenge to fail, got: %v\n", err)
+	}
+}
+
+func TestPasskeyUserVerification(t *testing.T) {
+	provider := initProvider(t)
+	a := newAuthenticator(t)
+	register(t, provider, a, models.LocalUser{ID: "user-1", Email: "alice@example.com"})
+
+	_, verified, err := loginVerified(t, provider, a)
+	if err != nil {
+		t.Fatalf("error logging in: %s\n", err)
+	}
+	if !verified {
+		t.Error("login should be user verified\n")
+	}
+
+	// userVerification defaults to preferred, so the login succeeds without it
+	a.noVerification = true
+	_, verified, err = loginVerified(t, provider, a)
+	if err != nil {
+		t.Fatalf("error logging in: %s\n", err)
+	}
+	if verified {
+		t.Error("login without the UV flag should not be user verified\n")
+	}
+}
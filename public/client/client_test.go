@@ -2,15 +2,23 @@ package client_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/lattots/salpa/internal/models"
 	"github.com/lattots/salpa/public/client"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestGetVerificationKey(t *testing.T) {
@@ -57,3 +65,200 @@ func TestGetVerificationKey(t *testing.T) {
 		t.Errorf("Keys do not match.\nExpected: %x\nGot:      %x", pubKey, fetchedKey)
 	}
 }
+
+// mockJWKSServer publishes the given keys and counts how many times they have been fetched.
+type mockJWKSServer struct {
+	mu      sync.Mutex
+	keys    []ed25519.PublicKey
+	fetches int
+}
+
+func (s *mockJWKSServer) setKeys(keys ...ed25519.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *mockJWKSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+
+	var jwks models.JWKSet
+	for _, key := range s.keys {
+		jwks.Keys = append(jwks.Keys, models.NewEd25519JWK(key))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
+}
+
+func signTestToken(t *testing.T, priv ed25519.PrivateKey, issuer string) string {
+	t.Helper()
+	claims := models.NewUserClaims("123", "user@test.com", time.Minute)
+	claims.Issuer = issuer
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = models.Ed25519KeyID(priv.Public().(ed25519.PublicKey))
+	signed, err := token.SignedString(priv)
+	if err != nil {
+		t.Fatalf("failed to sign test token: %s", err)
+	}
+	return signed
+}
+
+func TestVerifyTokenAfterKeyRotation(t *testing.T) {
+	oldPub, oldPriv, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := &mockJWKSServer{}
+	jwksServer.setKeys(oldPub)
+	router := http.NewServeMux()
+	router.Handle("GET /.well-known/jwks.json", jwksServer)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	authClient, err := client.NewHTTPClient(server.URL, []string{"google"},
+		client.WithRefreshInterval(0), client.WithMinRefreshInterval(0),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	if _, err = authClient.VerifyToken(signTestToken(t, oldPriv, server.URL)); err != nil {
+		t.Fatalf("failed to verify token signed with known key: %s", err)
+	}
+
+	// Server rotates its key, client must pick up the new key when it sees the unknown key ID
+	jwksServer.setKeys(newPub, oldPub)
+	claims, err := authClient.VerifyToken(signTestToken(t, newPriv, server.URL))
+	if err != nil {
+		t.Fatalf("failed to verify token signed with rotated key: %s", err)
+	}
+	if claims.UserID != "123" {
+		t.Errorf("wrong user ID, want 123 got %s", claims.UserID)
+	}
+}
+
+func TestUnknownKeyRefreshIsRateLimited(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, unknownPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := &mockJWKSServer{}
+	jwksServer.setKeys(pub)
+	server := httptest.NewServer(jwksServer)
+	defer server.Close()
+
+	authClient, err := client.NewHTTPClient(server.URL, []string{"google"},
+		client.WithRefreshInterval(0), client.WithMinRefreshInterval(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	for range 5 {
+		if _, err = authClient.VerifyToken(signTestToken(t, unknownPriv, server.URL)); err == nil {
+			t.Fatal("token signed with unknown key should not verify")
+		}
+	}
+
+	jwksServer.mu.Lock()
+	defer jwksServer.mu.Unlock()
+	if jwksServer.fetches != 1 {
+		t.Errorf("expected only the initial key fetch, got %d fetches", jwksServer.fetches)
+	}
+}
+
+func TestVerifyTokenIssuerAndAudience(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := &mockJWKSServer{}
+	jwksServer.setKeys(pub)
+	server := httptest.NewServer(jwksServer)
+	defer server.Close()
+
+	authClient, err := client.NewHTTPClient(server.URL, []string{"google"},
+		client.WithRefreshInterval(0),
+		client.WithIssuer("https://auth.test.com"),
+		client.WithAudience("https://app.test.com"),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	sign := func(issuer, audience string) string {
+		claims := models.NewUserClaims("123", "user@test.com", time.Minute)
+		claims.Issuer = issuer
+		claims.Audience = jwt.ClaimStrings{audience}
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = models.Ed25519KeyID(pub)
+		signed, _ := token.SignedString(priv)
+		return signed
+	}
+
+	if _, err = authClient.VerifyToken(sign("https://auth.test.com", "https://app.test.com")); err != nil {
+		t.Errorf("failed to verify token with expected issuer and audience: %s", err)
+	}
+	if _, err = authClient.VerifyToken(sign("https://evil.com", "https://app.test.com")); !errors.Is(err, client.ErrInvalidToken) {
+		t.Errorf("token with wrong issuer should be %s, got %v", client.ErrInvalidToken, err)
+	}
+	if _, err = authClient.VerifyToken(sign("https://auth.test.com", "https://other.test.com")); !errors.Is(err, client.ErrInvalidToken) {
+		t.Errorf("token with wrong audience should be %s, got %v", client.ErrInvalidToken, err)
+	}
+}
+
+func TestKeyRefreshStopsWithContext(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := &mockJWKSServer{}
+	jwksServer.setKeys(pub)
+	server := httptest.NewServer(jwksServer)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := client.NewHTTPClient(server.URL, []string{"google"},
+		client.WithContext(ctx), client.WithRefreshInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	jwksServer.mu.Lock()
+	fetches := jwksServer.fetches
+	jwksServer.mu.Unlock()
+	if fetches < 2 {
+		t.Errorf("keys should be refreshed in the background, got %d fetches", fetches)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	jwksServer.mu.Lock()
+	defer jwksServer.mu.Unlock()
+	if jwksServer.fetches != fetches {
+		t.Errorf("refresh should stop with the context, fetches went from %d to %d", fetches, jwksServer.fetches)
+	}
+}
+
+func TestVerifyTokenDefaultIssuer(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksServer := &mockJWKSServer{}
+	jwksServer.setKeys(pub)
+	server := httptest.NewServer(jwksServer)
+	defer server.Close()
+
+	authClient, err := client.NewHTTPClient(server.URL, []string{"google"}, client.WithRefreshInterval(0))
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	if _, err = authClient.VerifyToken(signTestToken(t, priv, server.URL)); err != nil {
+		t.Errorf("token issued by the auth domain should be valid: %s", err)
+	}
+	if _, err = authClient.VerifyToken(signTestToken(t, priv, "https://evil.com")); !errors.Is(err, client.ErrInvalidToken) {
+		t.Errorf("token with another issuer should be %s, got %v", client.ErrInvalidToken, err)
+	}
+	if _, err = authClient.VerifyToken(signTestToken(t, priv, "")); !errors.Is(err, client.ErrInvalidToken) {
+		t.Errorf("token without an issuer should be %s, got %v", client.ErrInvalidToken, err)
+	}
+}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"context"
 	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/lattots/salpa/internal/models"
 	"github.com/lattots/salpa/internal/util"
@@ -11,27 +15,113 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var errKeyFetch = errors.New("couldn't refresh verification keys")
+
 type httpClient struct {
-	domain          string   // Domain of the auth service
-	providers       []string // OAuth2 providers like Google, Microsoft, Apple...
-	verificationKey ed25519.PublicKey
+	domain    string   // Domain of the auth service
+	providers []string // OAuth2 providers like Google, Microsoft, Apple...
+
+	keysMu sync.RWMutex
+	keys   map[string]ed25519.PublicKey // Verification keys by key ID
+
+	// fetchMu makes concurrent requests with the same unknown key ID wait for a single fetch
+	fetchMu     sync.Mutex
+	lastFetched time.Time
+
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+
+	// Expected iss and aud claims. The issuer defaults to the auth domain, the audience isn't checked when empty
+	issuer   string
+	audience string
+	// Allowed clock difference between the auth service and this client
+	leeway time.Duration
+
+	// Cancelling ctx stops the background refresh and aborts key fetches
+	ctx context.Context
+}
+
+const (
+	defaultRefreshInterval    = time.Hour
+	defaultMinRefreshInterval = 30 * time.Second
+	defaultLeeway             = 30 * time.Second
+)
+
+type Option func(*httpClient)
+
+// WithIssuer makes the client reject tokens that weren't issued by issuer. Without it, the issuer must be the auth domain.
+// Set it when the client reaches the auth service at another address than its public one.
+func WithIssuer(issuer string) Option {
+	return func(c *httpClient) {
+		c.issuer = issuer
+	}
 }
 
-func NewHTTPClient(authDomain string, providers []string) (AuthClient, error) {
+// WithAudience makes the client reject tokens that weren't issued for audience.
+func WithAudience(audience string) Option {
+	return func(c *httpClient) {
+		c.audience = audience
+	}
+}
+
+// WithLeeway sets the allowed clock skew when validating token expiration and issuing times.
+func WithLeeway(d time.Duration) Option {
+	return func(c *httpClient) {
+		c.leeway = d
+	}
+}
+
+// WithContext ties the client to ctx. When ctx is done, keys are no longer refreshed in the background.
+func WithContext(ctx context.Context) Option {
+	return func(c *httpClient) {
+		c.ctx = ctx
+	}
+}
+
+// WithRefreshInterval sets how often verification keys are refreshed in the background.
+// Zero disables background refresh.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(c *httpClient) {
+		c.refreshInterval = d
+	}
+}
+
+// WithMinRefreshInterval limits how often tokens with an unknown key ID can trigger a key refresh.
+func WithMinRefreshInterval(d time.Duration) Option {
+	return func(c *httpClient) {
+		c.minRefreshInterval = d
+	}
+}
+
+// NewHTTPClient creates a client that verifies access tokens with the keys published by the auth service.
+// Keys are refreshed in the background until the context of WithContext is done, or for the lifetime of the program
+// without it, so the client should be long lived.
+func NewHTTPClient(authDomain string, providers []string, opts ...Option) (AuthClient, error) {
 	if authDomain == "" {
 		return nil, errors.New("no auth domain provided for client")
 	}
 	if len(providers) == 0 {
 		return nil, errors.New("no providers")
 	}
-	verKey, err := GetVerificationKey(authDomain)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't get verification key: %w", err)
-	}
 	client := &httpClient{
-		domain:          authDomain,
-		providers:       providers,
-		verificationKey: verKey,
+		domain:             authDomain,
+		providers:          providers,
+		issuer:             authDomain,
+		refreshInterval:    defaultRefreshInterval,
+		minRefreshInterval: defaultMinRefreshInterval,
+		leeway:             defaultLeeway,
+		ctx:                context.Background(),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	if err := client.fetchKeys(); err != nil {
+		return nil, fmt.Errorf("couldn't get verification keys: %w", err)
+	}
+
+	if client.refreshInterval > 0 {
+		go client.refreshKeysPeriodically()
 	}
 	return client, nil
 }
@@ -45,9 +135,21 @@ func (c *httpClient) GetLoginURLs() []string {
 }
 
 func (c *httpClient) VerifyToken(tokenStr string) (*models.UserClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &models.UserClaims{}, c.getVerificationKey)
+	opts := []jwt.ParserOption{jwt.WithIssuedAt(), jwt.WithLeeway(c.leeway)}
+	if c.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(c.issuer))
+	}
+	if c.audience != "" {
+		opts = append(opts, jwt.WithAudience(c.audience))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenStr, &models.UserClaims{}, c.getVerificationKey, opts...)
+	// Failing to fetch the verification keys is a problem on our end, not with the token
+	if errors.Is(err, errKeyFetch) {
+		return nil, fmt.Errorf("error verifying access token: %w", err)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error parsing refresh token: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 	if !token.Valid {
 		return nil, ErrInvalidToken
@@ -60,5 +162,79 @@ func (c *httpClient) getVerificationKey(token *jwt.Token) (any, error) {
 	if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
 		return nil, errors.New("unexpected signing method")
 	}
-	return c.verificationKey, nil
+	kid, _ := token.Header["kid"].(string)
+
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	// Unknown key ID most likely means the auth service has rotated its signing key
+	if err := c.fetchKeysRateLimited(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errKeyFetch, err)
+	}
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown verification key: %s", kid)
+}
+
+func (c *httpClient) lookupKey(kid string) (ed25519.PublicKey, bool) {
+	c.keysMu.RLock()
+	defer c.keysMu.RUnlock()
+
+	// Tokens without a key ID can only be verified if there's no ambiguity about the key
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *httpClient) fetchKeysRateLimited() error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	if time.Since(c.lastFetched) < c.minRefreshInterval {
+		return nil
+	}
+	return c.fetchKeysLocked()
+}
+
+func (c *httpClient) fetchKeys() error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	return c.fetchKeysLocked()
+}
+
+// fetchKeysLocked replaces the key set with the keys currently published by the auth service.
+// Caller must hold fetchMu.
+func (c *httpClient) fetchKeysLocked() error {
+	keys, err := getVerificationKeys(c.ctx, c.domain)
+	c.lastFetched = time.Now()
+	if err != nil {
+		return err
+	}
+
+	c.keysMu.Lock()
+	c.keys = keys
+	c.keysMu.Unlock()
+	return nil
+}
+
+func (c *httpClient) refreshKeysPeriodically() {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Keep using the old keys if the auth service is temporarily unavailable
+		if err := c.fetchKeys(); err != nil {
+			log.Printf("failed to refresh verification keys: %s\n", err)
+		}
+	}
 }
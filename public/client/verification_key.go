@@ -1,16 +1,24 @@
 package client
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
+
+	"github.com/lattots/salpa/internal/models"
 )
 
+// Keys are fetched while verifying tokens, so an auth service that doesn't answer must not hang the requests
+var keyHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
 func GetVerificationKey(authServiceURL string) (ed25519.PublicKey, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/auth/verification-key", authServiceURL))
+	resp, err := keyHTTPClient.Get(fmt.Sprintf("%s/auth/verification-key", authServiceURL))
 	if err != nil {
 		return nil, err
 	}
@@ -42,3 +50,43 @@ func GetVerificationKey(authServiceURL string) (ed25519.PublicKey, error) {
 
 	return edKey, nil
 }
+
+// GetVerificationKeys fetches the JSON Web Key Set of the auth service and returns the keys by key ID.
+func GetVerificationKeys(authServiceURL string) (map[string]ed25519.PublicKey, error) {
+	return getVerificationKeys(context.Background(), authServiceURL)
+}
+
+func getVerificationKeys(ctx context.Context, authServiceURL string) (map[string]ed25519.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/.well-known/jwks.json", authServiceURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := keyHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var jwks models.JWKSet
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("error decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey)
+	for _, jwk := range jwks.Keys {
+		// Skip keys this client can't use instead of failing on them
+		key, err := jwk.Ed25519PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no Ed25519 keys in JWKS")
+	}
+	return keys, nil
+}
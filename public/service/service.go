@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"slices"
 
+	"github.com/lattots/salpa/internal/models"
 	"github.com/lattots/salpa/public/client"
 )
 
@@ -33,18 +34,8 @@ func NewDefaultService(authorizer Authorizer, authClient client.AuthClient) *Def
 
 func (s *DefaultAuthService) AllowOnly(handler http.HandlerFunc, securityLevels []string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userClaims, err := client.GetClaims(s.authClient, r)
-		if errors.Is(err, client.ErrTokenNotFound) {
-			http.Error(w, "user is not authenticated", http.StatusUnauthorized)
-			return
-		}
-		if errors.Is(err, client.ErrInvalidToken) {
-			http.Error(w, "access token is invalid", http.StatusUnauthorized)
-			return
-		}
-		if err != nil {
-			log.Printf("failed to get user claims: %s\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		userClaims, ok := requestClaims(w, r, s.authClient)
+		if !ok {
 			return
 		}
 
@@ -66,18 +57,8 @@ func (s *DefaultAuthService) AllowOnly(handler http.HandlerFunc, securityLevels
 
 func (s *DefaultAuthService) AllowPathVal(handler http.HandlerFunc, pathValName string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userClaims, err := client.GetClaims(s.authClient, r)
-		if errors.Is(err, client.ErrTokenNotFound) {
-			http.Error(w, "user is not authenticated", http.StatusUnauthorized)
-			return
-		}
-		if errors.Is(err, client.ErrInvalidToken) {
-			http.Error(w, "access token is invalid", http.StatusUnauthorized)
-			return
-		}
-		if err != nil {
-			log.Printf("failed to get user claims: %s\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		userClaims, ok := requestClaims(w, r, s.authClient)
+		if !ok {
 			return
 		}
 
@@ -103,6 +84,90 @@ func (s *DefaultAuthService) AllowPathVal(handler http.HandlerFunc, pathValName
 	}
 }
 
+// ClaimsAuthService authorizes requests with the roles and claims of the access token alone.
+// Unlike DefaultAuthService it needs no Authorizer, so no database is queried on every request.
+// Roles and claims are set at login by the claim rules or the pre-issuance hook of the Salpa server.
+type ClaimsAuthService struct {
+	authClient client.AuthClient
+}
+
+func NewClaimsService(authClient client.AuthClient) *ClaimsAuthService {
+	return &ClaimsAuthService{authClient: authClient}
+}
+
+// AllowOnly allows users who have any of the given roles.
+func (s *ClaimsAuthService) AllowOnly(handler http.HandlerFunc, roles []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := requestClaims(w, r, s.authClient)
+		if !ok {
+			return
+		}
+
+		if !userClaims.HasRole(roles...) {
+			http.Error(w, "user is not allowed to access this resource", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// AllowPathVal allows users whose claim of the same name equals the path value.
+// userID, email and custom claims with a string value can be used.
+func (s *ClaimsAuthService) AllowPathVal(handler http.HandlerFunc, pathValName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userClaims, ok := requestClaims(w, r, s.authClient)
+		if !ok {
+			return
+		}
+
+		pathVal := r.PathValue(pathValName)
+		if pathVal == "" {
+			http.Error(w, fmt.Sprintf("%s is not set in query path", pathValName), http.StatusBadRequest)
+			return
+		}
+
+		userVal, found := claimValue(userClaims, pathValName)
+		if !found || userVal != pathVal {
+			http.Error(w, "user is not allowed to access this resource", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func claimValue(claims *models.UserClaims, name string) (string, bool) {
+	switch name {
+	case "userID":
+		return claims.UserID, true
+	case "email":
+		return claims.Email, true
+	}
+	value, ok := claims.Extra[name].(string)
+	return value, ok
+}
+
+// requestClaims returns the claims of the access token in the request.
+// If there is no valid token it writes the error response and returns false.
+func requestClaims(w http.ResponseWriter, r *http.Request, authClient client.AuthClient) (*models.UserClaims, bool) {
+	userClaims, err := client.GetClaims(authClient, r)
+	if errors.Is(err, client.ErrTokenNotFound) {
+		http.Error(w, "user is not authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+	if errors.Is(err, client.ErrInvalidToken) {
+		http.Error(w, "access token is invalid", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to get user claims: %s\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return userClaims, true
+}
+
 // Authorizer interface to be implemented by user application.
 // This is most likely going to be a database that maps user emails to user attributes.
 type Authorizer interface {
@@ -0,0 +1,90 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lattots/salpa/internal/models"
+	"github.com/lattots/salpa/public/client"
+	"github.com/lattots/salpa/public/service"
+)
+
+// stubClient accepts the token "valid" and returns the same claims for it
+type stubClient struct {
+	claims models.UserClaims
+}
+
+func (c stubClient) GetLoginURLs() []string {
+	return nil
+}
+
+func (c stubClient) VerifyToken(token string) (*models.UserClaims, error) {
+	if token != "valid" {
+		return nil, client.ErrInvalidToken
+	}
+	return &c.claims, nil
+}
+
+func newClaimsService() *service.ClaimsAuthService {
+	return service.NewClaimsService(stubClient{claims: models.UserClaims{
+		UserID: "user-1",
+		Email:  "alice@example.com",
+		Roles:  []string{"user"},
+		Extra:  map[string]any{"tenantID": "acme"},
+	}})
+}
+
+func serve(handler http.HandlerFunc, pattern, path, token string) int {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token})
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {}
+
+func TestClaimsServiceAllowOnly(t *testing.T) {
+	s := newClaimsService()
+
+	tests := []struct {
+		roles []string
+		token string
+		want  int
+	}{
+		{[]string{"admin", "user"}, "valid", http.StatusOK},
+		{[]string{"admin"}, "valid", http.StatusForbidden},
+		{[]string{"user"}, "", http.StatusUnauthorized},
+		{[]string{"user"}, "invalid", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		if got := serve(s.AllowOnly(ok, test.roles), "/", "/", test.token); got != test.want {
+			t.Errorf("roles %v with token %q: want %d got %d\n", test.roles, test.token, test.want, got)
+		}
+	}
+}
+
+func TestClaimsServiceAllowPathVal(t *testing.T) {
+	s := newClaimsService()
+
+	tests := []struct {
+		name, pattern, path string
+		want                int
+	}{
+		{"userID", "/users/{userID}", "/users/user-1", http.StatusOK},
+		{"userID", "/users/{userID}", "/users/user-2", http.StatusForbidden},
+		{"tenantID", "/tenants/{tenantID}", "/tenants/acme", http.StatusOK},
+		{"tenantID", "/tenants/{tenantID}", "/tenants/other", http.StatusForbidden},
+		{"teamID", "/teams/{teamID}", "/teams/acme", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if got := serve(s.AllowPathVal(ok, test.name), test.pattern, test.path, "valid"); got != test.want {
+			t.Errorf("%s: want %d got %d\n", test.path, test.want, got)
+		}
+	}
+}